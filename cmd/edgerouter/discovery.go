@@ -183,6 +183,8 @@ func discoveryEntry() *cobra.Command {
 
 	cmd.AddCommand(discoveryPutEntry())
 
+	cmd.AddCommand(discoveryIPRulesEntry())
+
 	cmd.AddCommand(&cobra.Command{
 		Use:   "rm [appId]",
 		Short: "Delete application",
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/erdiscovery"
+	"github.com/function61/gokit/osutil"
+	"github.com/scylladb/termtables"
+	"github.com/spf13/cobra"
+)
+
+func discoveryIPRulesEntry() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "iprules",
+		Short: "IP rules (access control) related commands",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "ls",
+		Short: "Lists IP rules",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(ipRulesList())
+		},
+	})
+
+	cmd.AddCommand(ipRulesAddEntry())
+	cmd.AddCommand(ipRulesRemoveEntry())
+
+	return cmd
+}
+
+func ipRulesAddEntry() *cobra.Command {
+	comment := ""
+	force := false
+
+	cmd := &cobra.Command{
+		Use:   "add <prefix> [appId...]",
+		Short: "Add (or replace) rule that allows the prefix to access the apps (no apps = all apps)",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(ipRulesAdd(erconfig.IPRule{
+				Prefix:  args[0],
+				Apps:    args[1:],
+				Comment: comment,
+			}, force))
+		},
+	}
+
+	cmd.Flags().StringVarP(&comment, "comment", "", comment, "Comment, like who or what the IPs are")
+	cmd.Flags().BoolVarP(&force, "force", "", force, "Ok to add the first rule (which turns on IP filtering)")
+
+	return cmd
+}
+
+func ipRulesRemoveEntry() *cobra.Command {
+	force := false
+
+	cmd := &cobra.Command{
+		Use:   "rm <prefix>",
+		Short: "Remove rule",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(ipRulesRemove(args[0], force))
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "", force, "Ok to remove the last rule (which turns off IP filtering)")
+
+	return cmd
+}
+
+func ipRulesList() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reader, _, err := newDefaultIPRulesDiscovery()
+	if err != nil {
+		return err
+	}
+
+	rules, err := reader.ReadIPRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	tbl := termtables.CreateTable()
+	tbl.AddHeaders("Prefix", "Apps", "Comment")
+
+	for _, rule := range rules {
+		apps := strings.Join(rule.Apps, ", ")
+		if apps == "" {
+			apps = "(all)"
+		}
+
+		tbl.AddRow(rule.Prefix, apps, rule.Comment)
+	}
+
+	fmt.Println(tbl.Render())
+
+	return nil
+}
+
+func ipRulesAdd(rule erconfig.IPRule, force bool) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	reader, writer, err := newDefaultIPRulesDiscovery()
+	if err != nil {
+		return err
+	}
+
+	existing, err := reader.ReadIPRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(existing) == 0 && !force {
+		return errors.New("no IP rules yet. the first rule turns on IP filtering (IPs not matching any rule are denied). use '--force' if you're sure")
+	}
+
+	return writer.AddIPRule(ctx, rule)
+}
+
+func ipRulesRemove(prefix string, force bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	reader, writer, err := newDefaultIPRulesDiscovery()
+	if err != nil {
+		return err
+	}
+
+	existing, err := reader.ReadIPRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, rule := range existing {
+		if rule.Prefix == prefix {
+			found = true
+		}
+	}
+
+	if !found {
+		return errors.New("rule to remove not found")
+	}
+
+	if len(existing) == 1 && !force {
+		return errors.New("this is the last IP rule. removing it turns off IP filtering (all IPs are allowed). use '--force' if you're sure")
+	}
+
+	return writer.RemoveIPRule(ctx, prefix)
+}
+
+func newDefaultIPRulesDiscovery() (erdiscovery.IPRulesReader, erdiscovery.IPRulesWriter, error) {
+	discoverySvc, err := newDefaultDiscoveryWithoutLogger()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader, isReader := discoverySvc.(erdiscovery.IPRulesReader)
+	writer, isWriter := discoverySvc.(erdiscovery.IPRulesWriter)
+	if !isReader || !isWriter {
+		return nil, nil, errors.New("default discovery doesn't store IP rules")
+	}
+
+	return reader, writer, nil
+}
@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"os"
 
+	"github.com/function61/edgerouter/pkg/erbackend/authbasicbackend"
 	"github.com/function61/edgerouter/pkg/erbackend/turbochargerbackend/turbochargererdeploy"
 	"github.com/function61/edgerouter/pkg/erlambdacli"
 	"github.com/function61/edgerouter/pkg/ers3cli"
@@ -27,6 +28,7 @@ func main() {
 	app.AddCommand(discoveryEntry())
 	app.AddCommand(serveEntry())
 	app.AddCommand(turbochargerEntrypoint())
+	app.AddCommand(authbasicbackend.CLIEntrypoint())
 
 	app.AddCommand(ers3cli.Entrypoint())
 	app.AddCommand(erlambdacli.Entrypoint())
@@ -0,0 +1,123 @@
+// Basic auth with a user list of hashed passwords
+package authbasicbackend
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/function61/edgerouter/pkg/erbackend/authidentity"
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/gokit/httputils"
+)
+
+const (
+	defaultRealm = "Restricted"
+
+	// browsers send the credentials with each request, and hashes are slow by design
+	verifiedCacheMaxSize = 1000
+)
+
+func New(opts erconfig.BackendOptsAuthBasic, authorizedBackend http.Handler) http.Handler {
+	realm := opts.Realm
+	if realm == "" {
+		realm = defaultRealm
+	}
+
+	users := map[string]erconfig.AuthBasicUser{}
+	for _, user := range opts.Users {
+		users[user.Username] = user
+	}
+
+	return &backend{
+		realm:             realm,
+		users:             users,
+		verified:          map[[sha256.Size]byte]bool{},
+		authorizedBackend: authorizedBackend,
+	}
+}
+
+type backend struct {
+	realm             string
+	users             map[string]erconfig.AuthBasicUser
+	authorizedBackend http.Handler
+
+	verifiedMu sync.Mutex
+	verified   map[[sha256.Size]byte]bool // sha256(username, password) of credentials whose hash matched
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authidentity.RemoveClientSupplied(r)
+
+	user := b.authenticate(r)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+b.realm+`", charset="UTF-8"`)
+		httputils.Error(w, http.StatusUnauthorized)
+		return
+	}
+
+	if !pathAllowed(r.URL.Path, user.AllowedPathPrefixes) {
+		httputils.Error(w, http.StatusForbidden)
+		return
+	}
+
+	// like in auth_v0, the origin doesn't need (and might not expect) the credentials
+	r.Header.Del("Authorization")
+
+	authidentity.SetUser(r, user.Username)
+
+	b.authorizedBackend.ServeHTTP(w, r)
+}
+
+func (b *backend) authenticate(r *http.Request) *erconfig.AuthBasicUser {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+
+	user, found := b.users[username]
+	if !found {
+		// spend the same time as with a wrong password, so usernames can't be enumerated by timing
+		_ = verifyPassword(password, dummyHash)
+		return nil
+	}
+
+	cacheKey := sha256.Sum256([]byte(username + "\x00" + password))
+
+	b.verifiedMu.Lock()
+	cached := b.verified[cacheKey]
+	b.verifiedMu.Unlock()
+
+	if !cached {
+		if err := verifyPassword(password, user.PasswordHash); err != nil {
+			return nil
+		}
+
+		b.verifiedMu.Lock()
+		if len(b.verified) >= verifiedCacheMaxSize {
+			clear(b.verified)
+		}
+		b.verified[cacheKey] = true
+		b.verifiedMu.Unlock()
+	}
+
+	return &user
+}
+
+// prefix "/grafana" allows "/grafana" and "/grafana/..." but not "/grafanax"
+func pathAllowed(path string, allowedPrefixes []string) bool {
+	if len(allowedPrefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range allowedPrefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,77 @@
+package authbasicbackend
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/gokit/assert"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestIntegration(t *testing.T) {
+	joeHash, err := HashPassword("joesSecret", HashAlgorithmBcrypt)
+	assert.Ok(t, err)
+
+	maryHash, err := HashPassword("marysSecret", HashAlgorithmArgon2id)
+	assert.Ok(t, err)
+
+	authMiddleware := New(erconfig.BackendOptsAuthBasic{
+		Users: []erconfig.AuthBasicUser{
+			{Username: "joe", PasswordHash: joeHash},
+			{Username: "mary", PasswordHash: maryHash, AllowedPathPrefixes: []string{"/grafana/", "/prometheus"}},
+		},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			panic("got authorization header in origin")
+		}
+
+		_, _ = w.Write([]byte("welcome " + r.Header.Get("X-Authenticated-User")))
+	}))
+
+	roundTrip := func(path string, username string, password string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		req.Header.Set("X-Authenticated-User", "admin") // spoofing attempt
+
+		response := httptest.NewRecorder()
+		authMiddleware.ServeHTTP(response, req)
+
+		return response.Result().Status + ": " + response.Body.String()
+	}
+
+	assert.EqualString(t, roundTrip("/", "", ""), "401 Unauthorized: Unauthorized\n")
+	assert.EqualString(t, roundTrip("/", "joe", "joesSecret"), "200 OK: welcome joe")
+	assert.EqualString(t, roundTrip("/", "joe", "joesSecret"), "200 OK: welcome joe") // cached
+	assert.EqualString(t, roundTrip("/", "joe", "marysSecret"), "401 Unauthorized: Unauthorized\n")
+	assert.EqualString(t, roundTrip("/", "JOE", "joesSecret"), "401 Unauthorized: Unauthorized\n")
+	assert.EqualString(t, roundTrip("/", "nobody", "joesSecret"), "401 Unauthorized: Unauthorized\n")
+	assert.EqualString(t, roundTrip("/grafana/d/overview", "mary", "marysSecret"), "200 OK: welcome mary")
+	assert.EqualString(t, roundTrip("/prometheus", "mary", "marysSecret"), "200 OK: welcome mary")
+	assert.EqualString(t, roundTrip("/prometheusx", "mary", "marysSecret"), "403 Forbidden: Forbidden\n")
+	assert.EqualString(t, roundTrip("/", "mary", "marysSecret"), "403 Forbidden: Forbidden\n")
+	assert.EqualString(t, roundTrip("/grafana/", "mary", "joesSecret"), "401 Unauthorized: Unauthorized\n")
+}
+
+func TestVerifyPassword(t *testing.T) {
+	// parameters must be read from the hash, not assumed to be what we currently hash with
+	salt := []byte("somesalt")
+	otherParams := "$argon2id$v=19$m=8192,t=1,p=2$" + base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("hunter2"), salt, 1, 8192, 2, 24))
+
+	assert.Ok(t, verifyPassword("hunter2", otherParams))
+	assert.Assert(t, verifyPassword("hunter3", otherParams) == errPasswordMismatch)
+
+	assert.EqualString(t, verifyPassword("hunter2", "$argon2id$v=19$m=8192").Error(), "argon2id: invalid hash format")
+	assert.EqualString(t, verifyPassword("hunter2", "$argon2id$v=16$m=8192,t=1,p=2$c29tZXNhbHQ$AAAA").Error(), "argon2id: unsupported version")
+
+	bcryptHash, err := HashPassword("hunter2", HashAlgorithmBcrypt)
+	assert.Ok(t, err)
+
+	assert.Ok(t, verifyPassword("hunter2", bcryptHash))
+	assert.Assert(t, verifyPassword("hunter3", bcryptHash) == errPasswordMismatch)
+}
@@ -0,0 +1,97 @@
+package authbasicbackend
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/function61/gokit/osutil"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func CLIEntrypoint() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "auth-basic",
+		Short: "Basic auth (auth_basic backend) related commands",
+	}
+
+	argon2id := false
+
+	hashCmd := &cobra.Command{
+		Use:   "hash-password",
+		Short: "Hash a password (read from terminal or stdin) for auth_basic user list",
+		Args:  cobra.NoArgs,
+		Run: func(_ *cobra.Command, _ []string) {
+			algorithm := HashAlgorithmBcrypt
+			if argon2id {
+				algorithm = HashAlgorithmArgon2id
+			}
+
+			osutil.ExitIfError(hashPassword(algorithm, os.Stdin, os.Stdout))
+		},
+	}
+	hashCmd.Flags().BoolVarP(&argon2id, "argon2id", "", argon2id, "Use argon2id instead of bcrypt")
+
+	cmd.AddCommand(hashCmd)
+
+	return cmd
+}
+
+func hashPassword(algorithm HashAlgorithm, stdin *os.File, output io.Writer) error {
+	password, err := readPassword(stdin)
+	if err != nil {
+		return err
+	}
+
+	if password == "" {
+		return errors.New("empty password")
+	}
+
+	hash, err := HashPassword(password, algorithm)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(output, hash)
+	return err
+}
+
+// prompts (without echo) if stdin is a terminal. otherwise reads first line (for scripting).
+func readPassword(stdin *os.File) (string, error) {
+	if !term.IsTerminal(int(stdin.Fd())) {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	prompt := func(text string) (string, error) {
+		fmt.Fprint(os.Stderr, text)
+		defer fmt.Fprintln(os.Stderr)
+
+		password, err := term.ReadPassword(int(stdin.Fd()))
+		return string(password), err
+	}
+
+	password, err := prompt("Password: ")
+	if err != nil {
+		return "", err
+	}
+
+	again, err := prompt("Password (again): ")
+	if err != nil {
+		return "", err
+	}
+
+	if password != again {
+		return "", errors.New("passwords do not match")
+	}
+
+	return password, nil
+}
@@ -0,0 +1,110 @@
+package authbasicbackend
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type HashAlgorithm string
+
+const (
+	HashAlgorithmBcrypt   HashAlgorithm = "bcrypt"
+	HashAlgorithmArgon2id HashAlgorithm = "argon2id"
+)
+
+// https://cheatsheetseries.owasp.org/cheatsheets/Password_Storage_Cheat_Sheet.html#argon2id
+const (
+	argon2MemoryKiB   = 19 * 1024
+	argon2Iterations  = 2
+	argon2Parallelism = 1
+	argon2SaltLen     = 16
+	argon2KeyLen      = 32
+)
+
+var errPasswordMismatch = errors.New("password mismatch")
+
+// for unknown users. bcrypt of a random password
+var dummyHash = "$2a$10$DnahalkRR73oLm9sYhCD9uyTwF/Rl4kXvvcX0gYCauA1o4SE1bhlm"
+
+func HashPassword(password string, algorithm HashAlgorithm) (string, error) {
+	switch algorithm {
+	case HashAlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case HashAlgorithmArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, argon2Iterations, argon2MemoryKiB, argon2Parallelism, argon2KeyLen)
+
+		// PHC string format, same as the argon2 reference implementation outputs
+		return fmt.Sprintf(
+			"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version,
+			argon2MemoryKiB,
+			argon2Iterations,
+			argon2Parallelism,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+}
+
+func verifyPassword(password string, hash string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return verifyArgon2id(password, hash)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return errPasswordMismatch
+	}
+
+	return nil
+}
+
+// "$argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>"
+func verifyArgon2id(password string, hash string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return errors.New("argon2id: invalid hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return errors.New("argon2id: unsupported version")
+	}
+
+	var memory, iterations uint32
+	var parallelism uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return fmt.Errorf("argon2id: parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return fmt.Errorf("argon2id: salt: %w", err)
+	}
+
+	expectedKey, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return fmt.Errorf("argon2id: key: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, uint32(len(expectedKey)))
+
+	if subtle.ConstantTimeCompare(key, expectedKey) != 1 {
+		return errPasswordMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// External authorization service decides (like nginx's auth_request or Traefik's ForwardAuth)
+package authforwardbackend
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erbackend/authidentity"
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/gokit/httputils"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+)
+
+// https://datatracker.ietf.org/doc/html/rfc9110#section-7.6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func New(
+	opts erconfig.BackendOptsAuthForward,
+	authorizedBackend http.Handler,
+	logger *slog.Logger,
+) http.Handler {
+	timeout := defaultTimeout
+	if opts.TimeoutSeconds != 0 {
+		timeout = time.Duration(opts.TimeoutSeconds) * time.Second
+	}
+
+	return &backend{
+		authURL:         opts.URL,
+		responseHeaders: opts.ResponseHeaders,
+		timeout:         timeout,
+		client: &http.Client{
+			// redirects (like to a login page) are meant for the client
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		authorizedBackend: authorizedBackend,
+		logger:            logger,
+	}
+}
+
+type backend struct {
+	authURL           string
+	responseHeaders   []string
+	timeout           time.Duration
+	client            *http.Client
+	authorizedBackend http.Handler
+	logger            *slog.Logger
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authidentity.RemoveClientSupplied(r)
+
+	// client could try to pass these off as coming from the auth service
+	for _, header := range b.responseHeaders {
+		r.Header.Del(header)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), b.timeout)
+	defer cancel()
+
+	authReq, err := http.NewRequestWithContext(ctx, http.MethodGet, b.authURL, nil)
+	if err != nil {
+		httputils.Error(w, http.StatusInternalServerError)
+		return
+	}
+
+	authReq.Header = requestHeadersForAuthService(r)
+
+	authRes, err := b.client.Do(authReq)
+	if err != nil {
+		b.logger.Error("auth service", "err", err)
+		http.Error(w, "auth service unavailable", http.StatusBadGateway)
+		return
+	}
+	defer authRes.Body.Close()
+
+	if authRes.StatusCode < 200 || authRes.StatusCode > 299 { // denied => auth service's response is the response
+		for key, values := range authRes.Header {
+			w.Header()[key] = values
+		}
+		for _, header := range hopByHopHeaders {
+			w.Header().Del(header)
+		}
+
+		w.WriteHeader(authRes.StatusCode)
+
+		_, _ = io.Copy(w, authRes.Body)
+		return
+	}
+
+	for _, header := range b.responseHeaders {
+		if values := authRes.Header.Values(header); len(values) > 0 {
+			r.Header[http.CanonicalHeaderKey(header)] = values
+		}
+	}
+
+	// client-supplied one was removed, so this came from the auth service
+	if user := r.Header.Get(authidentity.UserHeader); user != "" {
+		authidentity.SetUser(r, user)
+	}
+
+	b.authorizedBackend.ServeHTTP(w, r)
+}
+
+// original request's headers (the auth service decides on cookies, Authorization etc.) and what
+// else it needs to know about the original request.
+// (same headers that Traefik sends, so existing auth services work)
+func requestHeadersForAuthService(r *http.Request) http.Header {
+	headers := r.Header.Clone()
+	for _, header := range hopByHopHeaders {
+		headers.Del(header)
+	}
+
+	// there's no body
+	headers.Del("Content-Length")
+	headers.Del("Content-Type")
+
+	proto := "https"
+	if r.TLS == nil {
+		proto = "http"
+	}
+
+	headers.Set("X-Forwarded-Method", r.Method)
+	headers.Set("X-Forwarded-Proto", proto)
+	headers.Set("X-Forwarded-Host", r.Host)
+	headers.Set("X-Forwarded-Uri", r.URL.RequestURI())
+
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		headers.Set("X-Forwarded-For", clientIP)
+	}
+
+	return headers
+}
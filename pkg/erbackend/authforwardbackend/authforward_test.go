@@ -0,0 +1,90 @@
+package authforwardbackend
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+)
+
+func TestAuthForward(t *testing.T) {
+	var authServiceSaw string
+
+	authService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authServiceSaw = strings.Join([]string{
+			r.Method,
+			r.Header.Get("X-Forwarded-Method"),
+			r.Header.Get("X-Forwarded-Proto"),
+			r.Header.Get("X-Forwarded-Host"),
+			r.Header.Get("X-Forwarded-Uri"),
+			r.Header.Get("X-Forwarded-For"),
+		}, " ")
+
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			w.Header().Set("X-Authenticated-User", "joe")
+			w.Header().Add("X-Auth-Role", "admin")
+			w.Header().Add("X-Auth-Role", "billing")
+			w.Header().Set("X-Not-Copied", "secret")
+			w.WriteHeader(http.StatusNoContent)
+		case "Bearer expired":
+			http.Redirect(w, r, "https://login.example.com/?return=x", http.StatusFound)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			http.Error(w, "go away", http.StatusUnauthorized)
+		}
+	}))
+	defer authService.Close()
+
+	newBackend := func(authURL string) http.Handler {
+		return New(erconfig.BackendOptsAuthForward{
+			URL:             authURL,
+			ResponseHeaders: []string{"X-Authenticated-User", "x-auth-role"},
+		}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(strings.Join([]string{
+				r.Method + " " + r.URL.RequestURI(),
+				r.Header.Get("X-Authenticated-User"),
+				strings.Join(r.Header.Values("X-Auth-Role"), ","),
+				r.Header.Get("X-Not-Copied"),
+				readAll(t, r.Body),
+			}, " | ")))
+		}), slogshim.NewWithOutput(io.Discard))
+	}
+
+	backend := newBackend(authService.URL + "/check")
+
+	roundTrip := func(authorization string) string {
+		req := httptest.NewRequest(http.MethodPost, "http://api.example.com/orders?id=1", strings.NewReader("payload"))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", authorization)
+		req.Header.Set("X-Auth-Role", "superuser") // spoofing attempt
+
+		res := httptest.NewRecorder()
+		backend.ServeHTTP(res, req)
+
+		return res.Result().Status + " " + res.Header().Get("Location") + res.Header().Get("WWW-Authenticate") + ": " + res.Body.String()
+	}
+
+	assert.EqualString(t, roundTrip("Bearer good"), "200 OK : POST /orders?id=1 | joe | admin,billing |  | payload")
+	assert.EqualString(t, authServiceSaw, "GET POST http api.example.com /orders?id=1 192.0.2.1")
+
+	assert.EqualString(t, roundTrip("Bearer bad"), `401 Unauthorized Bearer realm="api": go away`+"\n")
+	assert.EqualString(t, roundTrip("Bearer expired"), `302 Found https://login.example.com/?return=x: <a href="https://login.example.com/?return=x">Found</a>.`+"\n\n")
+
+	authService.Close()
+	assert.EqualString(t, roundTrip("Bearer good"), "502 Bad Gateway : auth service unavailable\n")
+}
+
+func readAll(t *testing.T, r io.Reader) string {
+	t.Helper()
+
+	content, err := io.ReadAll(r)
+	assert.Ok(t, err)
+
+	return string(content)
+}
@@ -0,0 +1,55 @@
+// Headers by which auth backends tell the origin who the user is
+package authidentity
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const (
+	HeaderPrefix = "X-Authenticated-"
+	UserHeader   = HeaderPrefix + "User" // user ID, username, email or certificate subject (depends on the auth backend)
+)
+
+// origins trust these headers, so we can't let clients send them
+func RemoveClientSupplied(r *http.Request) {
+	for key := range r.Header {
+		if strings.HasPrefix(key, HeaderPrefix) {
+			r.Header.Del(key)
+		}
+	}
+}
+
+// tells the origin who the user is. if the request has an `Identity`, it's recorded there too.
+func SetUser(r *http.Request, user string) {
+	r.Header.Set(UserHeader, user)
+
+	if identity, ok := r.Context().Value(identityKey{}).(*Identity); ok {
+		identity.User = user
+	}
+}
+
+// who the auth backend said the user is, for Edgerouter's own use (like access logs). headers can't
+// be used for this, since for apps without an auth backend they're whatever the client sent.
+type Identity struct {
+	User string // empty if no auth backend authenticated the request
+}
+
+type identityKey struct{}
+
+// empty if no auth backend authenticated the request (or the request has no `Identity`)
+func User(r *http.Request) string {
+	if identity, ok := r.Context().Value(identityKey{}).(*Identity); ok {
+		return identity.User
+	}
+
+	return ""
+}
+
+// the returned request's auth backends record the user in the returned `Identity`
+func WithIdentity(r *http.Request) (*http.Request, *Identity) {
+	identity := &Identity{}
+
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)), identity
+}
@@ -0,0 +1,137 @@
+// Mutual TLS (client certificate) -based authentication
+package authmtlsbackend
+
+// The TLS handshake only requests the certificate (the listener has no idea which CAs the
+// apps of the hostname trust), so the verification happens here.
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/function61/edgerouter/pkg/erbackend/authidentity"
+	"github.com/function61/edgerouter/pkg/erconfig"
+)
+
+const (
+	subjectHeader = authidentity.HeaderPrefix + "Cert-Subject" // full DN, like "CN=billing,O=Example"
+)
+
+// returned when the client certificate couldn't have been sent because the connection was made
+// for another hostname (HTTP/2 connection reuse)
+var errMisdirected = errors.New("connection was not made for this hostname")
+
+func New(opts erconfig.BackendOptsAuthMtls, authorizedBackend http.Handler) (http.Handler, error) {
+	caCerts, err := opts.CertPool()
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend{
+		caCerts:           caCerts,
+		allowedSubjects:   opts.AllowedSubjects,
+		authorizedBackend: authorizedBackend,
+	}, nil
+}
+
+type backend struct {
+	caCerts           *x509.CertPool
+	allowedSubjects   []string
+	authorizedBackend http.Handler
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authidentity.RemoveClientSupplied(r)
+
+	cert, identity, err := b.authenticate(r)
+	if err != nil {
+		if err == errMisdirected { // client retries with a new connection
+			http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+		} else {
+			http.Error(w, "client certificate: "+err.Error(), http.StatusForbidden)
+		}
+		return
+	}
+
+	authidentity.SetUser(r, identity)
+	r.Header.Set(subjectHeader, cert.Subject.String())
+
+	b.authorizedBackend.ServeHTTP(w, r)
+}
+
+// returns the identity from the certificate that got the client in
+func (b *backend) authenticate(r *http.Request) (*x509.Certificate, string, error) {
+	if r.TLS == nil {
+		return nil, "", errors.New("TLS required")
+	}
+
+	if len(r.TLS.PeerCertificates) == 0 {
+		// browsers reuse HTTP/2 connections across hostnames that the server certificate covers,
+		// and the handshake of the other hostname didn't request a certificate.
+		hostname := r.Host
+		if withoutPort, _, err := net.SplitHostPort(r.Host); err == nil {
+			hostname = withoutPort
+		}
+
+		if !strings.EqualFold(hostname, r.TLS.ServerName) {
+			return nil, "", errMisdirected
+		}
+
+		return nil, "", errors.New("not given")
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         b.caCerts,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, "", err
+	}
+
+	identities := certIdentities(cert)
+
+	if len(b.allowedSubjects) == 0 { // any certificate from our CAs
+		if len(identities) == 0 {
+			return nil, "", errors.New("no subject CN or SANs")
+		}
+
+		return cert, identities[0], nil
+	}
+
+	for _, identity := range identities {
+		if slices.Contains(b.allowedSubjects, identity) {
+			return cert, identity, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("subject not allowed: %s", cert.Subject.String())
+}
+
+// CN first, since it's usually the "name" of the client
+func certIdentities(cert *x509.Certificate) []string {
+	identities := []string{}
+
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	return identities
+}
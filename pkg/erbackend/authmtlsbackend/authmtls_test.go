@@ -0,0 +1,107 @@
+package authmtlsbackend
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/gokit/assert"
+)
+
+func TestAuthenticate(t *testing.T) {
+	ourCA := newTestCA(t, "Our CA")
+	otherCA := newTestCA(t, "Other CA")
+
+	billing := ourCA.issue(t, "billing", x509.ExtKeyUsageClientAuth)
+	reporting := ourCA.issue(t, "reporting", x509.ExtKeyUsageClientAuth)
+	serverCert := ourCA.issue(t, "billing", x509.ExtKeyUsageServerAuth)
+	impostor := otherCA.issue(t, "billing", x509.ExtKeyUsageClientAuth)
+
+	backend, err := New(erconfig.BackendOptsAuthMtls{
+		CACertificates:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ourCA.cert.Raw})),
+		AllowedSubjects: []string{"billing"},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("welcome " + r.Header.Get("X-Authenticated-User") + " (" + r.Header.Get("X-Authenticated-Cert-Subject") + ")"))
+	}))
+	assert.Ok(t, err)
+
+	roundTrip := func(connState *tls.ConnectionState) string {
+		req := httptest.NewRequest(http.MethodGet, "https://api.example.com/", nil)
+		req.TLS = connState
+		req.Header.Set("X-Authenticated-User", "admin") // spoofing attempt
+
+		res := httptest.NewRecorder()
+		backend.ServeHTTP(res, req)
+
+		return res.Result().Status + ": " + res.Body.String()
+	}
+
+	withCert := func(certs ...*x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{ServerName: "api.example.com", PeerCertificates: certs}
+	}
+
+	assert.EqualString(t, roundTrip(withCert(billing)), "200 OK: welcome billing (CN=billing)")
+	assert.EqualString(t, roundTrip(withCert(reporting)), "403 Forbidden: client certificate: subject not allowed: CN=reporting\n")
+	assert.EqualString(t, roundTrip(withCert(serverCert)), "403 Forbidden: client certificate: x509: certificate specifies an incompatible key usage\n")
+	assert.EqualString(t, roundTrip(withCert(impostor)), "403 Forbidden: client certificate: x509: certificate signed by unknown authority\n")
+	assert.EqualString(t, roundTrip(withCert()), "403 Forbidden: client certificate: not given\n")
+	assert.EqualString(t, roundTrip(nil), "403 Forbidden: client certificate: TLS required\n")
+	assert.EqualString(t, roundTrip(&tls.ConnectionState{ServerName: "www.example.com"}), "421 Misdirected Request: connection was not made for this hostname\n")
+}
+
+type testCA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Ok(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Ok(t, err)
+
+	return &testCA{key, cert}
+}
+
+func (c *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}, c.cert, &key.PublicKey, c.key)
+	assert.Ok(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Ok(t, err)
+
+	return cert
+}
@@ -0,0 +1,426 @@
+// Generic OpenID Connect authentication (authorization code flow + PKCE)
+package authoidcbackend
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/function61/edgerouter/pkg/erbackend/authidentity"
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/gokit/httputils"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultCallbackPath      = "/_auth/oidc/callback"
+	defaultSessionDuration   = 12 * time.Hour
+	defaultGroupsClaim       = "groups"
+	loginTimeout             = 10 * time.Minute // user has this long to log in at the provider
+	providerDiscoveryTimeout = 10 * time.Second
+
+	emailHeader  = authidentity.HeaderPrefix + "Email"
+	groupsHeader = authidentity.HeaderPrefix + "Groups" // comma-separated. only the ones in AllowedGroups
+)
+
+func New(
+	opts erconfig.BackendOptsAuthOidc,
+	authorizedBackend http.Handler,
+	logger *slog.Logger,
+) http.Handler {
+	callbackPath := opts.CallbackPath
+	if callbackPath == "" {
+		callbackPath = defaultCallbackPath
+	}
+
+	sessionDuration := defaultSessionDuration
+	if opts.SessionDurationSeconds != 0 {
+		sessionDuration = time.Duration(opts.SessionDurationSeconds) * time.Second
+	}
+
+	groupsClaim := opts.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = defaultGroupsClaim
+	}
+
+	scopes := opts.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+
+		if len(opts.AllowedGroups) > 0 {
+			scopes = append(scopes, "groups")
+		}
+	}
+
+	// different apps (or providers) on the same hostname must not overwrite each other's cookies
+	cookieNameDigest := sha256.Sum256([]byte(opts.IssuerURL + "\n" + opts.ClientID + "\n" + callbackPath))
+	sessionCookieName := "_oidc_" + hex.EncodeToString(cookieNameDigest[:4])
+
+	return &backend{
+		opts:              opts,
+		scopes:            append([]string{oidc.ScopeOpenID}, slices.DeleteFunc(slices.Clone(scopes), isOpenIDScope)...),
+		callbackPath:      callbackPath,
+		logoutPath:        path.Join(path.Dir(callbackPath), "logout"),
+		sessionDuration:   sessionDuration,
+		groupsClaim:       groupsClaim,
+		cookies:           newCookieCodec(opts.CookieSecret),
+		sessionCookieName: sessionCookieName,
+		loginCookieName:   sessionCookieName + "_login",
+		authorizedBackend: authorizedBackend,
+		logger:            logger,
+	}
+}
+
+type backend struct {
+	opts              erconfig.BackendOptsAuthOidc
+	scopes            []string
+	callbackPath      string
+	logoutPath        string
+	sessionDuration   time.Duration
+	groupsClaim       string
+	cookies           *cookieCodec
+	sessionCookieName string
+	loginCookieName   string
+	authorizedBackend http.Handler
+	logger            *slog.Logger
+
+	providerMu sync.Mutex
+	provider   *provider // discovered lazily, so an unreachable provider doesn't fail loading the whole config
+}
+
+type provider struct {
+	endpoint oauth2.Endpoint
+	verifier *oidc.IDTokenVerifier
+}
+
+// stored in an encrypted cookie
+type session struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`  // only if verified
+	Groups  []string `json:"groups,omitempty"` // only the ones in AllowedGroups (cookie size is limited)
+	Expires int64    `json:"exp"`
+}
+
+// stored in an encrypted cookie between redirecting the user to the provider and the callback
+type loginState struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	PKCEVerifier string `json:"pkce_verifier"`
+	ReturnTo     string `json:"return_to"`
+	Expires      int64  `json:"exp"`
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authidentity.RemoveClientSupplied(r)
+
+	switch r.URL.Path {
+	case b.callbackPath:
+		b.callback(w, r)
+		return
+	case b.logoutPath:
+		http.SetCookie(w, b.cookie(r, b.sessionCookieName, "", "/", -1))
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	sess := session{}
+	if err := b.cookies.Decode(r, b.sessionCookieName, &sess); err != nil || time.Now().Unix() > sess.Expires {
+		b.redirectToLogin(w, r)
+		return
+	}
+
+	// allowlists could've changed after the session was created
+	if !b.authorize(sess) {
+		http.Error(w, "not allowed: "+sess.describeUser(), http.StatusForbidden)
+		return
+	}
+
+	// the origin doesn't need our session
+	removeCookie(r, b.sessionCookieName)
+
+	authidentity.SetUser(r, sess.describeUser())
+	if sess.Email != "" {
+		r.Header.Set(emailHeader, sess.Email)
+	}
+	if len(sess.Groups) > 0 {
+		r.Header.Set(groupsHeader, strings.Join(sess.Groups, ","))
+	}
+
+	b.authorizedBackend.ServeHTTP(w, r)
+}
+
+func (b *backend) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	// API clients can't follow a login flow, and we can't return the user to a POST after login
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "login required", http.StatusUnauthorized)
+		return
+	}
+
+	prov, err := b.getProvider()
+	if err != nil {
+		b.logger.Error("OIDC discovery", "err", err)
+		http.Error(w, "OIDC discovery failed", http.StatusBadGateway)
+		return
+	}
+
+	returnTo := r.URL.RequestURI()
+	if strings.HasPrefix(returnTo, "//") { // would redirect to another site
+		returnTo = "/"
+	}
+
+	login := loginState{
+		State:        randomToken(),
+		Nonce:        randomToken(),
+		PKCEVerifier: oauth2.GenerateVerifier(),
+		ReturnTo:     returnTo,
+		Expires:      time.Now().Add(loginTimeout).Unix(),
+	}
+
+	loginCookie, err := b.cookies.Encode(b.loginCookieName, login)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, b.cookie(r, b.loginCookieName, loginCookie, b.callbackPath, int(loginTimeout.Seconds())))
+
+	httputils.NoCacheHeaders(w)
+
+	http.Redirect(w, r, b.oauth2Config(r, prov).AuthCodeURL(
+		login.State,
+		oauth2.S256ChallengeOption(login.PKCEVerifier),
+		oidc.Nonce(login.Nonce),
+	), http.StatusFound)
+}
+
+func (b *backend) callback(w http.ResponseWriter, r *http.Request) {
+	// URL contains sensitive info
+	httputils.NoCacheHeaders(w)
+
+	login := loginState{}
+	if err := b.cookies.Decode(r, b.loginCookieName, &login); err != nil || time.Now().Unix() > login.Expires {
+		http.Error(w, "login expired (or cookies are disabled). please try again", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.State)) != 1 {
+		http.Error(w, "state mismatch", http.StatusBadRequest)
+		return
+	}
+
+	if errCode := query.Get("error"); errCode != "" {
+		http.Error(w, fmt.Sprintf("login failed: %s: %s", errCode, query.Get("error_description")), http.StatusForbidden)
+		return
+	}
+
+	sess, err := b.exchange(r, query.Get("code"), login)
+	if err != nil {
+		b.logger.Warn("OIDC login", "err", err)
+		http.Error(w, "login failed: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !b.authorize(*sess) {
+		b.logger.Info("OIDC login not allowed", "user", sess.describeUser())
+		http.Error(w, "not allowed: "+sess.describeUser(), http.StatusForbidden)
+		return
+	}
+
+	sessionCookie, err := b.cookies.Encode(b.sessionCookieName, sess)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, b.cookie(r, b.loginCookieName, "", b.callbackPath, -1))
+	http.SetCookie(w, b.cookie(r, b.sessionCookieName, sessionCookie, "/", int(b.sessionDuration.Seconds())))
+
+	http.Redirect(w, r, login.ReturnTo, http.StatusFound)
+}
+
+// code => verified ID token => session
+func (b *backend) exchange(r *http.Request, code string, login loginState) (*session, error) {
+	prov, err := b.getProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := b.oauth2Config(r, prov).Exchange(r.Context(), code, oauth2.VerifierOption(login.PKCEVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id_token in token response")
+	}
+
+	idToken, err := prov.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(login.Nonce)) != 1 {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	claims := map[string]any{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	sess := &session{
+		Subject: idToken.Subject,
+		Expires: time.Now().Add(b.sessionDuration).Unix(),
+	}
+
+	// anybody can claim any email at some providers, so an unverified one can't be used for
+	// authorization. providers that don't tell whether it's verified get the same treatment.
+	if email, _ := claims["email"].(string); email != "" && claims["email_verified"] == true {
+		sess.Email = email
+	}
+
+	for _, group := range groupsFromClaim(claims[b.groupsClaim]) {
+		if slices.Contains(b.opts.AllowedGroups, group) {
+			sess.Groups = append(sess.Groups, group)
+		}
+	}
+
+	return sess, nil
+}
+
+func (b *backend) authorize(sess session) bool {
+	if slices.ContainsFunc(sess.Groups, func(group string) bool {
+		return slices.Contains(b.opts.AllowedGroups, group)
+	}) {
+		return true
+	}
+
+	if sess.Email == "" {
+		return false
+	}
+
+	if slices.ContainsFunc(b.opts.AllowedEmails, func(email string) bool {
+		return strings.EqualFold(email, sess.Email)
+	}) {
+		return true
+	}
+
+	domain := sess.Email[strings.LastIndex(sess.Email, "@")+1:]
+
+	return slices.ContainsFunc(b.opts.AllowedDomains, func(allowed string) bool {
+		return strings.EqualFold(allowed, domain)
+	})
+}
+
+func (b *backend) getProvider() (*provider, error) {
+	b.providerMu.Lock()
+	defer b.providerMu.Unlock()
+
+	if b.provider == nil {
+		// not request's context because the key set that this creates outlives the request. bounded
+		// though, as other logins wait for us (holding the lock) if the issuer is slow to answer.
+		ctx, cancel := context.WithTimeout(context.Background(), providerDiscoveryTimeout)
+		defer cancel()
+
+		discovered, err := oidc.NewProvider(ctx, b.opts.IssuerURL)
+		if err != nil {
+			return nil, err
+		}
+
+		b.provider = &provider{
+			endpoint: discovered.Endpoint(),
+			verifier: discovered.Verifier(&oidc.Config{ClientID: b.opts.ClientID}),
+		}
+	}
+
+	return b.provider, nil
+}
+
+// redirect URL depends on the hostname the user is using
+func (b *backend) oauth2Config(r *http.Request, prov *provider) *oauth2.Config {
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+
+	return &oauth2.Config{
+		ClientID:     b.opts.ClientID,
+		ClientSecret: b.opts.ClientSecret,
+		Endpoint:     prov.endpoint,
+		RedirectURL:  scheme + "://" + r.Host + b.callbackPath,
+		Scopes:       b.scopes,
+	}
+}
+
+func (b *backend) cookie(r *http.Request, name string, value string, path string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode, // callback is a cross-site (top-level) redirect from the provider
+	}
+}
+
+func (s session) describeUser() string {
+	if s.Email != "" {
+		return s.Email
+	}
+
+	return s.Subject
+}
+
+// providers have the groups claim either as an array or a single string
+func groupsFromClaim(claim any) []string {
+	switch groups := claim.(type) {
+	case string:
+		return []string{groups}
+	case []any:
+		strs := []string{}
+		for _, group := range groups {
+			if str, ok := group.(string); ok {
+				strs = append(strs, str)
+			}
+		}
+		return strs
+	default:
+		return nil
+	}
+}
+
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+
+	r.Header.Del("Cookie")
+
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+func isOpenIDScope(scope string) bool {
+	return scope == oidc.ScopeOpenID
+}
+
+func randomToken() string {
+	return rand.Text()
+}
@@ -0,0 +1,252 @@
+package authoidcbackend
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+)
+
+func TestLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.Close()
+
+	authBackend := New(erconfig.BackendOptsAuthOidc{
+		IssuerURL:      issuer.URL,
+		ClientID:       "grafana",
+		ClientSecret:   "hunter2",
+		CookieSecret:   "0123456789abcdef0123456789abcdef",
+		AllowedEmails:  []string{"CONTRACTOR@gmail.com"},
+		AllowedDomains: []string{"example.com"},
+		AllowedGroups:  []string{"admins"},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Join([]string{
+			r.URL.RequestURI(),
+			r.Header.Get("X-Authenticated-User"),
+			r.Header.Get("X-Authenticated-Email"),
+			r.Header.Get("X-Authenticated-Groups"),
+			r.Header.Get("Cookie"),
+		}, " | ")))
+	}), slogshim.NewWithOutput(io.Discard))
+
+	app := httptest.NewServer(authBackend)
+	defer app.Close()
+
+	// logs in (if needed) as the user the issuer is told to log in as
+	newBrowser := func() *http.Client {
+		jar, err := cookiejar.New(nil)
+		assert.Ok(t, err)
+
+		return &http.Client{Jar: jar}
+	}
+
+	get := func(browser *http.Client, path string) string {
+		req, err := http.NewRequest(http.MethodGet, app.URL+path, nil)
+		assert.Ok(t, err)
+		req.Header.Set("X-Authenticated-User", "admin") // spoofing attempt
+		req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+
+		res, err := browser.Do(req)
+		assert.Ok(t, err)
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		assert.Ok(t, err)
+
+		return res.Status + ": " + string(body)
+	}
+
+	loginAs := func(claims map[string]any, path string) string {
+		issuer.loginAs(claims)
+		return get(newBrowser(), path)
+	}
+
+	alice := newBrowser()
+	issuer.loginAs(map[string]any{"sub": "1", "email": "alice@example.com", "email_verified": true})
+	assert.EqualString(t, get(alice, "/dashboard?from=now-1h"), "200 OK: /dashboard?from=now-1h | alice@example.com | alice@example.com |  | theme=dark")
+	assert.Assert(t, issuer.logins() == 1)
+
+	// session cookie gets us in without visiting the issuer
+	assert.EqualString(t, get(alice, "/api/health"), "200 OK: /api/health | alice@example.com | alice@example.com |  | theme=dark")
+	assert.Assert(t, issuer.logins() == 1)
+
+	assert.EqualString(t, loginAs(map[string]any{"sub": "2", "email": "contractor@gmail.com", "email_verified": true}, "/"), "200 OK: / | contractor@gmail.com | contractor@gmail.com |  | theme=dark")
+	assert.EqualString(t, loginAs(map[string]any{"sub": "3", "email": "bob@subsidiary.net", "email_verified": true, "groups": []string{"users", "admins"}}, "/"), "200 OK: / | bob@subsidiary.net | bob@subsidiary.net | admins | theme=dark")
+	assert.EqualString(t, loginAs(map[string]any{"sub": "4", "email": "mallory@evil.net", "email_verified": true, "groups": []string{"users"}}, "/"), "403 Forbidden: not allowed: mallory@evil.net\n")
+	assert.EqualString(t, loginAs(map[string]any{"sub": "5", "email": "mallory@example.com", "email_verified": false}, "/"), "403 Forbidden: not allowed: 5\n")
+	assert.EqualString(t, loginAs(map[string]any{"sub": "6", "email": "mallory@example.com"}, "/"), "403 Forbidden: not allowed: 6\n")
+
+	// API clients
+	res, err := http.Post(app.URL+"/api/annotations", "application/json", strings.NewReader("{}"))
+	assert.Ok(t, err)
+	assert.Assert(t, res.StatusCode == http.StatusUnauthorized)
+	assert.Ok(t, res.Body.Close())
+
+	// tampered (or other app's) session cookie is not accepted
+	req := httptest.NewRequest(http.MethodGet, app.URL+"/", nil)
+	req.AddCookie(&http.Cookie{Name: authBackend.(*backend).sessionCookieName, Value: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"})
+	rec := httptest.NewRecorder()
+	authBackend.ServeHTTP(rec, req)
+	assert.Assert(t, rec.Code == http.StatusFound)
+	assert.Assert(t, strings.HasPrefix(rec.Header().Get("Location"), issuer.URL+"/authorize?"))
+}
+
+// OIDC provider that logs in whoever it's told to, without asking any questions
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu          sync.Mutex
+	nextClaims  map[string]any
+	loginCount  int
+	pendingCode map[string]pendingCode
+}
+
+type pendingCode struct {
+	claims        map[string]any
+	nonce         string
+	codeChallenge string
+	redirectURI   string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+
+	issuer := &mockIssuer{key: key, pendingCode: map[string]pendingCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/authorize",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"keys": []map[string]any{{
+				"kty": "RSA",
+				"kid": "1",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("client_id") != "grafana" || query.Get("code_challenge_method") != "S256" || !strings.Contains(query.Get("scope"), "openid") {
+			http.Error(w, "bad authorization request", http.StatusBadRequest)
+			return
+		}
+
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+
+		code := rand.Text()
+		issuer.pendingCode[code] = pendingCode{
+			claims:        issuer.nextClaims,
+			nonce:         query.Get("nonce"),
+			codeChallenge: query.Get("code_challenge"),
+			redirectURI:   query.Get("redirect_uri"),
+		}
+		issuer.loginCount++
+
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code="+code+"&state="+query.Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		pending, found := issuer.pendingCode[r.FormValue("code")]
+		delete(issuer.pendingCode, r.FormValue("code"))
+		issuer.mu.Unlock()
+
+		verifierDigest := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		clientID, clientSecret, _ := r.BasicAuth()
+
+		switch {
+		case !found:
+			http.Error(w, "invalid code", http.StatusBadRequest)
+		case base64.RawURLEncoding.EncodeToString(verifierDigest[:]) != pending.codeChallenge:
+			http.Error(w, "PKCE verification failed", http.StatusBadRequest)
+		case r.FormValue("redirect_uri") != pending.redirectURI:
+			http.Error(w, "redirect_uri mismatch", http.StatusBadRequest)
+		case clientID != "grafana" || clientSecret != "hunter2":
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+		default:
+			claims := map[string]any{
+				"iss":   issuer.URL,
+				"aud":   "grafana",
+				"iat":   time.Now().Unix(),
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"nonce": pending.nonce,
+			}
+			for key, value := range pending.claims {
+				claims[key] = value
+			}
+
+			writeJSON(w, map[string]any{
+				"access_token": "dummy",
+				"token_type":   "Bearer",
+				"expires_in":   3600,
+				"id_token":     issuer.sign(t, claims),
+			})
+		}
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+
+	return issuer
+}
+
+func (m *mockIssuer) loginAs(claims map[string]any) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextClaims = claims
+}
+
+func (m *mockIssuer) logins() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.loginCount
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "1"})
+	assert.Ok(t, err)
+	payload, err := json.Marshal(claims)
+	assert.Ok(t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	assert.Ok(t, err)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,71 @@
+package authoidcbackend
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// cookie values are JSON encrypted with AES-GCM. the cookie name is authenticated as well, so a
+// login state cookie can't be passed off as a session cookie.
+type cookieCodec struct {
+	aead cipher.AEAD
+}
+
+func newCookieCodec(secret string) *cookieCodec {
+	key := sha256.Sum256([]byte(secret)) // => AES-256
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil { // can't fail with a valid key size
+		panic(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	return &cookieCodec{aead}
+}
+
+func (c *cookieCodec) Encode(name string, value any) (string, error) {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(c.aead.Seal(nonce, nonce, plaintext, []byte(name))), nil
+}
+
+func (c *cookieCodec) Decode(r *http.Request, name string, value any) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return err
+	}
+
+	if len(ciphertext) < c.aead.NonceSize() {
+		return errors.New("cookie too short")
+	}
+
+	plaintext, err := c.aead.Open(nil, ciphertext[:c.aead.NonceSize()], ciphertext[c.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(plaintext, value)
+}
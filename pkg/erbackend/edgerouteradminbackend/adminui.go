@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/function61/edgerouter/pkg/erbackend/reverseproxybackend"
 	"github.com/function61/edgerouter/pkg/erconfig"
 	"github.com/function61/gokit/dynversion"
 )
@@ -26,6 +27,23 @@ const adminTpl = `
 {{end}}
 </pre>
 
+{{if .OriginHealth}}
+<h2>Origin health</h2>
+
+<table>
+<tr><th>App</th><th>Origin</th><th>Status</th><th>Last checked</th><th>Last error</th></tr>
+{{range .OriginHealth}}
+<tr>
+	<td>{{.AppID}}</td>
+	<td>{{.Origin}}</td>
+	<td>{{if .Healthy}}healthy{{else}}unhealthy{{end}}</td>
+	<td>{{if .LastChecked.IsZero}}never{{else}}{{.LastChecked.Format "2006-01-02T15:04:05Z07:00"}}{{end}}</td>
+	<td>{{.LastError}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+
 <p>Version: {{.Version}}</p>
 <p>LastUpdated: {{.LastUpdated}}</p>
 </body>
@@ -60,12 +78,14 @@ func renderPage(currentConfig erconfig.CurrentConfigAccessor, output io.Writer)
 	}
 
 	return tpl.Execute(output, struct {
-		Apps        []string
-		Version     string
-		LastUpdated string
+		Apps         []string
+		OriginHealth []reverseproxybackend.OriginHealthStatus
+		Version      string
+		LastUpdated  string
 	}{
-		Apps:        appDescriptions,
-		Version:     dynversion.Version,
-		LastUpdated: currentConfig.LastUpdated().Format(time.RFC3339),
+		Apps:         appDescriptions,
+		OriginHealth: reverseproxybackend.OriginHealthStatuses(),
+		Version:      dynversion.Version,
+		LastUpdated:  currentConfig.LastUpdated().Format(time.RFC3339),
 	})
 }
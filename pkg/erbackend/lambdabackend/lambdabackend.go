@@ -19,7 +19,11 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
 	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/ertracing"
 	"github.com/function61/edgerouter/pkg/turbocharger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type lambdaBackend struct {
@@ -49,6 +53,15 @@ func New(ctx context.Context, opts erconfig.BackendOptsAwsLambda, logger *slog.L
 }
 
 func (b *lambdaBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, span := ertracing.Start(r.Context(), "lambda.Invoke", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("faas.invoked_name", b.functionName)))
+	defer span.End()
+
+	r = r.WithContext(ctx)
+
+	// function can continue our trace (it sees the headers)
+	ertracing.Inject(ctx, r.Header)
+
 	if b.isPayloadV2 {
 		// https://pkg.go.dev/github.com/aws/aws-lambda-go/events#APIGatewayV2HTTPRequest
 		b.serveHTTPModel(w, r)
@@ -111,10 +124,7 @@ func (b *lambdaBackend) serveHTTPModel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	lambdaResponse, err := b.lambda.Invoke(r.Context(), &lambda.InvokeInput{
-		FunctionName: aws.String(b.functionName),
-		Payload:      proxyRequestJSON,
-	})
+	lambdaResponse, err := b.invoke(r.Context(), proxyRequestJSON)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -147,14 +157,19 @@ func (b *lambdaBackend) serveRESTModel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sourceIP, _, _ := net.SplitHostPort(r.RemoteAddr) // already resolved from trusted proxies' headers
+
 	proxyRequest := events.APIGatewayProxyRequest{
 		Resource:              "/",
 		Path:                  r.URL.Path,
 		Headers:               headers,
 		HTTPMethod:            r.Method,
 		QueryStringParameters: queryParametersToSimpleMap(r.URL.Query()),
-		RequestContext:        events.APIGatewayProxyRequestContext{
+		RequestContext: events.APIGatewayProxyRequestContext{
 			// APIID: "dummy",
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP: sourceIP,
+			},
 		},
 	}
 
@@ -169,10 +184,7 @@ func (b *lambdaBackend) serveRESTModel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	lambdaResponse, err := b.lambda.Invoke(r.Context(), &lambda.InvokeInput{
-		FunctionName: aws.String(b.functionName),
-		Payload:      proxyRequestJSON,
-	})
+	lambdaResponse, err := b.invoke(r.Context(), proxyRequestJSON)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -203,6 +215,30 @@ func (b *lambdaBackend) serveRESTModel(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (b *lambdaBackend) invoke(ctx context.Context, payload []byte) (*lambda.InvokeOutput, error) {
+	span := trace.SpanFromContext(ctx)
+
+	started := time.Now()
+	res, err := b.lambda.Invoke(ctx, &lambda.InvokeInput{
+		FunctionName: aws.String(b.functionName),
+		Payload:      payload,
+	})
+	invocationDuration.WithLabelValues(b.functionName).Observe(time.Since(started).Seconds())
+	if err != nil {
+		invocationErrors.WithLabelValues(b.functionName, "invoke").Inc()
+		ertracing.RecordError(span, err)
+		return nil, err
+	}
+
+	// function crashed or returned an error. Invoke() itself succeeds in that case
+	if res.FunctionError != nil {
+		invocationErrors.WithLabelValues(b.functionName, "function").Inc()
+		span.SetStatus(codes.Error, *res.FunctionError)
+	}
+
+	return res, nil
+}
+
 func proxyAPIGatewayResponse(payloadResponse *events.APIGatewayV2HTTPResponse, w http.ResponseWriter) error {
 	responseHeaders := w.Header()
 
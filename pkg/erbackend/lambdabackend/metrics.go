@@ -0,0 +1,22 @@
+package lambdabackend
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	invocationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "er_lambda_invocation_duration_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 16), // from 1ms to 32 seconds (cold starts are slow)
+		Help:    "Time (in seconds) each Lambda invocation took.",
+	}, []string{"function"})
+	invocationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "er_lambda_invocation_errors",
+		Help: "Failed Lambda invocations, by type (\"invoke\" = calling Lambda failed, \"function\" = the function failed).",
+	}, []string{"function", "type"})
+)
+
+func init() {
+	prometheus.MustRegister(invocationDuration)
+	prometheus.MustRegister(invocationErrors)
+}
@@ -0,0 +1,424 @@
+package reverseproxybackend
+
+// Picks an origin for each request, and passively keeps track of origins' health so that
+// a crashing origin gets taken out of rotation before discovery notices it's gone.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/ertracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultEjectAfterFailures = 3
+	defaultEjectDuration      = 10 * time.Second
+)
+
+type origin struct {
+	url    url.URL
+	weight int
+
+	outstanding atomic.Int64 // requests in flight (incl. response body streaming)
+
+	activeHealth *activeHealth // nil if active health checks not in use
+
+	currentWeight int // for smooth weighted round robin. guarded by balancer.roundRobinMu
+
+	healthMu            sync.Mutex
+	consecutiveFailures int
+	ejectedUntil        time.Time
+}
+
+// "load" normalized by weight, so an origin with weight 2 is considered as loaded as weight 1
+// origin when it has twice the requests in flight
+func (o *origin) load() float64 {
+	return float64(o.outstanding.Load()) / float64(o.weight)
+}
+
+func (o *origin) activelyHealthy() bool {
+	return o.activeHealth == nil || o.activeHealth.healthy.Load()
+}
+
+func (o *origin) ejected(now time.Time) bool {
+	o.healthMu.Lock()
+	defer o.healthMu.Unlock()
+
+	return now.Before(o.ejectedUntil)
+}
+
+type balancer struct {
+	origins            []*origin
+	strategy           erconfig.LoadBalancingStrategy
+	ejectAfterFailures int // 0 = never eject
+	ejectDuration      time.Duration
+	roundRobinMu       sync.Mutex
+	now                func() time.Time // for testing
+	logger             *slog.Logger
+}
+
+func newBalancer(
+	originURLs []url.URL,
+	opts erconfig.BackendOptsReverseProxy,
+	originHealths map[string]*activeHealth,
+	logger *slog.Logger,
+) *balancer {
+	lbOpts := erconfig.LoadBalancing{}
+	if opts.LoadBalancing != nil {
+		lbOpts = *opts.LoadBalancing
+	}
+
+	origins := make([]*origin, 0, len(originURLs))
+	for i, originURL := range originURLs {
+		weight := 1
+		if configured, has := opts.OriginWeights[opts.Origins[i]]; has && configured > 0 {
+			weight = configured
+		}
+
+		origins = append(origins, &origin{
+			url:          originURL,
+			weight:       weight,
+			activeHealth: originHealths[originURL.String()],
+		})
+	}
+
+	ejectAfterFailures := func() int {
+		switch lbOpts.EjectAfterFailures {
+		case 0:
+			return defaultEjectAfterFailures
+		case -1:
+			return 0
+		default:
+			return lbOpts.EjectAfterFailures
+		}
+	}()
+
+	ejectDuration := defaultEjectDuration
+	if lbOpts.EjectDurationSeconds != 0 {
+		ejectDuration = time.Duration(lbOpts.EjectDurationSeconds) * time.Second
+	}
+
+	return &balancer{
+		origins:            origins,
+		strategy:           lbOpts.Strategy,
+		ejectAfterFailures: ejectAfterFailures,
+		ejectDuration:      ejectDuration,
+		now:                time.Now,
+		logger:             logger,
+	}
+}
+
+// returns nil only if all origins are in *exclude*
+func (b *balancer) pick(exclude []*origin) *origin {
+	candidates := b.candidates(exclude)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch b.strategy {
+	case erconfig.LoadBalancingStrategyLeastOutstanding:
+		return pickLeastOutstanding(candidates)
+	case erconfig.LoadBalancingStrategyPowerOfTwoChoices:
+		return pickPowerOfTwoChoices(candidates)
+	default:
+		return b.pickRoundRobin(candidates)
+	}
+}
+
+// available origins that are not in *exclude*. available = healthy (by active checks) and not ejected.
+// if nothing is available, we'll rather try the unavailable ones than give up (the ejection or
+// health status might be stale, or the whole service is down anyway).
+func (b *balancer) candidates(exclude []*origin) []*origin {
+	now := b.now()
+
+	notExcluded := make([]*origin, 0, len(b.origins))
+	healthy := make([]*origin, 0, len(b.origins))
+	available := make([]*origin, 0, len(b.origins))
+
+	for _, o := range b.origins {
+		if containsOrigin(exclude, o) {
+			continue
+		}
+
+		notExcluded = append(notExcluded, o)
+
+		if !o.activelyHealthy() {
+			continue
+		}
+
+		healthy = append(healthy, o)
+
+		if !o.ejected(now) {
+			available = append(available, o)
+		}
+	}
+
+	switch {
+	case len(available) > 0:
+		return available
+	case len(healthy) > 0:
+		return healthy
+	default:
+		return notExcluded
+	}
+}
+
+// smooth weighted round robin, as in nginx. spreads heavier origins' turns evenly instead of
+// giving them consecutive bursts.
+func (b *balancer) pickRoundRobin(candidates []*origin) *origin {
+	b.roundRobinMu.Lock()
+	defer b.roundRobinMu.Unlock()
+
+	var best *origin
+	totalWeight := 0
+
+	for _, o := range candidates {
+		o.currentWeight += o.weight
+		totalWeight += o.weight
+
+		if best == nil || o.currentWeight > best.currentWeight {
+			best = o
+		}
+	}
+
+	best.currentWeight -= totalWeight
+
+	return best
+}
+
+func pickLeastOutstanding(candidates []*origin) *origin {
+	best := candidates[0]
+	for _, o := range candidates[1:] {
+		if o.load() < best.load() {
+			best = o
+		}
+	}
+
+	return best
+}
+
+// pick two at random (weighted) and use the less loaded. avoids herding all traffic to the single
+// least loaded origin while still steering away from overloaded ones.
+func pickPowerOfTwoChoices(candidates []*origin) *origin {
+	first := pickWeightedRandom(candidates, nil)
+	second := pickWeightedRandom(candidates, first)
+
+	if second.load() < first.load() {
+		return second
+	}
+
+	return first
+}
+
+func pickWeightedRandom(candidates []*origin, exclude *origin) *origin {
+	totalWeight := 0
+	for _, o := range candidates {
+		if o != exclude {
+			totalWeight += o.weight
+		}
+	}
+
+	//nolint:gosec // Cryptographical randomness not required here
+	n := rand.Intn(totalWeight)
+
+	for _, o := range candidates {
+		if o == exclude {
+			continue
+		}
+
+		if n < o.weight {
+			return o
+		}
+
+		n -= o.weight
+	}
+
+	panic("unreachable")
+}
+
+func (b *balancer) reportSuccess(o *origin) {
+	o.healthMu.Lock()
+	defer o.healthMu.Unlock()
+
+	o.consecutiveFailures = 0
+}
+
+func (b *balancer) reportFailure(o *origin, reason string) {
+	if b.ejectAfterFailures == 0 { // ejection disabled
+		return
+	}
+
+	o.healthMu.Lock()
+	defer o.healthMu.Unlock()
+
+	o.consecutiveFailures++
+
+	now := b.now()
+
+	// counter is not reset on re-admission, so an origin that is still broken after its ejection
+	// expired gets ejected again on its first failure
+	if o.consecutiveFailures >= b.ejectAfterFailures && !now.Before(o.ejectedUntil) {
+		o.ejectedUntil = now.Add(b.ejectDuration)
+
+		b.logger.Warn("ejecting origin",
+			"origin", o.url.String(),
+			"consecutive_failures", o.consecutiveFailures,
+			"reason", reason,
+			"duration", b.ejectDuration.String())
+	}
+}
+
+// picks the origin for each round trip, and retries on another origin if connecting fails.
+// the request that comes in has everything else already set up except the origin-specific parts.
+type balancingTransport struct {
+	appID          string // for metrics
+	balancer       *balancer
+	inner          http.RoundTripper
+	passHostHeader bool
+}
+
+func (t *balancingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := []*origin{}
+
+	for {
+		o := t.balancer.pick(tried)
+		if o == nil { // should not happen, since we only retry if there are untried origins
+			return nil, errors.New("no origins to try")
+		}
+		tried = append(tried, o)
+
+		res, err := t.roundTripWithOrigin(req, o)
+		if err != nil {
+			// client going away (or timing out) says nothing about the origin's health
+			if req.Context().Err() != nil || errors.Is(err, context.Canceled) {
+				return nil, err
+			}
+
+			t.balancer.reportFailure(o, err.Error())
+
+			// safe to retry only if the origin certainly didn't get the request, and we can re-send the body
+			canRetry := isConnectError(err) && requestBodyReplayable(req) && len(tried) < len(t.balancer.origins)
+			if canRetry && req.Context().Err() == nil {
+				continue
+			}
+
+			return nil, err
+		}
+
+		if res.StatusCode >= 500 {
+			t.balancer.reportFailure(o, fmt.Sprintf("status %d", res.StatusCode))
+		} else {
+			t.balancer.reportSuccess(o)
+		}
+
+		return res, nil
+	}
+}
+
+func (t *balancingTransport) roundTripWithOrigin(req *http.Request, o *origin) (*http.Response, error) {
+	// one span per attempt, so retries show up in the trace
+	ctx, span := ertracing.Start(req.Context(), "reverse_proxy round trip", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("server.address", o.url.Host)))
+	defer span.End()
+
+	outreq := req.Clone(ctx)
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		outreq.Body = body
+	}
+
+	outreq.URL.Scheme = o.url.Scheme // "http" | "https"
+
+	// this specifies the host we're connecting to
+	outreq.URL.Host = o.url.Host
+
+	// sometimes we want the outgoing request to include the original "Host: ..." header, so
+	// the backend can see what hostname is in browser's address bar
+	if !t.passHostHeader {
+		outreq.Host = o.url.Host
+	}
+
+	// origin's Path is "normally" empty (e.g. "http://example.com"), but can be used to add a prefix
+	outreq.URL.Path = o.url.Path + outreq.URL.Path
+
+	ertracing.Inject(ctx, outreq.Header)
+
+	o.outstanding.Add(1)
+
+	started := time.Now()
+	res, err := t.inner.RoundTrip(outreq)
+	upstreamDuration.WithLabelValues(t.appID, o.url.String()).Observe(time.Since(started).Seconds())
+	if err != nil {
+		o.outstanding.Add(-1)
+		upstreamErrors.WithLabelValues(t.appID, o.url.String(), "transport").Inc()
+		ertracing.RecordError(span, err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+	if res.StatusCode >= 500 {
+		upstreamErrors.WithLabelValues(t.appID, o.url.String(), "5xx").Inc()
+		span.SetStatus(codes.Error, res.Status)
+	}
+
+	// response body can stream for a long time after RoundTrip() returns
+	res.Body = &outstandingTrackingBody{ReadCloser: res.Body, origin: o}
+
+	return res, nil
+}
+
+type outstandingTrackingBody struct {
+	io.ReadCloser
+	origin *origin
+	closed atomic.Bool
+}
+
+func (b *outstandingTrackingBody) Close() error {
+	if b.closed.CompareAndSwap(false, true) {
+		b.origin.outstanding.Add(-1)
+	}
+
+	return b.ReadCloser.Close()
+}
+
+// connection was not established => origin did not see the request
+func isConnectError(err error) bool {
+	opErr := &net.OpError{}
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func requestBodyReplayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func containsOrigin(origins []*origin, o *origin) bool {
+	for _, candidate := range origins {
+		if candidate == o {
+			return true
+		}
+	}
+
+	return false
+}
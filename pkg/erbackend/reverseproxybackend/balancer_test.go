@@ -0,0 +1,189 @@
+package reverseproxybackend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWeightedRoundRobin(t *testing.T) {
+	b := testBalancer(t, erconfig.BackendOptsReverseProxy{
+		Origins: []string{"http://a", "http://b", "http://c"},
+		OriginWeights: map[string]int{
+			"http://a": 3,
+		},
+	})
+
+	picks := []string{}
+	for i := 0; i < 10; i++ {
+		picks = append(picks, b.pick(nil).url.Host)
+	}
+
+	// smooth: a's turns are spread out instead of "a a a b c"
+	assert.EqualString(t, strings.Join(picks, " "), "a b a c a a b a c a")
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	b := testBalancer(t, erconfig.BackendOptsReverseProxy{
+		Origins: []string{"http://a", "http://b"},
+		LoadBalancing: &erconfig.LoadBalancing{
+			Strategy: erconfig.LoadBalancingStrategyLeastOutstanding,
+		},
+	})
+
+	b.origins[0].outstanding.Add(2)
+	b.origins[1].outstanding.Add(1)
+
+	assert.EqualString(t, b.pick(nil).url.Host, "b")
+}
+
+func TestEjectionAndReadmission(t *testing.T) {
+	b := testBalancer(t, erconfig.BackendOptsReverseProxy{
+		Origins: []string{"http://a", "http://b"},
+		LoadBalancing: &erconfig.LoadBalancing{
+			EjectAfterFailures:   2,
+			EjectDurationSeconds: 30,
+		},
+	})
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	a := b.origins[0]
+
+	b.reportFailure(a, "test")
+	assert.Assert(t, !a.ejected(now))
+
+	b.reportFailure(a, "test")
+	assert.Assert(t, a.ejected(now))
+
+	for i := 0; i < 4; i++ {
+		assert.EqualString(t, b.pick(nil).url.Host, "b")
+	}
+
+	// when everything is ejected, rather try ejected origins than nothing
+	assert.EqualString(t, b.pick([]*origin{b.origins[1]}).url.Host, "a")
+
+	now = now.Add(31 * time.Second)
+	assert.Assert(t, !a.ejected(now))
+
+	// still broken after re-admission => first failure ejects again
+	b.reportFailure(a, "test")
+	assert.Assert(t, a.ejected(now))
+
+	now = now.Add(31 * time.Second)
+	b.reportSuccess(a)
+	b.reportFailure(a, "test")
+	assert.Assert(t, !a.ejected(now))
+}
+
+func TestRetriesOnConnectError(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	defer healthy.Close()
+
+	// grab a free port and close it, so connecting to it fails
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	deadAddr := "http://" + dead.Addr().String()
+	assert.Ok(t, dead.Close())
+
+	proxy, err := NewWithModifyResponse("test", erconfig.BackendOptsReverseProxy{
+		Origins: []string{deadAddr, healthy.URL},
+	}, nil, slogshim.NewWithOutput(io.Discard))
+	assert.Ok(t, err)
+
+	for i := 0; i < 4; i++ {
+		res := httptest.NewRecorder()
+		proxy.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/foo", nil))
+
+		assert.EqualInt(t, res.Code, http.StatusOK)
+		assert.EqualString(t, res.Body.String(), "hello from /foo")
+	}
+
+	assert.Assert(t, testutil.ToFloat64(upstreamErrors.WithLabelValues("test", deadAddr, "transport")) >= 1)
+	assert.Assert(t, testutil.ToFloat64(upstreamErrors.WithLabelValues("test", healthy.URL, "transport")) == 0)
+}
+
+func TestClientAbortDoesNotEject(t *testing.T) {
+	requestReceived := make(chan struct{})
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestReceived <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+
+	b := testBalancer(t, erconfig.BackendOptsReverseProxy{
+		Origins: []string{slow.URL},
+		LoadBalancing: &erconfig.LoadBalancing{
+			EjectAfterFailures:   1,
+			EjectDurationSeconds: 30,
+		},
+	})
+
+	transport := &balancingTransport{appID: "test", balancer: b, inner: http.DefaultTransport}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-requestReceived
+		cancel()
+	}()
+
+	_, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	assert.Assert(t, errors.Is(err, context.Canceled))
+
+	assert.Assert(t, !b.origins[0].ejected(time.Now()))
+}
+
+func TestMetricsOfRemovedOriginsDeleted(t *testing.T) {
+	build := func(origins ...string) {
+		t.Helper()
+
+		_, err := NewWithModifyResponse("metricsapp", erconfig.BackendOptsReverseProxy{Origins: origins}, nil, slogshim.NewWithOutput(io.Discard))
+		assert.Ok(t, err)
+	}
+
+	build("http://a", "http://b")
+
+	upstreamErrors.WithLabelValues("metricsapp", "http://a", "5xx").Inc()
+	upstreamErrors.WithLabelValues("metricsapp", "http://b", "5xx").Inc()
+	upstreamDuration.WithLabelValues("metricsapp", "http://a").Observe(0.1)
+
+	build("http://b", "http://c") // "a" went away
+
+	// deleting succeeds only if the series still exists
+	assert.Assert(t, !upstreamErrors.DeleteLabelValues("metricsapp", "http://a", "5xx"))
+	assert.Assert(t, !upstreamDuration.DeleteLabelValues("metricsapp", "http://a"))
+	assert.Assert(t, upstreamErrors.DeleteLabelValues("metricsapp", "http://b", "5xx"))
+
+	upstreamErrors.WithLabelValues("metricsapp", "http://c", "5xx").Inc()
+
+	ForgetApp("metricsapp")
+
+	assert.Assert(t, !upstreamErrors.DeleteLabelValues("metricsapp", "http://c", "5xx"))
+}
+
+func testBalancer(t *testing.T, opts erconfig.BackendOptsReverseProxy) *balancer {
+	t.Helper()
+
+	assert.Ok(t, opts.Validate())
+
+	originURLs, err := parseOriginUrls(opts.Origins)
+	assert.Ok(t, err)
+
+	return newBalancer(originURLs, opts, nil, slogshim.NewWithOutput(io.Discard))
+}
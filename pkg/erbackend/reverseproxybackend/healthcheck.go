@@ -0,0 +1,328 @@
+package reverseproxybackend
+
+// Active health checking: probes origins in the background so that only healthy ones are routed to.
+//
+// Backend instances get re-created each time the app's config changes (which for Docker-discovered
+// apps happens whenever a replica comes or goes), so the probing state lives in a process-wide
+// registry keyed by (app, origin) instead of in the backend instance. That way an origin doesn't
+// lose its health state when its sibling replica gets added.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+)
+
+const (
+	defaultHealthCheckInterval           = 10 * time.Second
+	defaultHealthCheckTimeout            = 2 * time.Second
+	defaultHealthCheckHealthyThreshold   = 2
+	defaultHealthCheckUnhealthyThreshold = 3
+)
+
+var healthChecks = &healthCheckRegistry{
+	perApp: map[string]map[string]*activeHealth{},
+}
+
+type OriginHealthStatus struct {
+	AppID       string
+	Origin      string
+	Healthy     bool
+	LastChecked time.Time // zero if not probed yet
+	LastError   string
+}
+
+// current health status of all actively health checked origins, sorted by app and origin
+func OriginHealthStatuses() []OriginHealthStatus {
+	return healthChecks.statuses()
+}
+
+// releases what backends of an app that no longer exists left behind: probing of its origins and
+// the origins' metrics
+func ForgetApp(appID string) {
+	healthChecks.track(appID, nil, nil, nil)
+	upstreamMetricOrigins.track(appID, nil)
+}
+
+type healthCheckRegistry struct {
+	perApp map[string]map[string]*activeHealth // [appID][originURL]
+	mu     sync.Mutex
+}
+
+// declares the origins (and how to probe them) for an app, replacing the previous declaration.
+// probing for origins no longer declared is stopped. returns state for each declared origin.
+func (h *healthCheckRegistry) track(
+	appID string,
+	origins []url.URL,
+	probe *prober,
+	logger *slog.Logger,
+) map[string]*activeHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	previous := h.perApp[appID]
+	current := map[string]*activeHealth{}
+
+	for _, originURL := range origins {
+		key := originURL.String()
+
+		if existing, found := previous[key]; found && existing.probe.digest == probe.digest {
+			current[key] = existing
+			delete(previous, key)
+			continue
+		}
+
+		health := newActiveHealth(appID, originURL, probe, logger)
+		current[key] = health
+	}
+
+	for key, noLongerDeclared := range previous {
+		noLongerDeclared.stop()
+
+		if _, replaced := current[key]; !replaced {
+			originHealthy.DeleteLabelValues(appID, key)
+		}
+	}
+
+	if len(current) == 0 {
+		delete(h.perApp, appID)
+	} else {
+		h.perApp[appID] = current
+	}
+
+	return current
+}
+
+func (h *healthCheckRegistry) statuses() []OriginHealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	statuses := []OriginHealthStatus{}
+
+	for _, origins := range h.perApp {
+		for _, health := range origins {
+			statuses = append(statuses, health.status())
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].AppID != statuses[j].AppID {
+			return statuses[i].AppID < statuses[j].AppID
+		}
+
+		return statuses[i].Origin < statuses[j].Origin
+	})
+
+	return statuses
+}
+
+// how to probe origins of one app
+type prober struct {
+	opts            erconfig.HealthCheck
+	interval        time.Duration
+	timeout         time.Duration
+	transport       http.RoundTripper
+	headersToOrigin map[string]string
+	digest          string // if probing config changes, the state has to be re-established
+}
+
+func newProber(opts erconfig.HealthCheck, transport http.RoundTripper, headersToOrigin map[string]string) (*prober, error) {
+	digest, err := json.Marshal(struct {
+		Opts            erconfig.HealthCheck
+		HeadersToOrigin map[string]string
+	}{opts, headersToOrigin})
+	if err != nil {
+		return nil, err
+	}
+
+	orDefault := func(seconds int, def time.Duration) time.Duration {
+		if seconds == 0 {
+			return def
+		}
+
+		return time.Duration(seconds) * time.Second
+	}
+
+	return &prober{
+		opts:            opts,
+		interval:        orDefault(opts.IntervalSeconds, defaultHealthCheckInterval),
+		timeout:         orDefault(opts.TimeoutSeconds, defaultHealthCheckTimeout),
+		transport:       transport,
+		headersToOrigin: headersToOrigin,
+		digest:          string(digest),
+	}, nil
+}
+
+func (p *prober) probe(ctx context.Context, originURL url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	probeURL := originURL
+	probeURL.Path = originURL.Path + p.opts.Path
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range p.headersToOrigin {
+		req.Header.Set(key, value)
+	}
+
+	res, err := p.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if !p.statusOk(res.StatusCode) {
+		return fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func (p *prober) statusOk(status int) bool {
+	if p.opts.ExpectedStatus != 0 {
+		return status == p.opts.ExpectedStatus
+	}
+
+	return status >= 200 && status < 400
+}
+
+func (p *prober) healthyThreshold() int {
+	if p.opts.HealthyThreshold == 0 {
+		return defaultHealthCheckHealthyThreshold
+	}
+
+	return p.opts.HealthyThreshold
+}
+
+func (p *prober) unhealthyThreshold() int {
+	if p.opts.UnhealthyThreshold == 0 {
+		return defaultHealthCheckUnhealthyThreshold
+	}
+
+	return p.opts.UnhealthyThreshold
+}
+
+// health state of one origin, as determined by active probing
+type activeHealth struct {
+	appID   string
+	origin  url.URL
+	probe   *prober
+	healthy atomic.Bool
+	stop    context.CancelFunc
+	logger  *slog.Logger
+
+	mu                   sync.Mutex
+	checked              bool // false until first probe result
+	consecutiveSuccesses int
+	consecutiveFailures  int
+	lastChecked          time.Time
+	lastError            string
+}
+
+func newActiveHealth(appID string, origin url.URL, probe *prober, logger *slog.Logger) *activeHealth {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	health := &activeHealth{
+		appID:  appID,
+		origin: origin,
+		probe:  probe,
+		stop:   cancel,
+		logger: logger,
+	}
+
+	originHealthy.WithLabelValues(appID, origin.String()).Set(0)
+
+	go health.probeLoop(ctx)
+
+	return health
+}
+
+func (a *activeHealth) probeLoop(ctx context.Context) {
+	ticker := time.NewTicker(a.probe.interval)
+	defer ticker.Stop()
+
+	for {
+		// first probe immediately, so new origins become routable fast
+		err := a.probe.probe(ctx, a.origin)
+		if ctx.Err() != nil { // stopped while probing => result is meaningless
+			return
+		}
+
+		a.recordResult(err, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *activeHealth) recordResult(err error, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.lastChecked = now
+
+	wasHealthy := a.healthy.Load()
+
+	if err == nil {
+		a.lastError = ""
+		a.consecutiveSuccesses++
+		a.consecutiveFailures = 0
+
+		// first-ever result decides the state straight away (no need to wait for the threshold)
+		if !wasHealthy && (!a.checked || a.consecutiveSuccesses >= a.probe.healthyThreshold()) {
+			a.setHealthy(true)
+		}
+	} else {
+		a.lastError = err.Error()
+		a.consecutiveFailures++
+		a.consecutiveSuccesses = 0
+
+		if wasHealthy && a.consecutiveFailures >= a.probe.unhealthyThreshold() {
+			a.setHealthy(false)
+		}
+	}
+
+	a.checked = true
+}
+
+// expects lock to be held
+func (a *activeHealth) setHealthy(healthy bool) {
+	a.healthy.Store(healthy)
+
+	if healthy {
+		originHealthy.WithLabelValues(a.appID, a.origin.String()).Set(1)
+		a.logger.Info("origin healthy", "origin", a.origin.String())
+	} else {
+		originHealthy.WithLabelValues(a.appID, a.origin.String()).Set(0)
+		a.logger.Warn("origin unhealthy", "origin", a.origin.String(), "error", a.lastError)
+	}
+}
+
+func (a *activeHealth) status() OriginHealthStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return OriginHealthStatus{
+		AppID:       a.appID,
+		Origin:      a.origin.String(),
+		Healthy:     a.healthy.Load(),
+		LastChecked: a.lastChecked,
+		LastError:   a.lastError,
+	}
+}
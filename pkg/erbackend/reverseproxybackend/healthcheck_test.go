@@ -0,0 +1,81 @@
+package reverseproxybackend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+)
+
+func TestHealthThresholds(t *testing.T) {
+	probe, err := newProber(erconfig.HealthCheck{
+		Path:               "/health",
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	}, http.DefaultTransport, nil)
+	assert.Ok(t, err)
+
+	// not using newActiveHealth() so no probe loop gets started
+	health := &activeHealth{
+		appID:  "test",
+		origin: url.URL{Scheme: "http", Host: "a"},
+		probe:  probe,
+		logger: slogshim.NewWithOutput(io.Discard),
+	}
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	failed := errors.New("connection refused")
+
+	assert.Assert(t, !health.healthy.Load()) // unhealthy until proven otherwise
+
+	health.recordResult(nil, now) // first result decides straight away
+	assert.Assert(t, health.healthy.Load())
+
+	health.recordResult(failed, now)
+	assert.Assert(t, health.healthy.Load())
+	health.recordResult(failed, now)
+	assert.Assert(t, !health.healthy.Load())
+	assert.EqualString(t, health.status().LastError, "connection refused")
+
+	health.recordResult(nil, now)
+	assert.Assert(t, !health.healthy.Load())
+	health.recordResult(nil, now)
+	assert.Assert(t, health.healthy.Load())
+}
+
+func TestProbe(t *testing.T) {
+	healthy := true
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prefix/health" || r.Header.Get("Authorization") != "Basic Zm9vOmJhcg==" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !healthy {
+			http.Error(w, "starting up", http.StatusServiceUnavailable)
+		}
+	}))
+	defer origin.Close()
+
+	originURL, err := url.Parse(origin.URL + "/prefix")
+	assert.Ok(t, err)
+
+	probe, err := newProber(erconfig.HealthCheck{Path: "/health"}, http.DefaultTransport, map[string]string{
+		"Authorization": "Basic Zm9vOmJhcg==",
+	})
+	assert.Ok(t, err)
+
+	assert.Ok(t, probe.probe(context.Background(), *originURL))
+
+	healthy = false
+	assert.EqualString(t, probe.probe(context.Background(), *originURL).Error(), "unexpected status: 503")
+}
@@ -0,0 +1,69 @@
+package reverseproxybackend
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/function61/gokit/sliceutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	originHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "er_origin_healthy",
+		Help: "Active health check status of an origin (1 = healthy, 0 = unhealthy).",
+	}, []string{"app", "origin"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "er_upstream_duration_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.00025, 2, 16), // from 0.25ms to 8 seconds
+		Help:    "Time (in seconds) until an origin responded with headers. One per origin attempt.",
+	}, []string{"app", "origin"})
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "er_upstream_errors",
+		Help: "Origin attempts that failed, by reason (\"transport\" = no response, \"5xx\" = error status).",
+	}, []string{"app", "origin", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(originHealthy)
+	prometheus.MustRegister(upstreamDuration)
+	prometheus.MustRegister(upstreamErrors)
+}
+
+// origins are dynamic (Docker replicas come and go), so series of origins that are gone have to be
+// deleted or we'd keep accumulating them for as long as the process lives
+var upstreamMetricOrigins = &metricOriginRegistry{
+	perApp: map[string][]string{},
+}
+
+type metricOriginRegistry struct {
+	perApp map[string][]string // [appID] => origin URLs
+	mu     sync.Mutex
+}
+
+// declares the app's current origins. series of the previously declared ones that are no longer
+// among them are deleted.
+func (m *metricOriginRegistry) track(appID string, origins []url.URL) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := []string{}
+	for _, origin := range origins {
+		current = append(current, origin.String())
+	}
+
+	for _, previous := range m.perApp[appID] {
+		if !sliceutil.ContainsString(current, previous) {
+			labels := prometheus.Labels{"app": appID, "origin": previous}
+
+			upstreamDuration.DeletePartialMatch(labels)
+			upstreamErrors.DeletePartialMatch(labels)
+		}
+	}
+
+	if len(current) == 0 {
+		delete(m.perApp, appID)
+	} else {
+		m.perApp[appID] = current
+	}
+}
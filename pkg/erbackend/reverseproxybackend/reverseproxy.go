@@ -8,7 +8,6 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -31,7 +30,7 @@ import (
 //   4) now use cURL to request the same resource (= without caching), and you'll get 304 🤦
 
 func New(ctx context.Context, appID string, opts erconfig.BackendOptsReverseProxy, logger *slog.Logger) (http.Handler, error) {
-	handler, err := NewWithModifyResponse(appID, opts, nil)
+	handler, err := NewWithModifyResponse(appID, opts, nil, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -43,14 +42,15 @@ func NewWithModifyResponse(
 	appID string,
 	opts erconfig.BackendOptsReverseProxy,
 	modifyResponse func(r *http.Response) error,
+	logger *slog.Logger,
 ) (http.Handler, error) {
 	originUrls, err := parseOriginUrls(opts.Origins) // guarantees >= 1 items
 	if err != nil {
 		return nil, fmt.Errorf("reverseproxybackend: %w", err)
 	}
 
-	// transport that has optional TLS customizations and maybe caching (depending on options)
-	transport, err := maybeWrapWithCache(appID, opts, func() http.RoundTripper {
+	// transport that has optional TLS customizations
+	originTransport := func() http.RoundTripper {
 		if opts.TLSConfig != nil { // got custom TLS config?
 			return &http.Transport{
 				TLSClientConfig: &tls.Config{
@@ -62,19 +62,31 @@ func NewWithModifyResponse(
 		} else {
 			return http.DefaultTransport
 		}
-	}())
+	}()
+
+	// .. and maybe caching (depending on options)
+	transport, err := maybeWrapWithCache(appID, opts, originTransport)
 	if err != nil {
 		return nil, err
 	}
 
-	return &httputil.ReverseProxy{
-		Transport: transport,
-		Director: func(req *http.Request) {
-			//nolint:gosec // Cryptographical randomness not required here
-			randomOriginIdx := rand.Intn(len(originUrls))
+	// (also stops previous health checks for this app if they're no longer configured)
+	originHealths, err := trackHealthChecks(appID, originUrls, opts, originTransport, logger)
+	if err != nil {
+		return nil, fmt.Errorf("reverseproxybackend: %w", err)
+	}
 
-			originURL := originUrls[randomOriginIdx]
+	upstreamMetricOrigins.track(appID, originUrls)
 
+	return &httputil.ReverseProxy{
+		// origin-specific parts of the request are filled in by the balancer at round trip time
+		Transport: &balancingTransport{
+			appID:          appID,
+			balancer:       newBalancer(originUrls, opts, originHealths, logger),
+			inner:          transport,
+			passHostHeader: opts.PassHostHeader,
+		},
+		Director: func(req *http.Request) {
 			maybeIndexSuffix := func() string { // "/foo/" => "/foo/index.html" (if configured)
 				if opts.IndexDocument != "" && strings.HasSuffix(req.URL.Path, "/") {
 					return opts.IndexDocument
@@ -83,19 +95,7 @@ func NewWithModifyResponse(
 				}
 			}()
 
-			req.URL.Scheme = originURL.Scheme // "http" | "https"
-
-			// this specifies the host we're connecting to
-			req.URL.Host = originURL.Host
-
-			// sometimes we want the outgoing request to include the original "Host: ..." header, so
-			// the backend can see what hostname is in browser's address bar
-			if !opts.PassHostHeader {
-				req.Host = originURL.Host
-			}
-
-			// origin's Path is "normally" empty (e.g. "http://example.com"), but can be used to add a prefix
-			req.URL.Path = originURL.Path + req.URL.Path + maybeIndexSuffix
+			req.URL.Path += maybeIndexSuffix
 
 			// remove query string if we know we're serving static content and the output does
 			// not vary based on query string. someone malicious could even be trying to flood our
@@ -115,6 +115,25 @@ func NewWithModifyResponse(
 	}, nil
 }
 
+func trackHealthChecks(
+	appID string,
+	originURLs []url.URL,
+	opts erconfig.BackendOptsReverseProxy,
+	originTransport http.RoundTripper,
+	logger *slog.Logger,
+) (map[string]*activeHealth, error) {
+	if opts.HealthCheck == nil {
+		return healthChecks.track(appID, nil, nil, logger), nil
+	}
+
+	probe, err := newProber(*opts.HealthCheck, originTransport, opts.HeadersToOrigin)
+	if err != nil {
+		return nil, err
+	}
+
+	return healthChecks.track(appID, originURLs, probe, logger), nil
+}
+
 func maybeWrapWithCache(
 	appID string,
 	opts erconfig.BackendOptsReverseProxy,
@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
@@ -16,7 +17,7 @@ import (
 	"github.com/function61/gokit/ezhttp"
 )
 
-func New(appID string, opts erconfig.BackendOptsS3StaticWebsite) (http.Handler, error) {
+func New(appID string, opts erconfig.BackendOptsS3StaticWebsite, logger *slog.Logger) (http.Handler, error) {
 	if opts.DeployedVersion == "" {
 		errMsg := fmt.Sprintf("no deployed version for %s", appID)
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -31,9 +32,9 @@ func New(appID string, opts erconfig.BackendOptsS3StaticWebsite) (http.Handler,
 
 	cacheNotFound := &cache404{}
 
-	// FIXME: it uses appId as cache key, thus we synthetize new cache each time a
-	//        new version is deployed
-	return reverseproxybackend.NewWithModifyResponse(appID+"-"+opts.DeployedVersion, erconfig.BackendOptsReverseProxy{
+	// the version is only in the origin URL, so metrics etc. tracked per app ID carry over to the next
+	// deploy. the disk cache is per app too, but it's keyed by the origin URL so versions don't mix.
+	return reverseproxybackend.NewWithModifyResponse(appID, erconfig.BackendOptsReverseProxy{
 		// "/favicon.ico" =>
 		//   https://s3.us-east-1.amazonaws.com/myorg-websites/sites/joonasfi-blog/versionid/favicon.ico
 		Origins: []string{origin},
@@ -57,7 +58,7 @@ func New(appID string, opts erconfig.BackendOptsS3StaticWebsite) (http.Handler,
 		}
 
 		return nil
-	})
+	}, logger)
 }
 
 func serveCached404Page(url404 string, cacheNotFound *cache404) ([]byte, string, error) {
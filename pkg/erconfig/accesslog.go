@@ -0,0 +1,28 @@
+package erconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+// per-app access log settings. without this, all of the app's requests are logged (if the access
+// log is enabled at all).
+type AccessLogPolicy struct {
+	Disabled     bool     `json:"disabled,omitempty"`
+	SampleRate   float64  `json:"sample_rate,omitempty"`   // share of requests logged, 0 < x <= 1. unset = all. failed requests are always logged
+	ExcludePaths []string `json:"exclude_paths,omitempty"` // noisy ones like health checks. "/healthz" covers "/healthz" and "/healthz/..."
+}
+
+func (a *AccessLogPolicy) Validate() error {
+	if a.SampleRate < 0 || a.SampleRate > 1 {
+		return fmt.Errorf("SampleRate: must be between 0 and 1; got %v", a.SampleRate)
+	}
+
+	for _, path := range a.ExcludePaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("ExcludePaths: must start with '/': %s", path)
+		}
+	}
+
+	return nil
+}
@@ -2,12 +2,16 @@
 package erconfig
 
 import (
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/function61/edgerouter/pkg/turbocharger"
+	"github.com/function61/gokit/sliceutil"
 )
 
 // can be used to fetch the current state of configuration - the apps Edgerouter knows *right now*,
@@ -21,9 +25,10 @@ type CurrentConfigAccessor interface {
 type FrontendKind string
 
 const (
-	FrontendKindHostname       FrontendKind = "hostname"
-	FrontendKindHostnameRegexp FrontendKind = "hostname_regexp"
-	FrontendKindPathPrefix     FrontendKind = "path_prefix"
+	FrontendKindHostname         FrontendKind = "hostname"
+	FrontendKindHostnameWildcard FrontendKind = "hostname_wildcard" // "*.example.com". uses Hostname field.
+	FrontendKindHostnameRegexp   FrontendKind = "hostname_regexp"
+	FrontendKindPathPrefix       FrontendKind = "path_prefix"
 )
 
 // https://docs.traefik.io/v1.7/basics/#matchers
@@ -34,12 +39,67 @@ type Frontend struct {
 	PathPrefix        string       `json:"path_prefix"` // applies with both kinds
 	StripPathPrefix   bool         `json:"strip_path_prefix,omitempty"`
 	AllowInsecureHTTP bool         `json:"allow_insecure_http,omitempty"`
+
+	// additional matchers, evaluated after hostname and path prefix have matched. all specified have to match.
+	Methods    []string       `json:"methods,omitempty"`     // any of these, e.g. ["GET", "HEAD"]
+	Headers    []ValueMatcher `json:"headers,omitempty"`     // all of these
+	Queries    []ValueMatcher `json:"queries,omitempty"`     // all of these (query parameters)
+	PathRegexp string         `json:"path_regexp,omitempty"` // full path, e.g. "^/users/[0-9]+$"
+
+	TLS *TLSPolicy `json:"tls,omitempty"` // nil = defaults (unless other frontend of the same hostname specifies it)
+}
+
+// matches a header or query parameter. with neither value nor regexp the parameter only has to be present.
+// for multi-valued parameters it's enough for one of the values to match.
+type ValueMatcher struct {
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`  // exact match
+	Regexp string `json:"regexp,omitempty"` // unanchored, so use "^...$" if you want full match
+}
+
+func (v *ValueMatcher) Validate() error {
+	if err := ErrorIfUnset(v.Name == "", "Name"); err != nil {
+		return err
+	}
+
+	if v.Value != "" && v.Regexp != "" {
+		return fmt.Errorf("%s: specify either Value or Regexp, not both", v.Name)
+	}
+
+	if v.Regexp != "" {
+		if _, err := regexp.Compile(v.Regexp); err != nil {
+			return fmt.Errorf("%s: Regexp: %v", v.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// true if the frontend has matchers in addition to hostname and path prefix
+func (f *Frontend) HasAdditionalMatchers() bool {
+	return len(f.Methods) > 0 || len(f.Headers) > 0 || len(f.Queries) > 0 || f.PathRegexp != ""
 }
 
 func (f *Frontend) Validate() error {
 	switch f.Kind {
 	case FrontendKindHostname:
-		return ErrorIfUnset(f.Hostname == "", "Hostname")
+		if err := ErrorIfUnset(f.Hostname == "", "Hostname"); err != nil {
+			return err
+		}
+
+		if strings.Contains(f.Hostname, "*") {
+			return fmt.Errorf("Hostname: '%s' looks like a wildcard. use kind %s", f.Hostname, FrontendKindHostnameWildcard)
+		}
+	case FrontendKindHostnameWildcard:
+		if err := ErrorIfUnset(f.Hostname == "", "Hostname"); err != nil {
+			return err
+		}
+
+		// like with TLS certificates, the wildcard is the whole leftmost label
+		parent, isWildcard := strings.CutPrefix(f.Hostname, "*.")
+		if !isWildcard || parent == "" || strings.Contains(parent, "*") {
+			return fmt.Errorf("Hostname: expecting wildcard like '*.example.com'; got '%s'", f.Hostname)
+		}
 	case FrontendKindHostnameRegexp:
 		if err := ErrorIfUnset(f.HostnameRegexp == "", "HostnameRegexp"); err != nil {
 			return err
@@ -50,11 +110,51 @@ func (f *Frontend) Validate() error {
 			return fmt.Errorf("HostnameRegexp: %v", err)
 		}
 	case FrontendKindPathPrefix:
-		return ErrorIfUnset(f.PathPrefix == "", "PathPrefix")
+		if err := ErrorIfUnset(f.PathPrefix == "", "PathPrefix"); err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("unknown frontend kind: %s", f.Kind)
 	}
 
+	if f.TLS != nil {
+		if f.Kind == FrontendKindPathPrefix { // TLS policy is chosen based on hostname (SNI)
+			return fmt.Errorf("TLS: not supported for kind %s", f.Kind)
+		}
+
+		if err := f.TLS.Validate(); err != nil {
+			return fmt.Errorf("TLS: %w", err)
+		}
+	}
+
+	return f.validateAdditionalMatchers()
+}
+
+func (f *Frontend) validateAdditionalMatchers() error {
+	for _, method := range f.Methods {
+		if method == "" || method != strings.ToUpper(method) {
+			return fmt.Errorf("Methods: method must be in uppercase: '%s'", method)
+		}
+	}
+
+	for _, header := range f.Headers {
+		if err := header.Validate(); err != nil {
+			return fmt.Errorf("Headers: %w", err)
+		}
+	}
+
+	for _, query := range f.Queries {
+		if err := query.Validate(); err != nil {
+			return fmt.Errorf("Queries: %w", err)
+		}
+	}
+
+	if f.PathRegexp != "" {
+		if _, err := regexp.Compile(f.PathRegexp); err != nil {
+			return fmt.Errorf("PathRegexp: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -62,6 +162,10 @@ type Application struct {
 	ID        string     `json:"id"` // ACLs can reference this, so keep stable (i.e. service replicas/restarts should not affect this)
 	Frontends []Frontend `json:"frontends"`
 	Backend   Backend    `json:"backend"`
+
+	AccessLog        *AccessLogPolicy        `json:"access_log,omitempty"`        // nil = all requests are logged
+	RateLimit        *RateLimitPolicy        `json:"rate_limit,omitempty"`        // nil = not rate limited
+	ConcurrencyLimit *ConcurrencyLimitPolicy `json:"concurrency_limit,omitempty"` // nil = not limited
 }
 
 func (a *Application) Validate() error {
@@ -79,6 +183,24 @@ func (a *Application) Validate() error {
 		}
 	}
 
+	if a.AccessLog != nil {
+		if err := a.AccessLog.Validate(); err != nil {
+			return fmt.Errorf("app %s AccessLog: %w", a.ID, err)
+		}
+	}
+
+	if a.RateLimit != nil {
+		if err := a.RateLimit.Validate(); err != nil {
+			return fmt.Errorf("app %s RateLimit: %w", a.ID, err)
+		}
+	}
+
+	if a.ConcurrencyLimit != nil {
+		if err := a.ConcurrencyLimit.Validate(); err != nil {
+			return fmt.Errorf("app %s ConcurrencyLimit: %w", a.ID, err)
+		}
+	}
+
 	switch a.Backend.Kind {
 	case BackendKindS3StaticWebsite:
 		return a.Backend.S3StaticWebsiteOpts.Validate()
@@ -86,12 +208,20 @@ func (a *Application) Validate() error {
 		return a.Backend.ReverseProxyOpts.Validate()
 	case BackendKindAwsLambda:
 		return a.Backend.AwsLambdaOpts.Validate()
-	case BackendKindEdgerouterAdmin, BackendKindPromMetrics:
+	case BackendKindEdgerouterAdmin, BackendKindPromMetrics, BackendKindAcmeChallenge:
 		return nil // nothing to validate
 	case BackendKindAuthV0:
 		return a.Backend.AuthV0Opts.Validate()
+	case BackendKindAuthBasic:
+		return a.Backend.AuthBasicOpts.Validate()
 	case BackendKindAuthSso:
 		return a.Backend.AuthSsoOpts.Validate()
+	case BackendKindAuthMtls:
+		return a.Backend.AuthMtlsOpts.Validate()
+	case BackendKindAuthOidc:
+		return a.Backend.AuthOidcOpts.Validate()
+	case BackendKindAuthForward:
+		return a.Backend.AuthForwardOpts.Validate()
 	case BackendKindRedirect:
 		return a.Backend.RedirectOpts.Validate()
 	case BackendKindTurbocharger:
@@ -113,10 +243,15 @@ const (
 	BackendKindAwsLambda       BackendKind = "aws_lambda"
 	BackendKindEdgerouterAdmin BackendKind = "edgerouter_admin"
 	BackendKindAuthV0          BackendKind = "auth_v0"
+	BackendKindAuthBasic       BackendKind = "auth_basic"
 	BackendKindAuthSso         BackendKind = "auth_sso"
+	BackendKindAuthMtls        BackendKind = "auth_mtls"
+	BackendKindAuthOidc        BackendKind = "auth_oidc"
+	BackendKindAuthForward     BackendKind = "auth_forward"
 	BackendKindRedirect        BackendKind = "redirect"
 	BackendKindPromMetrics     BackendKind = "prom_metrics"
 	BackendKindTurbocharger    BackendKind = "turbocharger"
+	BackendKindAcmeChallenge   BackendKind = "acme_challenge" // answers ACME HTTP-01 challenges of our built-in ACME client
 )
 
 type Backend struct {
@@ -125,7 +260,11 @@ type Backend struct {
 	ReverseProxyOpts    *BackendOptsReverseProxy    `json:"reverse_proxy_opts,omitempty"`
 	AwsLambdaOpts       *BackendOptsAwsLambda       `json:"aws_lambda_opts,omitempty"`
 	AuthV0Opts          *BackendOptsAuthV0          `json:"auth_v0_opts,omitempty"`
+	AuthBasicOpts       *BackendOptsAuthBasic       `json:"auth_basic_opts,omitempty"`
 	AuthSsoOpts         *BackendOptsAuthSso         `json:"auth_sso_opts,omitempty"`
+	AuthMtlsOpts        *BackendOptsAuthMtls        `json:"auth_mtls_opts,omitempty"`
+	AuthOidcOpts        *BackendOptsAuthOidc        `json:"auth_oidc_opts,omitempty"`
+	AuthForwardOpts     *BackendOptsAuthForward     `json:"auth_forward_opts,omitempty"`
 	RedirectOpts        *BackendOptsRedirect        `json:"redirect_opts,omitempty"`
 	TurbochargerOpts    *BackendOptsTurbocharger    `json:"turbocharger_opts,omitempty"`
 }
@@ -146,6 +285,9 @@ func (b *BackendOptsS3StaticWebsite) Validate() error {
 
 type BackendOptsReverseProxy struct {
 	Origins           []string          `json:"origins"`
+	OriginWeights     map[string]int    `json:"origin_weights,omitempty"` // origin => relative share of traffic. origins not listed here have weight 1
+	LoadBalancing     *LoadBalancing    `json:"load_balancing,omitempty"`
+	HealthCheck       *HealthCheck      `json:"health_check,omitempty"` // active probing. if set, only origins that pass are routed to
 	TLSConfig         *TLSConfig        `json:"tls_config,omitempty"`
 	Caching           bool              `json:"caching,omitempty"`             // turn on response caching?
 	PassHostHeader    bool              `json:"pass_host_header,omitempty"`    // use client-sent Host (=true) or origin's hostname? (=false) https://doc.traefik.io/traefik/routing/services/#pass-host-header
@@ -155,7 +297,68 @@ type BackendOptsReverseProxy struct {
 }
 
 func (b *BackendOptsReverseProxy) Validate() error {
-	return ErrorIfUnset(len(b.Origins) == 0, "Origins")
+	if err := ErrorIfUnset(len(b.Origins) == 0, "Origins"); err != nil {
+		return err
+	}
+
+	for origin, weight := range b.OriginWeights {
+		if !sliceutil.ContainsString(b.Origins, origin) {
+			return fmt.Errorf("OriginWeights: origin not in Origins: %s", origin)
+		}
+
+		if weight < 1 {
+			return fmt.Errorf("OriginWeights: weight for %s must be >= 1; got %d", origin, weight)
+		}
+	}
+
+	if b.LoadBalancing != nil {
+		if err := b.LoadBalancing.Validate(); err != nil {
+			return fmt.Errorf("LoadBalancing: %w", err)
+		}
+	}
+
+	if b.HealthCheck != nil {
+		if err := b.HealthCheck.Validate(); err != nil {
+			return fmt.Errorf("HealthCheck: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type LoadBalancingStrategy string
+
+const (
+	LoadBalancingStrategyRoundRobin        LoadBalancingStrategy = "round_robin" // weighted. the default
+	LoadBalancingStrategyLeastOutstanding  LoadBalancingStrategy = "least_outstanding"
+	LoadBalancingStrategyPowerOfTwoChoices LoadBalancingStrategy = "power_of_two_choices"
+	loadBalancingStrategyDefault           LoadBalancingStrategy = ""
+)
+
+// how traffic is spread across a reverse proxy's origins, and when a misbehaving origin is
+// taken out of rotation ("ejected"). ejected origins are re-admitted after the ejection duration.
+type LoadBalancing struct {
+	Strategy             LoadBalancingStrategy `json:"strategy,omitempty"`
+	EjectAfterFailures   int                   `json:"eject_after_failures,omitempty"`   // consecutive connection errors or 5xx responses. 0 = default, -1 = never eject
+	EjectDurationSeconds int                   `json:"eject_duration_seconds,omitempty"` // 0 = default
+}
+
+func (l *LoadBalancing) Validate() error {
+	switch l.Strategy {
+	case loadBalancingStrategyDefault, LoadBalancingStrategyRoundRobin, LoadBalancingStrategyLeastOutstanding, LoadBalancingStrategyPowerOfTwoChoices:
+	default:
+		return fmt.Errorf("unknown strategy: %s", l.Strategy)
+	}
+
+	if l.EjectAfterFailures < -1 {
+		return fmt.Errorf("EjectAfterFailures: invalid value %d", l.EjectAfterFailures)
+	}
+
+	if l.EjectDurationSeconds < 0 {
+		return fmt.Errorf("EjectDurationSeconds: invalid value %d", l.EjectDurationSeconds)
+	}
+
+	return nil
 }
 
 type BackendOptsAwsLambda struct {
@@ -183,6 +386,67 @@ func (b *BackendOptsAuthV0) Validate() error {
 	)
 }
 
+// basic auth with a user list
+type BackendOptsAuthBasic struct {
+	Realm             string          `json:"realm,omitempty"` // shown in the browser's password prompt
+	Users             []AuthBasicUser `json:"users"`
+	AuthorizedBackend *Backend        `json:"authorized_backend"` // ptr for validation
+}
+
+type AuthBasicUser struct {
+	Username            string   `json:"username"`
+	PasswordHash        string   `json:"password_hash"`                   // bcrypt ("$2b$...") or argon2id ("$argon2id$..."). use "$ edgerouter auth-basic hash-password"
+	AllowedPathPrefixes []string `json:"allowed_path_prefixes,omitempty"` // empty = all paths
+}
+
+func (b *BackendOptsAuthBasic) Validate() error {
+	if err := FirstError(
+		ErrorIfUnset(b.AuthorizedBackend == nil, "AuthorizedBackend"),
+		ErrorIfUnset(len(b.Users) == 0, "Users"),
+	); err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, user := range b.Users {
+		if err := user.Validate(); err != nil {
+			return fmt.Errorf("Users: %s: %w", user.Username, err)
+		}
+
+		if seen[user.Username] {
+			return fmt.Errorf("Users: duplicate username: %s", user.Username)
+		}
+		seen[user.Username] = true
+	}
+
+	return nil
+}
+
+func (u *AuthBasicUser) Validate() error {
+	if err := FirstError(
+		ErrorIfUnset(u.Username == "", "Username"),
+		ErrorIfUnset(u.PasswordHash == "", "PasswordHash"),
+	); err != nil {
+		return err
+	}
+
+	if strings.Contains(u.Username, ":") { // separator in basic auth
+		return errors.New("Username: can't contain ':'")
+	}
+
+	if !strings.HasPrefix(u.PasswordHash, "$2") && !strings.HasPrefix(u.PasswordHash, "$argon2id$") {
+		return errors.New("PasswordHash: not bcrypt or argon2id")
+	}
+
+	for _, prefix := range u.AllowedPathPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("AllowedPathPrefixes: must start with '/': %s", prefix)
+		}
+	}
+
+	return nil
+}
+
 type BackendOptsAuthSso struct {
 	IDServerURL       string   `json:"id_server_url,omitempty"`
 	AllowedUserIds    []string `json:"allowed_user_ids"`
@@ -197,6 +461,116 @@ func (b *BackendOptsAuthSso) Validate() error {
 	)
 }
 
+// client has to present a certificate issued by one of the CAs
+type BackendOptsAuthMtls struct {
+	CACertificates    string   `json:"ca_certificates"`            // PEM
+	AllowedSubjects   []string `json:"allowed_subjects,omitempty"` // subject CN or DNS/email/URI SANs. empty = any certificate from the CAs
+	AuthorizedBackend *Backend `json:"authorized_backend"`         // ptr for validation
+}
+
+func (b *BackendOptsAuthMtls) Validate() error {
+	if err := FirstError(
+		ErrorIfUnset(b.AuthorizedBackend == nil, "AuthorizedBackend"),
+		ErrorIfUnset(b.CACertificates == "", "CACertificates"),
+	); err != nil {
+		return err
+	}
+
+	if _, err := b.CertPool(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *BackendOptsAuthMtls) CertPool() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(b.CACertificates)) {
+		return nil, errors.New("CACertificates: no certificates found")
+	}
+
+	return pool, nil
+}
+
+// login with any OpenID Connect provider. user gets in if any of the allowlists match.
+type BackendOptsAuthOidc struct {
+	IssuerURL              string   `json:"issuer_url"` // ex: "https://accounts.google.com". discovery document is looked up from here
+	ClientID               string   `json:"client_id"`
+	ClientSecret           string   `json:"client_secret,omitempty"`            // empty for public clients (PKCE is used in any case)
+	Scopes                 []string `json:"scopes,omitempty"`                   // "openid" is always requested. default "email" + "profile" (+ "groups" if AllowedGroups)
+	CookieSecret           string   `json:"cookie_secret"`                      // session cookies are encrypted with this. changing it logs everybody out
+	CallbackPath           string   `json:"callback_path,omitempty"`            // default "/_auth/oidc/callback". register "https://<hostname><CallbackPath>" with the provider
+	SessionDurationSeconds int      `json:"session_duration_seconds,omitempty"` // 0 = default (12 hours)
+	AllowedEmails          []string `json:"allowed_emails,omitempty"`
+	AllowedDomains         []string `json:"allowed_domains,omitempty"` // email domains, like "example.com"
+	AllowedGroups          []string `json:"allowed_groups,omitempty"`
+	GroupsClaim            string   `json:"groups_claim,omitempty"` // default "groups"
+	AuthorizedBackend      *Backend `json:"authorized_backend"`     // ptr for validation
+}
+
+func (b *BackendOptsAuthOidc) Validate() error {
+	if err := FirstError(
+		ErrorIfUnset(b.AuthorizedBackend == nil, "AuthorizedBackend"),
+		ErrorIfUnset(b.IssuerURL == "", "IssuerURL"),
+		ErrorIfUnset(b.ClientID == "", "ClientID"),
+		ErrorIfUnset(b.CookieSecret == "", "CookieSecret"),
+	); err != nil {
+		return err
+	}
+
+	if len(b.CookieSecret) < 32 {
+		return errors.New("CookieSecret: must be at least 32 characters")
+	}
+
+	// accidental empty could be dangerous (everybody with an account at the provider would get in)
+	if len(b.AllowedEmails) == 0 && len(b.AllowedDomains) == 0 && len(b.AllowedGroups) == 0 {
+		return errors.New("specify at least one of AllowedEmails, AllowedDomains or AllowedGroups")
+	}
+
+	if b.CallbackPath != "" && !strings.HasPrefix(b.CallbackPath, "/") {
+		return fmt.Errorf("CallbackPath: must start with '/': %s", b.CallbackPath)
+	}
+
+	if b.SessionDurationSeconds < 0 {
+		return fmt.Errorf("SessionDurationSeconds: invalid value %d", b.SessionDurationSeconds)
+	}
+
+	return nil
+}
+
+// asks an external authorization service (like nginx's auth_request or Traefik's ForwardAuth) for
+// each request. 2xx from the service = allowed, any other response is returned to the client.
+type BackendOptsAuthForward struct {
+	URL               string   `json:"url"`                        // ex: "http://authz.internal:8080/check"
+	ResponseHeaders   []string `json:"response_headers,omitempty"` // copied from the auth service's response to the request to AuthorizedBackend
+	TimeoutSeconds    int      `json:"timeout_seconds,omitempty"`  // 0 = default (5 seconds)
+	AuthorizedBackend *Backend `json:"authorized_backend"`         // ptr for validation
+}
+
+func (b *BackendOptsAuthForward) Validate() error {
+	if err := FirstError(
+		ErrorIfUnset(b.AuthorizedBackend == nil, "AuthorizedBackend"),
+		ErrorIfUnset(b.URL == "", "URL"),
+	); err != nil {
+		return err
+	}
+
+	authURL, err := url.Parse(b.URL)
+	if err != nil {
+		return fmt.Errorf("URL: %w", err)
+	}
+
+	if (authURL.Scheme != "http" && authURL.Scheme != "https") || authURL.Host == "" {
+		return fmt.Errorf("URL: must be absolute http(s) URL: %s", b.URL)
+	}
+
+	if b.TimeoutSeconds < 0 {
+		return fmt.Errorf("TimeoutSeconds: invalid value %d", b.TimeoutSeconds)
+	}
+
+	return nil
+}
+
 type BackendOptsRedirect struct {
 	To string `json:"to"`
 }
@@ -234,6 +608,29 @@ func SimpleHostnameFrontend(hostname string, options ...FrontendOpt) Frontend {
 		PathPrefix:        opts.pathPrefix,
 		StripPathPrefix:   opts.stripPathPrefix,
 		AllowInsecureHTTP: opts.allowInsecureHTTP,
+		Methods:           opts.methods,
+		Headers:           opts.headers,
+		Queries:           opts.queries,
+		PathRegexp:        opts.pathRegexp,
+		TLS:               opts.tlsPolicy,
+	}
+}
+
+// "*.example.com" matches "foo.example.com" but not "example.com" or "foo.bar.example.com"
+func WildcardHostnameFrontend(wildcard string, options ...FrontendOpt) Frontend {
+	opts := getFrontendOptions(options)
+
+	return Frontend{
+		Kind:              FrontendKindHostnameWildcard,
+		Hostname:          wildcard,
+		PathPrefix:        opts.pathPrefix,
+		StripPathPrefix:   opts.stripPathPrefix,
+		AllowInsecureHTTP: opts.allowInsecureHTTP,
+		Methods:           opts.methods,
+		Headers:           opts.headers,
+		Queries:           opts.queries,
+		PathRegexp:        opts.pathRegexp,
+		TLS:               opts.tlsPolicy,
 	}
 }
 
@@ -246,6 +643,11 @@ func RegexpHostnameFrontend(hostnameRegexp string, options ...FrontendOpt) Front
 		PathPrefix:        opts.pathPrefix,
 		StripPathPrefix:   opts.stripPathPrefix,
 		AllowInsecureHTTP: opts.allowInsecureHTTP,
+		Methods:           opts.methods,
+		Headers:           opts.headers,
+		Queries:           opts.queries,
+		PathRegexp:        opts.pathRegexp,
+		TLS:               opts.tlsPolicy,
 	}
 }
 
@@ -258,6 +660,11 @@ func PathPrefixFrontend(pathPrefix string, options ...FrontendOpt) Frontend {
 		PathPrefix:        opts.pathPrefix,
 		StripPathPrefix:   opts.stripPathPrefix,
 		AllowInsecureHTTP: opts.allowInsecureHTTP,
+		Methods:           opts.methods,
+		Headers:           opts.headers,
+		Queries:           opts.queries,
+		PathRegexp:        opts.pathRegexp,
+		TLS:               opts.tlsPolicy,
 	}
 }
 
@@ -324,6 +731,12 @@ func PromMetricsBackend() Backend {
 	}
 }
 
+func AcmeChallengeBackend() Backend {
+	return Backend{
+		Kind: BackendKindAcmeChallenge,
+	}
+}
+
 func AuthV0Backend(bearerToken string, authorizedBackend Backend) Backend {
 	return Backend{
 		Kind: BackendKindAuthV0,
@@ -334,6 +747,47 @@ func AuthV0Backend(bearerToken string, authorizedBackend Backend) Backend {
 	}
 }
 
+func AuthBasicBackend(users []AuthBasicUser, authorizedBackend Backend) Backend {
+	return Backend{
+		Kind: BackendKindAuthBasic,
+		AuthBasicOpts: &BackendOptsAuthBasic{
+			Users:             users,
+			AuthorizedBackend: &authorizedBackend,
+		},
+	}
+}
+
+func AuthForwardBackend(authURL string, responseHeaders []string, authorizedBackend Backend) Backend {
+	return Backend{
+		Kind: BackendKindAuthForward,
+		AuthForwardOpts: &BackendOptsAuthForward{
+			URL:               authURL,
+			ResponseHeaders:   responseHeaders,
+			AuthorizedBackend: &authorizedBackend,
+		},
+	}
+}
+
+func AuthMtlsBackend(caCertificates string, allowedSubjects []string, authorizedBackend Backend) Backend {
+	return Backend{
+		Kind: BackendKindAuthMtls,
+		AuthMtlsOpts: &BackendOptsAuthMtls{
+			CACertificates:    caCertificates,
+			AllowedSubjects:   allowedSubjects,
+			AuthorizedBackend: &authorizedBackend,
+		},
+	}
+}
+
+func AuthOidcBackend(opts BackendOptsAuthOidc, authorizedBackend Backend) Backend {
+	opts.AuthorizedBackend = &authorizedBackend
+
+	return Backend{
+		Kind:         BackendKindAuthOidc,
+		AuthOidcOpts: &opts,
+	}
+}
+
 func AuthSsoBackend(
 	idServerURL string,
 	allowedUserIds []string,
@@ -367,15 +821,48 @@ func (a *Application) Describe() string {
 }
 
 func (f *Frontend) Describe() string {
-	switch f.Kind {
-	case FrontendKindHostname:
-		return string(f.Kind) + ":" + f.Hostname + f.PathPrefix
-	case FrontendKindHostnameRegexp:
-		return string(f.Kind) + ":" + f.HostnameRegexp + f.PathPrefix
-	case FrontendKindPathPrefix:
-		return string(f.Kind) + ":" + f.PathPrefix
+	description := func() string {
+		switch f.Kind {
+		case FrontendKindHostname, FrontendKindHostnameWildcard:
+			return string(f.Kind) + ":" + f.Hostname + f.PathPrefix
+		case FrontendKindHostnameRegexp:
+			return string(f.Kind) + ":" + f.HostnameRegexp + f.PathPrefix
+		case FrontendKindPathPrefix:
+			return string(f.Kind) + ":" + f.PathPrefix
+		default:
+			return string(f.Kind)
+		}
+	}()
+
+	conditions := []string{}
+	if len(f.Methods) > 0 {
+		conditions = append(conditions, "method="+strings.Join(f.Methods, "|"))
+	}
+	for _, header := range f.Headers {
+		conditions = append(conditions, "header:"+header.Describe())
+	}
+	for _, query := range f.Queries {
+		conditions = append(conditions, "query:"+query.Describe())
+	}
+	if f.PathRegexp != "" {
+		conditions = append(conditions, "path~"+f.PathRegexp)
+	}
+
+	if len(conditions) > 0 {
+		description += " [" + strings.Join(conditions, ", ") + "]"
+	}
+
+	return description
+}
+
+func (v *ValueMatcher) Describe() string {
+	switch {
+	case v.Value != "":
+		return v.Name + "=" + v.Value
+	case v.Regexp != "":
+		return v.Name + "~" + v.Regexp
 	default:
-		return string(f.Kind)
+		return v.Name
 	}
 }
 
@@ -389,19 +876,64 @@ func (b *Backend) Describe() string {
 		return string(b.Kind) + ":" + fmt.Sprintf("%s@%s", b.AwsLambdaOpts.FunctionName, b.AwsLambdaOpts.RegionID)
 	case BackendKindAuthV0:
 		return string(b.Kind) + ":" + fmt.Sprintf("[bearerToken=...] -> %s", b.AuthV0Opts.AuthorizedBackend.Describe())
+	case BackendKindAuthBasic:
+		usernames := []string{}
+		for _, user := range b.AuthBasicOpts.Users {
+			usernames = append(usernames, user.Username)
+		}
+
+		return string(b.Kind) + ":" + fmt.Sprintf("[users=%s] -> %s", strings.Join(usernames, ","), b.AuthBasicOpts.AuthorizedBackend.Describe())
 	case BackendKindRedirect:
 		return string(b.Kind) + ":" + b.RedirectOpts.To
 	case BackendKindTurbocharger:
 		return string(b.Kind) + ":" + b.TurbochargerOpts.Manifest.String()
 	case BackendKindAuthSso:
 		return string(b.Kind) + ":" + fmt.Sprintf("[audience=%s] -> %s", b.AuthSsoOpts.Audience, b.AuthSsoOpts.AuthorizedBackend.Describe())
-	case BackendKindEdgerouterAdmin, BackendKindPromMetrics: // to please exhaustive lint
+	case BackendKindAuthMtls:
+		return string(b.Kind) + ":" + fmt.Sprintf("[allowedSubjects=%s] -> %s", strings.Join(b.AuthMtlsOpts.AllowedSubjects, ","), b.AuthMtlsOpts.AuthorizedBackend.Describe())
+	case BackendKindAuthOidc:
+		return string(b.Kind) + ":" + fmt.Sprintf("[issuer=%s] -> %s", b.AuthOidcOpts.IssuerURL, b.AuthOidcOpts.AuthorizedBackend.Describe())
+	case BackendKindAuthForward:
+		return string(b.Kind) + ":" + fmt.Sprintf("[%s] -> %s", b.AuthForwardOpts.URL, b.AuthForwardOpts.AuthorizedBackend.Describe())
+	case BackendKindEdgerouterAdmin, BackendKindPromMetrics, BackendKindAcmeChallenge: // to please exhaustive lint
 		return string(b.Kind)
 	default: // should never actually arrive here
 		return string(b.Kind)
 	}
 }
 
+// each Edgerouter node probes the origins in the background. an origin is considered healthy
+// after *HealthyThreshold* consecutive successful probes, and unhealthy after *UnhealthyThreshold*
+// consecutive failed probes. newly discovered origins are considered unhealthy until the first probe passes.
+type HealthCheck struct {
+	Path               string `json:"path"`                          // ex: "/health"
+	IntervalSeconds    int    `json:"interval_seconds,omitempty"`    // 0 = default (10 seconds)
+	TimeoutSeconds     int    `json:"timeout_seconds,omitempty"`     // 0 = default (2 seconds)
+	HealthyThreshold   int    `json:"healthy_threshold,omitempty"`   // 0 = default (2)
+	UnhealthyThreshold int    `json:"unhealthy_threshold,omitempty"` // 0 = default (3)
+	ExpectedStatus     int    `json:"expected_status,omitempty"`     // 0 = any 2xx or 3xx
+}
+
+func (h *HealthCheck) Validate() error {
+	if err := ErrorIfUnset(h.Path == "", "Path"); err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(h.Path, "/") {
+		return fmt.Errorf("Path must start with '/'; got %s", h.Path)
+	}
+
+	if h.IntervalSeconds < 0 || h.TimeoutSeconds < 0 || h.HealthyThreshold < 0 || h.UnhealthyThreshold < 0 {
+		return errors.New("negative values not allowed")
+	}
+
+	if h.ExpectedStatus != 0 && (h.ExpectedStatus < 100 || h.ExpectedStatus > 599) {
+		return fmt.Errorf("ExpectedStatus: invalid status %d", h.ExpectedStatus)
+	}
+
+	return nil
+}
+
 type TLSConfig struct {
 	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
 	ServerName         string `json:"server_name,omitempty"` // used to verify the hostname on the server cert. also sent via SNI
@@ -448,6 +980,11 @@ type frontendOptions struct {
 	pathPrefix        string
 	stripPathPrefix   bool
 	allowInsecureHTTP bool
+	methods           []string
+	headers           []ValueMatcher
+	queries           []ValueMatcher
+	pathRegexp        string
+	tlsPolicy         *TLSPolicy
 }
 
 func getFrontendOptions(fns []FrontendOpt) frontendOptions {
@@ -473,3 +1010,39 @@ func PathPrefix(pathPrefix string) FrontendOpt {
 }
 
 func StripPathPrefix(opts *frontendOptions) { opts.stripPathPrefix = true }
+
+func Methods(methods ...string) FrontendOpt {
+	return func(opts *frontendOptions) {
+		opts.methods = append(opts.methods, methods...)
+	}
+}
+
+func HeaderEquals(name string, value string) FrontendOpt {
+	return func(opts *frontendOptions) {
+		opts.headers = append(opts.headers, ValueMatcher{Name: name, Value: value})
+	}
+}
+
+func HeaderRegexp(name string, re string) FrontendOpt {
+	return func(opts *frontendOptions) {
+		opts.headers = append(opts.headers, ValueMatcher{Name: name, Regexp: re})
+	}
+}
+
+func QueryEquals(name string, value string) FrontendOpt {
+	return func(opts *frontendOptions) {
+		opts.queries = append(opts.queries, ValueMatcher{Name: name, Value: value})
+	}
+}
+
+func PathRegexp(re string) FrontendOpt {
+	return func(opts *frontendOptions) {
+		opts.pathRegexp = re
+	}
+}
+
+func WithTLSPolicy(policy TLSPolicy) FrontendOpt {
+	return func(opts *frontendOptions) {
+		opts.tlsPolicy = &policy
+	}
+}
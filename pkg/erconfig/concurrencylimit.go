@@ -0,0 +1,29 @@
+package erconfig
+
+import (
+	"fmt"
+)
+
+// load shedding: at most *MaxConcurrent* requests are served at once, *MaxQueued* wait for their
+// turn and the rest get 503 right away. without this, the app's concurrency is not limited.
+type ConcurrencyLimitPolicy struct {
+	MaxConcurrent       int `json:"max_concurrent"`
+	MaxQueued           int `json:"max_queued,omitempty"`            // unset = no queue
+	QueueTimeoutSeconds int `json:"queue_timeout_seconds,omitempty"` // unset = wait as long as the client does
+}
+
+func (c *ConcurrencyLimitPolicy) Validate() error {
+	if c.MaxConcurrent <= 0 {
+		return fmt.Errorf("MaxConcurrent: must be positive; got %d", c.MaxConcurrent)
+	}
+
+	if c.MaxQueued < 0 {
+		return fmt.Errorf("MaxQueued: must not be negative; got %d", c.MaxQueued)
+	}
+
+	if c.QueueTimeoutSeconds < 0 {
+		return fmt.Errorf("QueueTimeoutSeconds: must not be negative; got %d", c.QueueTimeoutSeconds)
+	}
+
+	return nil
+}
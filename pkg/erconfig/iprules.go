@@ -0,0 +1,47 @@
+package erconfig
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// IP-based access control. when there are any rules, a client's IP must match a rule and the rule
+// must allow the app. IPs that match no rule are denied. the first matching rule decides: after
+// priority and deny rules, ip-rules.hcl's rules are tried in file order and then the discovered ones
+// (most specific first), so a discovered /32 doesn't override a broader rule from the file. see
+// pkg/erserver/ipfilter.go for the details.
+type IPRule struct {
+	Prefix  string   `json:"prefix"`            // ex: "192.168.1.0/24". identifies the rule
+	Apps    []string `json:"apps,omitempty"`    // app IDs. empty = all apps
+	Comment string   `json:"comment,omitempty"` // ex: "office VLAN"
+}
+
+func (i *IPRule) Validate() error {
+	prefix, err := netip.ParsePrefix(i.Prefix)
+	if err != nil {
+		return fmt.Errorf("Prefix: %w", err)
+	}
+
+	// so that the same network can't have two rules under different names
+	if prefix.Masked().String() != i.Prefix {
+		return fmt.Errorf("Prefix: not in canonical form; use %s", prefix.Masked().String())
+	}
+
+	return nil
+}
+
+// funky signature to make sure we get at least one app (0 apps by accident would mean all apps)
+func IPRuleAllowOnlyApps(prefix string, comment string, app1 string, appN ...string) IPRule {
+	return IPRule{
+		Prefix:  prefix,
+		Apps:    append([]string{app1}, appN...),
+		Comment: comment,
+	}
+}
+
+func IPRuleAllowAllApps(prefix string, comment string) IPRule {
+	return IPRule{
+		Prefix:  prefix,
+		Comment: comment,
+	}
+}
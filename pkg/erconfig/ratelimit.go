@@ -0,0 +1,65 @@
+package erconfig
+
+import (
+	"fmt"
+)
+
+type RateLimitKey string
+
+const (
+	RateLimitKeyClientIP RateLimitKey = "client_ip"
+	RateLimitKeyHeader   RateLimitKey = "header" // e.g. API key
+	RateLimitKeyUser     RateLimitKey = "user"   // as authenticated by the app's auth backend
+)
+
+// per-app token bucket: each client (as identified by *Key*) can make *Burst* requests at once, and
+// the bucket refills at *RequestsPerSecond*. without this, the app is not rate limited.
+type RateLimitPolicy struct {
+	RequestsPerSecond float64      `json:"requests_per_second"`
+	Burst             int          `json:"burst,omitempty"`  // unset = one second's worth of requests
+	Key               RateLimitKey `json:"key,omitempty"`    // unset = client_ip
+	Header            string       `json:"header,omitempty"` // for key=header. requests without the header are keyed by client IP
+	ClusterWide       bool         `json:"cluster_wide,omitempty"`
+}
+
+func (r *RateLimitPolicy) Validate() error {
+	if r.RequestsPerSecond <= 0 {
+		return fmt.Errorf("RequestsPerSecond: must be positive; got %v", r.RequestsPerSecond)
+	}
+
+	if r.Burst < 0 {
+		return fmt.Errorf("Burst: must not be negative; got %d", r.Burst)
+	}
+
+	switch r.Key {
+	case "", RateLimitKeyClientIP, RateLimitKeyUser:
+		if r.Header != "" {
+			return fmt.Errorf("Header: only for key=%s", RateLimitKeyHeader)
+		}
+	case RateLimitKeyHeader:
+		if err := ErrorIfUnset(r.Header == "", "Header"); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Key: unsupported: %s", r.Key)
+	}
+
+	return nil
+}
+
+// burst with the default applied
+func (r *RateLimitPolicy) BurstOrDefault() int {
+	if r.Burst == 0 {
+		return max(1, int(r.RequestsPerSecond))
+	}
+
+	return r.Burst
+}
+
+func (r *RateLimitPolicy) KeyOrDefault() RateLimitKey {
+	if r.Key == "" {
+		return RateLimitKeyClientIP
+	}
+
+	return r.Key
+}
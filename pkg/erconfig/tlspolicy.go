@@ -0,0 +1,143 @@
+package erconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// TLS settings for a hostname. TLS is negotiated before we see the request's path, so all
+// frontends of a hostname that specify a policy must specify the same one (frontends without a
+// policy get the hostname's policy).
+type TLSPolicy struct {
+	MinVersion        string             `json:"min_version,omitempty"`   // "1.0" | "1.1" | "1.2" | "1.3". default Go's default
+	CipherSuites      []string           `json:"cipher_suites,omitempty"` // Go's names, e.g. "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". only affects TLS <= 1.2
+	HSTS              *HSTSPolicy        `json:"hsts,omitempty"`
+	ClientCertificate *ClientCertificate `json:"client_certificate,omitempty"`
+}
+
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Strict-Transport-Security
+type HSTSPolicy struct {
+	MaxAgeSeconds     int  `json:"max_age_seconds"`
+	IncludeSubdomains bool `json:"include_subdomains,omitempty"`
+	Preload           bool `json:"preload,omitempty"`
+}
+
+// clients are asked for a certificate signed by one of the CAs
+type ClientCertificate struct {
+	CACertificates string `json:"ca_certificates"`    // PEM
+	Optional       bool   `json:"optional,omitempty"` // if given it's verified, but not having one is ok
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (t *TLSPolicy) Validate() error {
+	if _, err := t.MinVersionID(); err != nil {
+		return err
+	}
+
+	if _, err := t.CipherSuiteIDs(); err != nil {
+		return err
+	}
+
+	if t.HSTS != nil {
+		if err := t.HSTS.Validate(); err != nil {
+			return fmt.Errorf("HSTS: %w", err)
+		}
+	}
+
+	if t.ClientCertificate != nil {
+		if _, err := t.ClientCertificate.CertPool(); err != nil {
+			return fmt.Errorf("ClientCertificate: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// 0 = Go's default
+func (t *TLSPolicy) MinVersionID() (uint16, error) {
+	if t.MinVersion == "" {
+		return 0, nil
+	}
+
+	version, found := tlsVersions[t.MinVersion]
+	if !found {
+		return 0, fmt.Errorf("MinVersion: unsupported: %s", t.MinVersion)
+	}
+
+	return version, nil
+}
+
+// nil = Go's default
+func (t *TLSPolicy) CipherSuiteIDs() ([]uint16, error) {
+	if len(t.CipherSuites) == 0 {
+		return nil, nil
+	}
+
+	// only the secure ones (tls.InsecureCipherSuites() are not accepted)
+	byName := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+
+	ids := []uint16{}
+	for _, name := range t.CipherSuites {
+		id, found := byName[name]
+		if !found {
+			return nil, fmt.Errorf("CipherSuites: unsupported or insecure: %s", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func (h *HSTSPolicy) Validate() error {
+	if h.MaxAgeSeconds <= 0 {
+		return errors.New("MaxAgeSeconds must be positive")
+	}
+
+	// https://hstspreload.org/#submission-requirements
+	if h.Preload && (!h.IncludeSubdomains || h.MaxAgeSeconds < 31536000) {
+		return errors.New("Preload requires IncludeSubdomains and MaxAgeSeconds of at least one year")
+	}
+
+	return nil
+}
+
+// value for Strict-Transport-Security header
+func (h *HSTSPolicy) HeaderValue() string {
+	value := "max-age=" + strconv.Itoa(h.MaxAgeSeconds)
+
+	if h.IncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+
+	if h.Preload {
+		value += "; preload"
+	}
+
+	return value
+}
+
+func (c *ClientCertificate) CertPool() (*x509.CertPool, error) {
+	if err := ErrorIfUnset(c.CACertificates == "", "CACertificates"); err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(c.CACertificates)) {
+		return nil, errors.New("CACertificates: no certificates found")
+	}
+
+	return pool, nil
+}
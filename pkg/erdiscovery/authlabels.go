@@ -0,0 +1,41 @@
+package erdiscovery
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+)
+
+// wraps backend in auth backend as specified by "edgerouter.auth*" labels (Docker) or annotations
+// (Kubernetes). serviceName is used to derive the SSO audience.
+func AuthFromLabels(labels map[string]string, serviceName string, backend erconfig.Backend) (erconfig.Backend, error) {
+	switch labels["edgerouter.auth"] {
+	case "public":
+		// we require explicit opt-in to this for security, so missing keys don't accidentally expose sensitive endpoints
+		return backend, nil // no wrapping
+	case "bearer_token":
+		bearerToken := labels["edgerouter.auth_bearer_token"]
+		if bearerToken == "" {
+			return erconfig.Backend{}, errors.New("empty bearer token not supported")
+		}
+
+		return erconfig.AuthV0Backend(bearerToken, backend), nil
+	case "sso":
+		tenant := labels["edgerouter.auth_sso.tenant"]
+		if tenant == "" {
+			return erconfig.Backend{}, errors.New("edgerouter.auth_sso.tenant empty")
+		}
+
+		// looks like t-2/monitoring_prometheus
+		audience := fmt.Sprintf("%s/%s", tenant, serviceName)
+
+		// is not a security issue if empty (nobody gets through then)
+		users := strings.Split(labels["edgerouter.auth_sso.users"], ",")
+
+		return erconfig.AuthSsoBackend("", users, audience, backend), nil
+	default:
+		return erconfig.Backend{}, fmt.Errorf("unsupported auth mode: %s", labels["edgerouter.auth"])
+	}
+}
@@ -0,0 +1,246 @@
+// Discovers applications from a Consul(-compatible) service catalog
+package consuldiscovery
+
+// Services are opted in the same way as Docker services: with Traefik-style labels. Consul
+// doesn't have labels, so we read them from tags ("traefik.frontend.rule=Host:example.com", like
+// Traefik's Consul catalog provider does) and from service meta (which wins over tags).
+//
+// Changes are noticed with blocking queries: https://developer.hashicorp.com/consul/api-docs/features/blocking
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/erdiscovery"
+	"github.com/function61/edgerouter/pkg/erdiscovery/dockerdiscovery"
+	"github.com/function61/gokit/backoff"
+	"github.com/function61/gokit/ezhttp"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// Consul caps this at 10 minutes and adds jitter of wait/16
+	blockingQueryWait = 5 * time.Minute
+)
+
+func HasConfigInEnv() bool {
+	return os.Getenv("CONSUL_DISCOVERY") != ""
+}
+
+// configured with ENV:
+//   - CONSUL_DISCOVERY: Consul HTTP API address, like "http://127.0.0.1:8500"
+//   - CONSUL_HTTP_TOKEN: (optional) ACL token
+func New(logger *slog.Logger) (erdiscovery.Reader, error) {
+	return &consulDiscovery{
+		consulURL: strings.TrimRight(os.Getenv("CONSUL_DISCOVERY"), "/"),
+		token:     os.Getenv("CONSUL_HTTP_TOKEN"),
+		client:    &http.Client{Timeout: blockingQueryWait + time.Minute},
+		logger:    logger.With("subsystem", "consuldiscovery"),
+	}, nil
+}
+
+type consulDiscovery struct {
+	consulURL string
+	token     string
+	client    *http.Client
+	logger    *slog.Logger
+}
+
+var _ erdiscovery.Watcher = (*consulDiscovery)(nil)
+
+// https://developer.hashicorp.com/consul/api-docs/health#list-service-instances-for-service
+type serviceEntry struct {
+	Node struct {
+		Node    string `json:"Node"`
+		ID      string `json:"ID"`
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Tags    []string          `json:"Tags"`
+		Meta    map[string]string `json:"Meta"`
+		Address string            `json:"Address"` // "" = same as node's address
+		Port    int               `json:"Port"`
+	} `json:"Service"`
+}
+
+func (c *consulDiscovery) ReadApplications(ctx context.Context) ([]erconfig.Application, error) {
+	// service name => tags
+	catalog := map[string][]string{}
+	if _, err := c.get(ctx, "/v1/catalog/services", &catalog); err != nil {
+		return nil, err
+	}
+
+	serviceNames := []string{}
+	for name := range catalog {
+		serviceNames = append(serviceNames, name)
+	}
+	sort.Strings(serviceNames)
+
+	apps := []erconfig.Application{}
+
+	for _, name := range serviceNames {
+		// only healthy instances
+		entries := []serviceEntry{}
+		if _, err := c.get(ctx, "/v1/health/service/"+url.PathEscape(name)+"?passing=true", &entries); err != nil {
+			return nil, err
+		}
+
+		service := entriesToService(name, entries)
+		if len(service.Instances) == 0 {
+			continue
+		}
+
+		serviceApps, err := dockerdiscovery.TraefikAnnotationsToApps(service)
+		if err != nil {
+			c.logger.Error("TraefikAnnotationsToApps",
+				"service", service.Name,
+				"error", err)
+			continue
+		}
+
+		apps = append(apps, serviceApps...)
+	}
+
+	return apps, nil
+}
+
+// notifies when the catalog (services registered/deregistered) or health of any instance changes
+func (c *consulDiscovery) WatchChanges(ctx context.Context, changed chan<- struct{}) error {
+	watchers, ctx := errgroup.WithContext(ctx)
+
+	for _, endpoint := range []string{"/v1/catalog/services", "/v1/health/state/any"} {
+		watchers.Go(func() error {
+			c.watch(ctx, endpoint, changed)
+			return nil
+		})
+	}
+
+	return watchers.Wait()
+}
+
+// returns only when ctx is canceled
+func (c *consulDiscovery) watch(ctx context.Context, endpoint string, changed chan<- struct{}) {
+	index := uint64(0) // 0 = return immediately (to learn the current index)
+
+	errorBackoff := backoff.ExponentialWithCappedMax(100*time.Millisecond, 30*time.Second)
+
+	for {
+		var discard any
+		newIndex, err := c.get(ctx, fmt.Sprintf("%s?index=%d&wait=%s", endpoint, index, blockingQueryWait), &discard)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			c.logger.Warn("blocking query failed", "endpoint", endpoint, "error", err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(errorBackoff()):
+				continue
+			}
+		}
+
+		errorBackoff = backoff.ExponentialWithCappedMax(100*time.Millisecond, 30*time.Second)
+
+		// first query (index=0) also notifies, because we don't know what happened between the
+		// last read and us learning the index
+		if newIndex != index {
+			erdiscovery.NotifyChanged(changed)
+		}
+
+		// https://developer.hashicorp.com/consul/api-docs/features/blocking#implementation-details
+		if newIndex < index { // index went backwards (e.g. Consul state restore) => reset
+			newIndex = 0
+		}
+
+		index = newIndex
+	}
+}
+
+// returns the X-Consul-Index of the response
+func (c *consulDiscovery) get(ctx context.Context, path string, result any) (uint64, error) {
+	opts := []ezhttp.ConfigPiece{
+		ezhttp.Client(c.client),
+		ezhttp.RespondsJson(result, true),
+	}
+
+	if c.token != "" {
+		opts = append(opts, ezhttp.Header("X-Consul-Token", c.token))
+	}
+
+	res, err := ezhttp.Get(ctx, c.consulURL+path, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	index, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("X-Consul-Index: %w", err)
+	}
+
+	return index, nil
+}
+
+func entriesToService(name string, entries []serviceEntry) dockerdiscovery.Service {
+	service := dockerdiscovery.Service{
+		Name:   name,
+		Labels: map[string]string{},
+	}
+
+	for _, entry := range entries {
+		// instances of the same service should be configured the same, so this works out even
+		// though we're merging labels of all instances
+		for key, value := range tagsToLabels(entry.Service.Tags) {
+			service.Labels[key] = value
+		}
+
+		for key, value := range entry.Service.Meta {
+			service.Labels[key] = value
+		}
+
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+
+		service.Instances = append(service.Instances, dockerdiscovery.ServiceInstance{
+			DockerTaskID: entry.Service.ID,
+			NodeID:       entry.Node.ID,
+			NodeHostname: entry.Node.Node,
+			IPv4:         address,
+			Port:         entry.Service.Port,
+		})
+	}
+
+	return service
+}
+
+// "traefik.frontend.rule=Host:example.com" => {"traefik.frontend.rule": "Host:example.com"}.
+// tags that don't look like key=value are ignored.
+func tagsToLabels(tags []string) map[string]string {
+	labels := map[string]string{}
+
+	for _, tag := range tags {
+		key, value, found := strings.Cut(tag, "=")
+		if !found {
+			continue
+		}
+
+		labels[key] = value
+	}
+
+	return labels
+}
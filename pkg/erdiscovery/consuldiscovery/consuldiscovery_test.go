@@ -0,0 +1,146 @@
+package consuldiscovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+)
+
+func TestReadApplications(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "42")
+
+		switch r.URL.String() {
+		case "/v1/catalog/services":
+			_, _ = io.WriteString(w, `{"consul": [], "web": ["traefik.frontend.rule=Host:example.com", "edgerouter.auth=public", "v2"]}`)
+		case "/v1/health/service/consul?passing=true":
+			_, _ = io.WriteString(w, `[{"Node": {"Node": "vm1", "Address": "10.0.0.1"}, "Service": {"ID": "consul", "Service": "consul", "Port": 8300}}]`)
+		case "/v1/health/service/web?passing=true":
+			_, _ = io.WriteString(w, `[
+  {"Node": {"Node": "vm1", "ID": "n1", "Address": "10.0.0.1"}, "Service": {"ID": "web-1", "Service": "web", "Tags": ["traefik.frontend.rule=Host:example.com", "edgerouter.auth=public", "v2"], "Port": 8080}},
+  {"Node": {"Node": "vm2", "ID": "n2", "Address": "10.0.0.2"}, "Service": {"ID": "web-2", "Service": "web", "Tags": ["traefik.frontend.rule=Host:example.com", "edgerouter.auth=public", "v2"], "Address": "192.168.1.2", "Port": 8081}}
+]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer consul.Close()
+
+	apps, err := testDiscovery(consul.URL).ReadApplications(context.Background())
+	assert.Ok(t, err)
+
+	assert.EqualJson(t, apps, `[
+  {
+    "id": "web",
+    "frontends": [
+      {
+        "kind": "hostname",
+        "hostname": "example.com",
+        "path_prefix": "/"
+      }
+    ],
+    "backend": {
+      "kind": "reverse_proxy",
+      "reverse_proxy_opts": {
+        "origins": [
+          "http://10.0.0.1:8080",
+          "http://192.168.1.2:8081"
+        ],
+        "pass_host_header": true
+      }
+    }
+  }
+]`)
+}
+
+func TestWatchChanges(t *testing.T) {
+	catalogIndex := atomic.Uint64{}
+	catalogIndex.Store(10)
+	catalogChanged := make(chan struct{})
+
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			// simulate blocking query: block until index moves past the asked one
+			if r.URL.Query().Get("index") == fmt.Sprintf("%d", catalogIndex.Load()) {
+				select {
+				case <-catalogChanged:
+				case <-r.Context().Done():
+					return
+				}
+			}
+
+			w.Header().Set("X-Consul-Index", fmt.Sprintf("%d", catalogIndex.Load()))
+			_, _ = io.WriteString(w, `{}`)
+		case "/v1/health/state/any":
+			// never changes
+			if r.URL.Query().Get("index") == "5" {
+				<-r.Context().Done()
+				return
+			}
+
+			w.Header().Set("X-Consul-Index", "5")
+			_, _ = io.WriteString(w, `[]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer consul.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- testDiscovery(consul.URL).WatchChanges(ctx, changed)
+	}()
+
+	expectChanged := func() {
+		t.Helper()
+
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected change notification")
+		}
+	}
+
+	// learning the initial indexes (one from each endpoint, might've coalesced)
+	expectChanged()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-changed:
+	default:
+	}
+
+	select {
+	case <-changed:
+		t.Fatal("unexpected change notification")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	catalogIndex.Store(11)
+	catalogChanged <- struct{}{}
+	expectChanged()
+
+	cancel()
+	assert.Ok(t, <-watchDone)
+}
+
+func testDiscovery(consulURL string) *consulDiscovery {
+	return &consulDiscovery{
+		consulURL: consulURL,
+		client:    http.DefaultClient,
+		logger:    slogshim.NewWithOutput(io.Discard),
+	}
+}
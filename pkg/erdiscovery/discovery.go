@@ -11,12 +11,37 @@ type Reader interface {
 	ReadApplications(context.Context) ([]erconfig.Application, error)
 }
 
+// optional interface for a Reader that knows when its applications (might have) changed, so the
+// changes can be picked up right away instead of waiting for the next poll
+type Watcher interface {
+	// blocks until ctx is canceled. signals changes with NotifyChanged()
+	WatchChanges(ctx context.Context, changed chan<- struct{}) error
+}
+
 type Writer interface {
 	UpdateApplication(context.Context, erconfig.Application) error
 	DeleteApplication(context.Context, erconfig.Application) error
 }
 
+// optional interface for a Reader that also stores IP rules (erconfig.IPRule)
+type IPRulesReader interface {
+	ReadIPRules(context.Context) ([]erconfig.IPRule, error)
+}
+
+type IPRulesWriter interface {
+	AddIPRule(context.Context, erconfig.IPRule) error // replaces existing rule of the same prefix
+	RemoveIPRule(ctx context.Context, prefix string) error
+}
+
 type ReaderWriter interface {
 	Reader
 	Writer
 }
+
+// non-blocking, so if the consumer is busy (it'll re-read everything anyway), changes coalesce
+func NotifyChanged(changed chan<- struct{}) {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
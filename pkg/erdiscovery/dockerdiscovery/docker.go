@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/function61/edgerouter/pkg/erconfig"
 	"github.com/function61/edgerouter/pkg/erdiscovery"
@@ -27,7 +28,8 @@ type ServiceInstance struct {
 	DockerTaskID string
 	NodeID       string
 	NodeHostname string
-	IPv4         string
+	IPv4         string // can also be a hostname or an IPv6 address for non-Docker sources
+	Port         int    // 0 = not known (use traefik.port label or scheme's default port)
 }
 
 func HasConfigInEnv() bool {
@@ -66,6 +68,7 @@ func New(logger *slog.Logger) (erdiscovery.Reader, error) {
 		dockerNetworkName: dockerNetworkName,
 		dockerURL:         dockerURL,
 		dockerClient:      dockerClient,
+		dying:             newDyingInstances(),
 		logger:            logger,
 	}, nil
 }
@@ -74,6 +77,7 @@ type dockerDiscovery struct {
 	dockerNetworkName string
 	dockerURL         string
 	dockerClient      *http.Client
+	dying             *dyingInstances // learned from Docker events
 	logger            *slog.Logger
 }
 
@@ -92,21 +96,20 @@ func (s *dockerDiscovery) ReadApplications(ctx context.Context) ([]erconfig.Appl
 	swarmServicesAndBareContainers = append(swarmServicesAndBareContainers, swarmServices...)
 	swarmServicesAndBareContainers = append(swarmServicesAndBareContainers, bareContainers...)
 
+	swarmServicesAndBareContainers = s.dying.withoutDying(swarmServicesAndBareContainers, time.Now())
+
 	apps := []erconfig.Application{}
 
 	for _, service := range swarmServicesAndBareContainers {
-		app, err := traefikAnnotationsToApp(service)
+		serviceApps, err := TraefikAnnotationsToApps(service)
 		if err != nil {
-			s.logger.Error("traefikAnnotationsToApp",
+			s.logger.Error("TraefikAnnotationsToApps",
 				"service", service.Name,
 				"error", err)
 			continue
 		}
-		if app == nil { // non-error skip
-			continue
-		}
 
-		apps = append(apps, *app)
+		apps = append(apps, serviceApps...)
 	}
 
 	return apps, nil
@@ -0,0 +1,219 @@
+package dockerdiscovery
+
+// Subscribes to Docker's event stream so container/service changes are noticed right away instead of
+// on the next poll. Polling is still kept as a safety net.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erdiscovery"
+	"github.com/function61/gokit/backoff"
+)
+
+const (
+	// if we never see the container start again or get destroyed, don't hold on to it forever
+	dyingInstanceMaxAge = 5 * time.Minute
+)
+
+// https://docs.docker.com/engine/api/v1.30/#tag/System/operation/SystemEvents
+type dockerEvent struct {
+	Type   string `json:"Type"` // "container" | "service" | "network" | ...
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// service events were introduced in API v1.30
+var eventsEndpoint = "/v1.30/events?filters=" + url.QueryEscape(`{"type":["container","service","network"]}`)
+
+var _ erdiscovery.Watcher = (*dockerDiscovery)(nil)
+
+func (s *dockerDiscovery) WatchChanges(ctx context.Context, changed chan<- struct{}) error {
+	reconnectBackoff := backoff.ExponentialWithCappedMax(100*time.Millisecond, 30*time.Second)
+
+	for {
+		err := s.followEvents(ctx, changed, func() { // successfully connected
+			reconnectBackoff = backoff.ExponentialWithCappedMax(100*time.Millisecond, 30*time.Second)
+		})
+
+		if ctx.Err() != nil { // asked to stop
+			return nil
+		}
+
+		s.logger.Warn("docker events stream interrupted; reconnecting", "error", err)
+
+		// we might've missed events while disconnected
+		erdiscovery.NotifyChanged(changed)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reconnectBackoff()):
+		}
+	}
+}
+
+// returns only on error or when ctx is canceled
+func (s *dockerDiscovery) followEvents(ctx context.Context, changed chan<- struct{}, connected func()) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.dockerURL+eventsEndpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.dockerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", res.Status)
+	}
+
+	connected()
+
+	// the stream is a sequence of JSON objects
+	events := json.NewDecoder(res.Body)
+
+	for {
+		event := dockerEvent{}
+		if err := events.Decode(&event); err != nil {
+			return err
+		}
+
+		if s.processEvent(event) {
+			s.logger.Debug("docker event triggers sync", "type", event.Type, "action", event.Action, "actor", event.Actor.ID)
+
+			erdiscovery.NotifyChanged(changed)
+		}
+	}
+}
+
+// returns true if the event (might) affect discovered applications
+func (s *dockerDiscovery) processEvent(event dockerEvent) bool {
+	switch event.Type {
+	case "container":
+		// for Swarm tasks the task ID is what ends up in ServiceInstance (instead of the container ID)
+		instanceIDs := []string{event.Actor.ID}
+		if taskID := event.Actor.Attributes["com.docker.swarm.task.id"]; taskID != "" {
+			instanceIDs = append(instanceIDs, taskID)
+		}
+
+		switch event.Action {
+		case "kill":
+			// "kill" is also how signals like SIGHUP ("reload your config") are delivered. only the
+			// ones that stop the container mean it's dying.
+			switch event.Actor.Attributes["signal"] {
+			case "15", "9": // SIGTERM, SIGKILL
+				s.dying.mark(instanceIDs, time.Now())
+				return true
+			default:
+				return false
+			}
+		case "stop", "die":
+			// container is shutting down but it might still show as running for a while (graceful
+			// shutdown). pull it from rotation before clients hit it.
+			s.dying.mark(instanceIDs, time.Now())
+			return true
+		case "start":
+			s.dying.unmark(instanceIDs)
+			return true
+		case "destroy":
+			s.dying.unmark(instanceIDs) // won't be seen anymore anyway
+			return true
+		default: // "exec_start" etc. (these happen a lot if containers have health checks), or "pause"
+			// which is temporary by definition
+			return false
+		}
+	case "service":
+		switch event.Action {
+		case "create", "update", "remove":
+			return true
+		default:
+			return false
+		}
+	case "network":
+		switch event.Action {
+		case "connect", "disconnect": // container's IP on our network might've changed
+			return true
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+}
+
+// instances (containers/Swarm tasks) that we've seen stopping, but whose removal might not yet be
+// reflected in the containers/tasks listings
+type dyingInstances struct {
+	since map[string]time.Time
+	mu    sync.Mutex
+}
+
+func newDyingInstances() *dyingInstances {
+	return &dyingInstances{
+		since: map[string]time.Time{},
+	}
+}
+
+func (d *dyingInstances) mark(ids []string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, id := range ids {
+		d.since[id] = now
+	}
+}
+
+func (d *dyingInstances) unmark(ids []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, id := range ids {
+		delete(d.since, id)
+	}
+}
+
+func (d *dyingInstances) withoutDying(services []Service, now time.Time) []Service {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for id, since := range d.since { // expire
+		if now.Sub(since) > dyingInstanceMaxAge {
+			delete(d.since, id)
+		}
+	}
+
+	if len(d.since) == 0 { // fast path
+		return services
+	}
+
+	filtered := []Service{}
+
+	for _, service := range services {
+		instances := []ServiceInstance{}
+		for _, instance := range service.Instances {
+			if _, dying := d.since[instance.DockerTaskID]; !dying {
+				instances = append(instances, instance)
+			}
+		}
+
+		if len(instances) == 0 {
+			continue
+		}
+
+		service.Instances = instances
+		filtered = append(filtered, service)
+	}
+
+	return filtered
+}
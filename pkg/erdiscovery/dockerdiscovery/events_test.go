@@ -0,0 +1,122 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+)
+
+func TestWatchChanges(t *testing.T) {
+	sendEvent := make(chan string)
+
+	dockerAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1.30/events" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-sendEvent:
+				_, _ = io.WriteString(w, event+"\n")
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer dockerAPI.Close()
+
+	discovery := &dockerDiscovery{
+		dockerURL:    dockerAPI.URL,
+		dockerClient: dockerAPI.Client(),
+		dying:        newDyingInstances(),
+		logger:       slogshim.NewWithOutput(io.Discard),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- discovery.WatchChanges(ctx, changed)
+	}()
+
+	expectChanged := func() {
+		t.Helper()
+
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected change notification")
+		}
+	}
+
+	twoReplicas := []Service{
+		{
+			Name: "web",
+			Instances: []ServiceInstance{
+				{DockerTaskID: "task1", IPv4: "10.0.0.1"},
+				{DockerTaskID: "task2", IPv4: "10.0.0.2"},
+			},
+		},
+	}
+
+	// noise that should not trigger sync
+	sendEvent <- `{"Type":"container","Action":"exec_start: /healthcheck","Actor":{"ID":"c1"}}`
+	sendEvent <- `{"Type":"container","Action":"kill","Actor":{"ID":"c1","Attributes":{"signal":"1"}}}` // SIGHUP
+	sendEvent <- `{"Type":"container","Action":"pause","Actor":{"ID":"c1"}}`
+
+	// a replica starts shutting down
+	sendEvent <- `{"Type":"container","Action":"kill","Actor":{"ID":"c2","Attributes":{"com.docker.swarm.task.id":"task2","signal":"15"}}}`
+	expectChanged()
+
+	_, c1Dying := discovery.dying.since["c1"]
+	assert.Assert(t, !c1Dying)
+
+	assert.EqualJson(t, discovery.dying.withoutDying(twoReplicas, time.Now())[0].Instances, `[
+  {
+    "DockerTaskID": "task1",
+    "NodeID": "",
+    "NodeHostname": "",
+    "IPv4": "10.0.0.1",
+    "Port": 0
+  }
+]`)
+
+	// .. and comes back
+	sendEvent <- `{"Type":"container","Action":"start","Actor":{"ID":"c2","Attributes":{"com.docker.swarm.task.id":"task2"}}}`
+	expectChanged()
+
+	assert.EqualInt(t, len(discovery.dying.withoutDying(twoReplicas, time.Now())[0].Instances), 2)
+
+	sendEvent <- `{"Type":"service","Action":"update","Actor":{"ID":"s1"}}`
+	expectChanged()
+
+	cancel()
+	assert.Ok(t, <-watchDone)
+}
+
+func TestDyingInstancesExpire(t *testing.T) {
+	dying := newDyingInstances()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	dying.mark([]string{"task1"}, now)
+
+	service := []Service{{Name: "web", Instances: []ServiceInstance{{DockerTaskID: "task1"}}}}
+
+	assert.EqualInt(t, len(dying.withoutDying(service, now.Add(time.Minute))), 0)
+	assert.EqualInt(t, len(dying.withoutDying(service, now.Add(6*time.Minute))), 1)
+}
@@ -3,30 +3,60 @@ package dockerdiscovery
 import (
 	"errors"
 	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/erdiscovery"
 )
 
 // find annotations from here:
 //
 //	https://docs.traefik.io/v1.7/configuration/backends/docker/
-func traefikAnnotationsToApp(service Service) (*erconfig.Application, error) {
-	// we used to have explicit check for label traefik.enable=true, but that was strictly
-	// for Traefik itself so it doesn't expose everything by default (= security concern).
-	// now that we've moved to Edgerouter, presence of this is enough for opt-in
-	frontendRule := service.Labels["traefik.frontend.rule"]
-	if frontendRule == "" {
-		return nil, nil
+//	https://doc.traefik.io/traefik/v2.11/routing/providers/docker/ (routers and services)
+//
+// one service can produce multiple apps (v1 segments, v2 services), e.g. for a container that
+// has an UI and an API in different ports.
+//
+// exported for other discovery sources (like service catalogs) that carry Traefik-style labels
+func TraefikAnnotationsToApps(service Service) ([]erconfig.Application, error) {
+	routings, err := traefikLabelsToRoutings(service.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	apps := []erconfig.Application{}
+
+	for _, routing := range routings {
+		app, err := traefikRoutingToApp(service, routing)
+		if err != nil {
+			if routing.name != "" {
+				return nil, fmt.Errorf("%s: %w", routing.name, err)
+			}
+
+			return nil, err
+		}
+		if app == nil { // non-error skip
+			continue
+		}
+
+		apps = append(apps, *app)
 	}
 
+	return apps, nil
+}
+
+func traefikRoutingToApp(service Service, routing traefikRouting) (*erconfig.Application, error) {
 	scheme := "http"
-	if proto, specified := service.Labels["traefik.protocol"]; specified {
-		if proto != "http" && proto != "https" {
-			return nil, fmt.Errorf("unsupported protocol: %s", proto)
+	if routing.scheme != "" {
+		if routing.scheme != "http" && routing.scheme != "https" {
+			return nil, fmt.Errorf("unsupported protocol: %s", routing.scheme)
 		}
 
-		scheme = proto
+		scheme = routing.scheme
 	}
 
 	insecureSkipVerify, err := func() (bool, error) {
@@ -53,44 +83,18 @@ func traefikAnnotationsToApp(service Service) (*erconfig.Application, error) {
 	// also doesn't exist in Traefik
 	tlsServerName := service.Labels["traefik.backend.tls.serverName"]
 
-	port := service.Labels["traefik.port"]
-	if port == "" {
-		switch scheme {
-		case "http":
-			port = "80"
-		case "https":
-			port = "443"
-		}
-	}
-
-	frontend, err := func() (erconfig.Frontend, error) {
-		parsed, err := parseTraefikFrontendRule(frontendRule)
-		if err != nil {
-			return erconfig.Frontend{}, err
-		}
-
-		opts := []erconfig.FrontendOpt{}
-		if parsed.PathPrefix != "" {
-			opts = append(opts, erconfig.PathPrefix(parsed.PathPrefix))
-		}
-
-		switch {
-		case parsed.Host != "":
-			return erconfig.SimpleHostnameFrontend(parsed.Host, opts...), nil
-		case parsed.HostRegexp != "":
-			return erconfig.RegexpHostnameFrontend(parsed.HostRegexp, opts...), nil
-		default:
-			return erconfig.Frontend{}, fmt.Errorf("unsupported frontend rule: %s", frontendRule)
-		}
-	}()
-	if err != nil {
-		return nil, err
+	defaultPort := "80"
+	if scheme == "https" {
+		defaultPort = "443"
 	}
 
 	addrs := []string{}
 
 	for _, instance := range service.Instances {
-		addrs = append(addrs, scheme+"://"+instance.IPv4+":"+port)
+		// explicit label wins over what the source knows about the instance
+		port := coalesce(routing.port, portOrEmpty(instance.Port), defaultPort)
+
+		addrs = append(addrs, scheme+"://"+net.JoinHostPort(instance.IPv4, port))
 	}
 
 	if len(addrs) == 0 {
@@ -108,45 +112,211 @@ func traefikAnnotationsToApp(service Service) (*erconfig.Application, error) {
 		true)
 
 	// maybe wrap in auth backend
-	backendAuthorized, err := func() (erconfig.Backend, error) {
-		switch service.Labels["edgerouter.auth"] {
-		case "public":
-			// we require explicit opt-in to this for security, so missing keys don't accidentally expose sensitive endpoints
-			return backend, nil // no wrapping
-		case "bearer_token":
-			bearerToken := service.Labels["edgerouter.auth_bearer_token"]
-			if bearerToken == "" {
-				return erconfig.Backend{}, errors.New("empty bearer token not supported")
-			}
+	backendAuthorized, err := erdiscovery.AuthFromLabels(service.Labels, service.Name, backend)
+	if err != nil {
+		return nil, err
+	}
 
-			return erconfig.AuthV0Backend(bearerToken, backend), nil
-		case "sso":
-			tenant := service.Labels["edgerouter.auth_sso.tenant"]
-			if tenant == "" {
-				return erconfig.Backend{}, errors.New("edgerouter.auth_sso.tenant empty")
-			}
+	concurrencyLimit, err := erdiscovery.ConcurrencyLimitFromLabels(service.Labels)
+	if err != nil {
+		return nil, err
+	}
 
-			// looks like t-2/monitoring_prometheus
-			audience := fmt.Sprintf("%s/%s", tenant, service.Name)
+	// ACLs can reference the ID, so it's derived only from things the user controls
+	id := service.Name
+	if routing.name != "" {
+		id = service.Name + "_" + routing.name
+	}
 
-			// is not a security issue if empty (nobody gets through then)
-			users := strings.Split(service.Labels["edgerouter.auth_sso.users"], ",")
+	return &erconfig.Application{
+		ID:               id,
+		Frontends:        routing.frontends,
+		Backend:          backendAuthorized,
+		ConcurrencyLimit: concurrencyLimit,
+	}, nil
+}
 
-			return erconfig.AuthSsoBackend("", users, audience, backend), nil
-		default:
-			return erconfig.Backend{}, fmt.Errorf("unsupported auth mode: %s", service.Labels["edgerouter.auth"])
-		}
-	}()
+// what the Traefik labels say about routing to a (port of a) service
+type traefikRouting struct {
+	name      string // segment (v1) or service (v2) name. "" for v1 default routing or v2 routers without a service
+	frontends []erconfig.Frontend
+	scheme    string // "" = not specified
+	port      string // "" = not specified
+}
+
+// returns empty if service has no routing labels
+func traefikLabelsToRoutings(labels map[string]string) ([]traefikRouting, error) {
+	// we used to have explicit check for label traefik.enable=true, but that was strictly
+	// for Traefik itself so it doesn't expose everything by default (= security concern).
+	// now that we've moved to Edgerouter, presence of a rule is enough for opt-in
+	v1, err := traefikV1LabelsToRoutings(labels)
 	if err != nil {
 		return nil, err
 	}
 
-	app := erconfig.SimpleApplication(
-		service.Name,
-		frontend,
-		backendAuthorized)
+	if len(v1) > 0 {
+		return v1, nil
+	}
+
+	return traefikV2LabelsToRoutings(labels)
+}
+
+// https://doc.traefik.io/traefik/v1.7/configuration/backends/docker/#on-containers-with-multiple-ports-segment-labels
+//
+// "traefik.frontend.rule" + "traefik.port" is the default routing. segments are declared with
+// "traefik.<segment>.frontend.rule" + "traefik.<segment>.port".
+func traefikV1LabelsToRoutings(labels map[string]string) ([]traefikRouting, error) {
+	routings := []traefikRouting{}
+
+	if frontendRule := labels["traefik.frontend.rule"]; frontendRule != "" {
+		frontend, err := traefikV1RuleToFrontend(frontendRule)
+		if err != nil {
+			return nil, err
+		}
+
+		routings = append(routings, traefikRouting{
+			frontends: []erconfig.Frontend{frontend},
+			scheme:    labels["traefik.protocol"],
+			port:      labels["traefik.port"],
+		})
+	}
+
+	for _, segment := range traefikV1Segments(labels) {
+		frontend, err := traefikV1RuleToFrontend(labels["traefik."+segment+".frontend.rule"])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", segment, err)
+		}
+
+		routings = append(routings, traefikRouting{
+			name:      segment,
+			frontends: []erconfig.Frontend{frontend},
+			scheme:    coalesce(labels["traefik."+segment+".protocol"], labels["traefik.protocol"]),
+			port:      labels["traefik."+segment+".port"], // not inheriting, as segments are about differing ports
+		})
+	}
+
+	return routings, nil
+}
+
+// "traefik.api.frontend.rule" => "api" (sorted for determinism)
+func traefikV1Segments(labels map[string]string) []string {
+	segments := []string{}
+
+	for key, value := range labels {
+		parts := strings.Split(key, ".")
+		if len(parts) != 4 || parts[0] != "traefik" || parts[2] != "frontend" || parts[3] != "rule" || value == "" {
+			continue
+		}
+
+		segments = append(segments, parts[1])
+	}
+
+	sort.Strings(segments)
+
+	return segments
+}
+
+func traefikV1RuleToFrontend(frontendRule string) (erconfig.Frontend, error) {
+	parsed, err := parseTraefikFrontendRule(frontendRule)
+	if err != nil {
+		return erconfig.Frontend{}, err
+	}
+
+	opts := []erconfig.FrontendOpt{}
+	if parsed.PathPrefix != "" {
+		opts = append(opts, erconfig.PathPrefix(parsed.PathPrefix))
+	}
 
-	return &app, nil
+	switch {
+	case parsed.Host != "":
+		return erconfig.SimpleHostnameFrontend(parsed.Host, opts...), nil
+	case parsed.HostRegexp != "":
+		return erconfig.RegexpHostnameFrontend(parsed.HostRegexp, opts...), nil
+	default:
+		return erconfig.Frontend{}, fmt.Errorf("unsupported frontend rule: %s", frontendRule)
+	}
+}
+
+// https://doc.traefik.io/traefik/v2.11/routing/providers/docker/
+//
+// routers ("traefik.http.routers.<router>.rule") become frontends. routers' services
+// ("traefik.http.services.<service>.loadbalancer.server.port") tell the port and scheme.
+// routers to different services become different routings.
+func traefikV2LabelsToRoutings(labels map[string]string) ([]traefikRouting, error) {
+	routers := traefikV2Names(labels, "traefik.http.routers.")
+	services := traefikV2Names(labels, "traefik.http.services.")
+
+	frontendsByService := map[string][]erconfig.Frontend{}
+	serviceNames := []string{} // in order of appearance
+
+	for _, router := range routers {
+		rule := labels["traefik.http.routers."+router+".rule"]
+		if rule == "" { // router with only other settings (like TLS). they're not our concern.
+			continue
+		}
+
+		frontends, err := traefikV2RuleToFrontends(rule)
+		if err != nil {
+			return nil, fmt.Errorf("router %s: %w", router, err)
+		}
+
+		// like in Traefik, the service can be left out if there's only one
+		serviceName := labels["traefik.http.routers."+router+".service"]
+		if serviceName == "" && len(services) > 1 {
+			return nil, fmt.Errorf("router %s: service must be specified as there are multiple services", router)
+		}
+
+		if serviceName == "" && len(services) == 1 {
+			serviceName = services[0]
+		}
+
+		if _, seen := frontendsByService[serviceName]; !seen {
+			serviceNames = append(serviceNames, serviceName)
+		}
+
+		frontendsByService[serviceName] = append(frontendsByService[serviceName], frontends...)
+	}
+
+	routings := []traefikRouting{}
+
+	for _, serviceName := range serviceNames {
+		lbServer := "traefik.http.services." + serviceName + ".loadbalancer.server."
+
+		routings = append(routings, traefikRouting{
+			// named after the service even if it's the only one, so the app's ID (and the IP rules
+			// referencing it) doesn't change when another service is added
+			name:      serviceName,
+			frontends: frontendsByService[serviceName],
+			scheme:    labels[lbServer+"scheme"],
+			port:      labels[lbServer+"port"],
+		})
+	}
+
+	return routings, nil
+}
+
+// "traefik.http.routers.web.rule", "traefik.http.routers.api.tls" => ["api", "web"] (sorted for determinism)
+func traefikV2Names(labels map[string]string, prefix string) []string {
+	names := []string{}
+
+	for key := range labels {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		name, _, ok := strings.Cut(key[len(prefix):], ".")
+		if !ok || name == "" {
+			continue
+		}
+
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
 }
 
 type traefikFrontendRule struct {
@@ -178,3 +348,11 @@ func parseTraefikFrontendRule(rule string) (traefikFrontendRule, error) {
 
 	return parsed, nil
 }
+
+func portOrEmpty(port int) string {
+	if port == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(port)
+}
@@ -2,8 +2,11 @@ package dockerdiscovery
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/function61/edgerouter/pkg/erconfig"
 	"github.com/function61/gokit/assert"
 )
 
@@ -181,15 +184,105 @@ func TestTraefikAnnotationsToApp(t *testing.T) {
       "pass_host_header": true
     }
   }
+}`),
+		mkTestCase("v2", ip101And102, labels{
+			"edgerouter.auth":                                             "public",
+			"traefik.enable":                                              "true",
+			"traefik.http.routers.web.rule":                               "Host(`example.com`) && PathPrefix(`/app/`)",
+			"traefik.http.routers.web.tls":                                "true",
+			"traefik.http.routers.legacy.rule":                            "Host(`old.example.com`, `older.example.com`)",
+			"traefik.http.services.app.loadbalancer.server.port":          "8080",
+			"traefik.http.services.app.loadbalancer.server.scheme":        "https",
+			"traefik.http.middlewares.app-redirect.redirectscheme.scheme": "https",
+		}, `{
+  "id": "v2_app",
+  "frontends": [
+    {
+      "kind": "hostname",
+      "hostname": "old.example.com",
+      "path_prefix": "/"
+    },
+    {
+      "kind": "hostname",
+      "hostname": "older.example.com",
+      "path_prefix": "/"
+    },
+    {
+      "kind": "hostname",
+      "hostname": "example.com",
+      "path_prefix": "/app/"
+    }
+  ],
+  "backend": {
+    "kind": "reverse_proxy",
+    "reverse_proxy_opts": {
+      "origins": [
+        "https://192.168.1.101:8080",
+        "https://192.168.1.102:8080"
+      ],
+      "pass_host_header": true
+    }
+  }
+}`),
+		mkTestCase("v2NoServices", ip101, labels{
+			"edgerouter.auth":               "public",
+			"traefik.http.routers.web.rule": "Host(`example.com`)",
+		}, `{
+  "id": "v2NoServices",
+  "frontends": [
+    {
+      "kind": "hostname",
+      "hostname": "example.com",
+      "path_prefix": "/"
+    }
+  ],
+  "backend": {
+    "kind": "reverse_proxy",
+    "reverse_proxy_opts": {
+      "origins": [
+        "http://192.168.1.101:80"
+      ],
+      "pass_host_header": true
+    }
+  }
+}`),
+		mkTestCase("concurrencyLimited", ip101, labels{
+			"edgerouter.auth": "public",
+			"edgerouter.concurrency_limit.max_concurrent": "20",
+			"edgerouter.concurrency_limit.max_queued":     "100",
+			"traefik.frontend.rule":                       "Host:www.example.com",
+		}, `{
+  "id": "concurrencyLimited",
+  "frontends": [
+    {
+      "kind": "hostname",
+      "hostname": "www.example.com",
+      "path_prefix": "/"
+    }
+  ],
+  "backend": {
+    "kind": "reverse_proxy",
+    "reverse_proxy_opts": {
+      "origins": [
+        "http://192.168.1.101:80"
+      ],
+      "pass_host_header": true
+    }
+  },
+  "concurrency_limit": {
+    "max_concurrent": 20,
+    "max_queued": 100
+  }
 }`),
 	}
 
 	for _, tc := range tcs {
 		t.Run(tc.input.Name, func(t *testing.T) {
-			app, err := traefikAnnotationsToApp(tc.input)
+			apps, err := TraefikAnnotationsToApps(tc.input)
 			assert.Ok(t, err)
+			assert.EqualInt(t, len(apps), 1)
 
-			appJSON, err := json.MarshalIndent(app, "", "  ")
+			appJSON, err := json.MarshalIndent(apps[0], "", "  ")
 			assert.Ok(t, err)
 
 			assert.EqualString(t, string(appJSON), tc.expectedOutput)
@@ -197,6 +290,94 @@ func TestTraefikAnnotationsToApp(t *testing.T) {
 	}
 }
 
+func TestMultipleAppsPerService(t *testing.T) {
+	uiAndAPI := func(lab labels) Service {
+		return Service{
+			Name:      "grafana",
+			Labels:    lab,
+			Instances: []ServiceInstance{{IPv4: "192.168.1.101"}},
+		}
+	}
+
+	summarize := func(apps []erconfig.Application) []string {
+		summaries := []string{}
+		for _, app := range apps {
+			summaries = append(summaries, fmt.Sprintf("%s %s -> %s",
+				app.ID,
+				app.Frontends[0].Hostname,
+				strings.Join(app.Backend.ReverseProxyOpts.Origins, ",")))
+		}
+		return summaries
+	}
+
+	// v1.7 segments
+	apps, err := TraefikAnnotationsToApps(uiAndAPI(labels{
+		"edgerouter.auth":           "public",
+		"traefik.frontend.rule":     "Host:grafana.example.com",
+		"traefik.port":              "3000",
+		"traefik.api.frontend.rule": "Host:api.example.com",
+		"traefik.api.port":          "9090",
+		"traefik.api.protocol":      "https",
+	}))
+	assert.Ok(t, err)
+	assert.EqualString(t, strings.Join(summarize(apps), "\n"), `grafana grafana.example.com -> http://192.168.1.101:3000
+grafana_api api.example.com -> https://192.168.1.101:9090`)
+
+	// v2 services
+	apps, err = TraefikAnnotationsToApps(uiAndAPI(labels{
+		"edgerouter.auth":                                    "public",
+		"traefik.http.routers.ui.rule":                       "Host(`grafana.example.com`)",
+		"traefik.http.routers.ui.service":                    "ui",
+		"traefik.http.services.ui.loadbalancer.server.port":  "8080",
+		"traefik.http.routers.api.rule":                      "Host(`api.example.com`)",
+		"traefik.http.routers.api.service":                   "api",
+		"traefik.http.services.api.loadbalancer.server.port": "9090",
+	}))
+	assert.Ok(t, err)
+	assert.EqualString(t, strings.Join(summarize(apps), "\n"), `grafana_api api.example.com -> http://192.168.1.101:9090
+grafana_ui grafana.example.com -> http://192.168.1.101:8080`)
+
+	// ID of a single v2 service doesn't depend on whether there are other services
+	apps, err = TraefikAnnotationsToApps(uiAndAPI(labels{
+		"edgerouter.auth":                                   "public",
+		"traefik.http.routers.ui.rule":                      "Host(`grafana.example.com`)",
+		"traefik.http.services.ui.loadbalancer.server.port": "8080",
+	}))
+	assert.Ok(t, err)
+	assert.EqualString(t, strings.Join(summarize(apps), "\n"), "grafana_ui grafana.example.com -> http://192.168.1.101:8080")
+
+	_, err = TraefikAnnotationsToApps(uiAndAPI(labels{
+		"edgerouter.auth":                                    "public",
+		"traefik.http.routers.ui.rule":                       "Host(`grafana.example.com`)",
+		"traefik.http.services.ui.loadbalancer.server.port":  "8080",
+		"traefik.http.services.api.loadbalancer.server.port": "9090",
+	}))
+	assert.EqualString(t, err.Error(), "router ui: service must be specified as there are multiple services")
+}
+
+func TestConcurrencyLimitLabelErrors(t *testing.T) {
+	service := func(lab labels) Service {
+		lab["edgerouter.auth"] = "public"
+		lab["traefik.frontend.rule"] = "Host:www.example.com"
+
+		return Service{
+			Name:      "web",
+			Labels:    lab,
+			Instances: []ServiceInstance{{IPv4: "192.168.1.101"}},
+		}
+	}
+
+	_, err := TraefikAnnotationsToApps(service(labels{
+		"edgerouter.concurrency_limit.max_concurrent": "lots",
+	}))
+	assert.EqualString(t, err.Error(), `edgerouter.concurrency_limit.max_concurrent: strconv.Atoi: parsing "lots": invalid syntax`)
+
+	_, err = TraefikAnnotationsToApps(service(labels{
+		"edgerouter.concurrency_limit.max_queued": "10",
+	}))
+	assert.EqualString(t, err.Error(), "edgerouter.concurrency_limit: MaxConcurrent: must be positive; got 0")
+}
+
 func TestParseSubRules(t *testing.T) {
 	rule, err := parseTraefikFrontendRule("Host:example.com;PathPrefix:/admin/")
 	assert.Ok(t, err)
@@ -204,3 +385,67 @@ func TestParseSubRules(t *testing.T) {
 	assert.Ok(t, err)
 	assert.EqualString(t, string(asJSON), `{"Host":"example.com","PathPrefix":"/admin/"}`)
 }
+
+func TestTraefikV2RuleToFrontends(t *testing.T) {
+	for _, tc := range []struct {
+		rule     string
+		expected string
+	}{
+		{
+			"Host(`example.com`)",
+			`[{"kind":"hostname","hostname":"example.com","path_prefix":"/"}]`,
+		},
+		{
+			"Host(`a.com`) && (PathPrefix(`/x`) || PathPrefix(`/y`))",
+			`[{"kind":"hostname","hostname":"a.com","path_prefix":"/x"},{"kind":"hostname","hostname":"a.com","path_prefix":"/y"}]`,
+		},
+		{
+			"PathPrefix(`/api`) || HostRegexp(`{subdomain:[a-z]+}.example.com`, `{any}.example.net`)",
+			`[{"kind":"path_prefix","path_prefix":"/api"},{"kind":"hostname_regexp","hostname_regexp":"{[a-z]+}.example.com","path_prefix":"/"},{"kind":"hostname_regexp","hostname_regexp":"{[^.]+}.example.net","path_prefix":"/"}]`,
+		},
+		{
+			"Host(\"quoted.com\")&&PathPrefix(`/`)",
+			`[{"kind":"hostname","hostname":"quoted.com","path_prefix":"/"}]`,
+		},
+		{
+			"Host(`a.com`) && Host(`b.com`)",
+			`error: conflicting Host matchers: 'a.com' and 'b.com'`,
+		},
+		{
+			"Host(`a.com`) && !PathPrefix(`/admin`)",
+			"error: rule 'Host(`a.com`) && !PathPrefix(`/admin`)': negation not supported (at 17)",
+		},
+		{
+			"Host(`a.com`",
+			"error: rule 'Host(`a.com`': expected ')' at end of rule",
+		},
+		{
+			"Host(`a.com`) PathPrefix(`/`)",
+			"error: rule 'Host(`a.com`) PathPrefix(`/`)': unexpected 'PathPrefix(`/`)' at 14",
+		},
+		{
+			"Host(`a.com`) && Headers(`X-Api-Version`, `2`) && Method(`GET`, `HEAD`)",
+			`[{"kind":"hostname","hostname":"a.com","path_prefix":"/","methods":["GET","HEAD"],"headers":[{"name":"X-Api-Version","value":"2"}]}]`,
+		},
+		{
+			"HeadersRegexp(`Upgrade`, `(?i)websocket`) && Query(`a=1`, `b=2`) && Path(`/ws.json`)",
+			`[{"kind":"path_prefix","path_prefix":"/","headers":[{"name":"Upgrade","regexp":"(?i)websocket"}],"queries":[{"name":"a","value":"1"},{"name":"b","value":"2"}],"path_regexp":"^/ws\\.json$"}]`,
+		},
+		{
+			"ClientIP(`10.0.0.0/8`)",
+			"error: unsupported matcher: ClientIP",
+		},
+	} {
+		t.Run(tc.rule, func(t *testing.T) {
+			frontends, err := traefikV2RuleToFrontends(tc.rule)
+			if err != nil {
+				assert.EqualString(t, "error: "+err.Error(), tc.expected)
+				return
+			}
+
+			asJSON, err := json.Marshal(frontends)
+			assert.Ok(t, err)
+			assert.EqualString(t, string(asJSON), tc.expected)
+		})
+	}
+}
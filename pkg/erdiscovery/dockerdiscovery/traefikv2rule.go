@@ -0,0 +1,334 @@
+package dockerdiscovery
+
+// Parser for Traefik v2 router rules:
+//
+//	https://doc.traefik.io/traefik/v2.11/routing/routers/#rule
+//
+// The rule is an expression like "Host(`a.com`) && (PathPrefix(`/x`) || PathPrefix(`/y`))". Our
+// frontends are flat (one host matcher + one path prefix + conditions that all have to match), so
+// the expression is normalized to an OR of ANDs (each AND = one frontend).
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+)
+
+type traefikV2Matcher struct {
+	name string   // "Host" | "PathPrefix" | ...
+	args []string // for matchers that have "any of" semantics with multiple args, this has only one
+}
+
+// matchers that all have to match
+type traefikV2Conjunction []traefikV2Matcher
+
+func traefikV2RuleToFrontends(rule string) ([]erconfig.Frontend, error) {
+	conjunctions, err := parseTraefikV2Rule(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	frontends := []erconfig.Frontend{}
+
+	for _, conjunction := range conjunctions {
+		frontend, err := traefikV2ConjunctionToFrontend(conjunction)
+		if err != nil {
+			return nil, err
+		}
+
+		frontends = append(frontends, frontend)
+	}
+
+	return frontends, nil
+}
+
+func traefikV2ConjunctionToFrontend(conjunction traefikV2Conjunction) (erconfig.Frontend, error) {
+	host, hostRegexp, pathPrefix, pathRegexp := "", "", "", ""
+	opts := []erconfig.FrontendOpt{}
+	methodsSeen := false
+
+	// "Host(`a`) && Host(`b`)" can never match, so it's most probably a mistake
+	setOnce := func(field *string, name string, value string) error {
+		if *field != "" && *field != value {
+			return fmt.Errorf("conflicting %s matchers: '%s' and '%s'", name, *field, value)
+		}
+
+		*field = value
+		return nil
+	}
+
+	for _, matcher := range conjunction {
+		if err := func() error {
+			switch matcher.name {
+			case "Host":
+				return setOnce(&host, matcher.name, matcher.args[0])
+			case "HostRegexp":
+				return setOnce(&hostRegexp, matcher.name, traefikV2HostRegexpToOurs(matcher.args[0]))
+			case "PathPrefix":
+				return setOnce(&pathPrefix, matcher.name, matcher.args[0])
+			case "Path":
+				if strings.Contains(matcher.args[0], "{") {
+					return fmt.Errorf("path templates not supported: %s", matcher.args[0])
+				}
+
+				return setOnce(&pathRegexp, matcher.name, "^"+regexp.QuoteMeta(matcher.args[0])+"$")
+			case "Method":
+				if methodsSeen {
+					return fmt.Errorf("multiple Method matchers")
+				}
+				methodsSeen = true
+
+				opts = append(opts, erconfig.Methods(matcher.args...))
+			case "Headers", "HeadersRegexp":
+				if len(matcher.args) != 2 {
+					return fmt.Errorf("%s: expecting 2 arguments; got %d", matcher.name, len(matcher.args))
+				}
+
+				if matcher.name == "Headers" {
+					opts = append(opts, erconfig.HeaderEquals(matcher.args[0], matcher.args[1]))
+				} else {
+					opts = append(opts, erconfig.HeaderRegexp(matcher.args[0], matcher.args[1]))
+				}
+			case "Query":
+				for _, pair := range matcher.args { // all have to match
+					key, value, _ := strings.Cut(pair, "=")
+					opts = append(opts, erconfig.QueryEquals(key, value))
+				}
+			default:
+				return fmt.Errorf("unsupported matcher: %s", matcher.name)
+			}
+
+			return nil
+		}(); err != nil {
+			return erconfig.Frontend{}, err
+		}
+	}
+
+	if host != "" && hostRegexp != "" {
+		return erconfig.Frontend{}, fmt.Errorf("both Host and HostRegexp specified: '%s' and '%s'", host, hostRegexp)
+	}
+
+	if pathPrefix != "" {
+		opts = append(opts, erconfig.PathPrefix(pathPrefix))
+	}
+
+	if pathRegexp != "" {
+		opts = append(opts, erconfig.PathRegexp(pathRegexp))
+	}
+
+	switch {
+	case host != "":
+		return erconfig.SimpleHostnameFrontend(host, opts...), nil
+	case hostRegexp != "":
+		return erconfig.RegexpHostnameFrontend(hostRegexp, opts...), nil
+	default: // no host matchers => all hosts
+		return erconfig.PathPrefixFrontend("/", opts...), nil
+	}
+}
+
+var traefikV2HostRegexpVariableRe = regexp.MustCompile(`\{[^}]+\}`)
+
+// v2 has named variables "{subdomain:[a-z]+}" (or just "{subdomain}" = any label). ours are "{[a-z]+}"
+func traefikV2HostRegexpToOurs(hostRegexp string) string {
+	return traefikV2HostRegexpVariableRe.ReplaceAllStringFunc(hostRegexp, func(variable string) string {
+		_, re, hasRegexp := strings.Cut(variable[1:len(variable)-1], ":")
+		if !hasRegexp {
+			re = "[^.]+"
+		}
+
+		return "{" + re + "}"
+	})
+}
+
+// returns the rule in disjunctive normal form (OR of ANDs)
+func parseTraefikV2Rule(rule string) ([]traefikV2Conjunction, error) {
+	p := &traefikV2RuleParser{input: rule}
+
+	result, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("rule '%s': %w", rule, err)
+	}
+
+	if p.skipSpace(); p.pos != len(p.input) {
+		return nil, fmt.Errorf("rule '%s': unexpected '%s' at %d", rule, p.input[p.pos:], p.pos)
+	}
+
+	return result, nil
+}
+
+// recursive descent parser. grammar:
+//
+//	or      = and { "||" and }
+//	and     = factor { "&&" factor }
+//	factor  = "(" or ")" | matcher
+//	matcher = name "(" string { "," string } ")"
+type traefikV2RuleParser struct {
+	input string
+	pos   int
+}
+
+func (p *traefikV2RuleParser) parseOr() ([]traefikV2Conjunction, error) {
+	result, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.consume("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, right...)
+	}
+
+	return result, nil
+}
+
+func (p *traefikV2RuleParser) parseAnd() ([]traefikV2Conjunction, error) {
+	result, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.consume("&&") {
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+
+		// (a || b) && (c || d) => a&&c || a&&d || b&&c || b&&d
+		product := []traefikV2Conjunction{}
+		for _, l := range result {
+			for _, r := range right {
+				combined := append(append(traefikV2Conjunction{}, l...), r...)
+				product = append(product, combined)
+			}
+		}
+
+		result = product
+	}
+
+	return result, nil
+}
+
+func (p *traefikV2RuleParser) parseFactor() ([]traefikV2Conjunction, error) {
+	if p.consume("(") {
+		result, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.consume(")") {
+			return nil, p.errorExpected("')'")
+		}
+
+		return result, nil
+	}
+
+	if p.consume("!") {
+		return nil, fmt.Errorf("negation not supported (at %d)", p.pos-1)
+	}
+
+	return p.parseMatcher()
+}
+
+func (p *traefikV2RuleParser) parseMatcher() ([]traefikV2Conjunction, error) {
+	p.skipSpace()
+
+	nameStart := p.pos
+	for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos]))) {
+		p.pos++
+	}
+
+	name := p.input[nameStart:p.pos]
+	if name == "" {
+		return nil, p.errorExpected("matcher")
+	}
+
+	if !p.consume("(") {
+		return nil, p.errorExpected("'('")
+	}
+
+	args := []string{}
+
+	for {
+		arg, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+
+		if !p.consume(",") {
+			break
+		}
+	}
+
+	if !p.consume(")") {
+		return nil, p.errorExpected("')'")
+	}
+
+	switch name {
+	case "Host", "HostRegexp", "PathPrefix", "Path":
+		// multiple args means any of them, i.e. "Host(`a`, `b`)" = "Host(`a`) || Host(`b`)"
+		result := []traefikV2Conjunction{}
+		for _, arg := range args {
+			result = append(result, traefikV2Conjunction{{name: name, args: []string{arg}}})
+		}
+
+		return result, nil
+	default: // e.g. "Headers(`key`, `value`)". the matcher itself knows what the args mean.
+		return []traefikV2Conjunction{{{name: name, args: args}}}, nil
+	}
+}
+
+// `backticked` or "double-quoted"
+func (p *traefikV2RuleParser) parseString() (string, error) {
+	p.skipSpace()
+
+	if p.pos >= len(p.input) || (p.input[p.pos] != '`' && p.input[p.pos] != '"') {
+		return "", p.errorExpected("string")
+	}
+
+	quote := p.input[p.pos]
+
+	end := strings.IndexByte(p.input[p.pos+1:], quote)
+	if end == -1 {
+		return "", fmt.Errorf("unterminated string at %d", p.pos)
+	}
+
+	str := p.input[p.pos+1 : p.pos+1+end]
+	p.pos += end + 2
+
+	return str, nil
+}
+
+// skips whitespace and consumes token if it's next
+func (p *traefikV2RuleParser) consume(token string) bool {
+	p.skipSpace()
+
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+
+	return false
+}
+
+func (p *traefikV2RuleParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *traefikV2RuleParser) errorExpected(what string) error {
+	if p.pos >= len(p.input) {
+		return fmt.Errorf("expected %s at end of rule", what)
+	}
+
+	return fmt.Errorf("expected %s at %d", what, p.pos)
+}
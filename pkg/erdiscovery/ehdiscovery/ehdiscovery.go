@@ -20,6 +20,10 @@ import (
 
 const (
 	stream = "/loadbalancer"
+
+	// EventHorizon doesn't (yet) have pub/sub, so "watching" is polling the stream. reaching realtime
+	// is a single cheap read when nothing has changed, so we can afford to do it often.
+	defaultWatchInterval = 2 * time.Second
 )
 
 func HasConfigInEnv() bool {
@@ -27,20 +31,36 @@ func HasConfigInEnv() bool {
 }
 
 type ehDiscovery struct {
-	tenantCtx ehreader.TenantCtx
-	reader    *ehreader.Reader
-	cursor    ehclient.Cursor
-	logger    *slog.Logger
-	apps      map[string]erconfig.Application
-	appsMu    sync.Mutex
+	tenantCtx     ehreader.TenantCtx
+	reader        *ehreader.Reader
+	readerMu      sync.Mutex // reader is not safe for concurrent use
+	watchInterval time.Duration
+	cursor        ehclient.Cursor
+	logger        *slog.Logger
+	apps          map[string]erconfig.Application
+	ipRules       map[string]erconfig.IPRule // keyed by prefix
+	appsMu        sync.Mutex                 // also protects ipRules
 }
 
+var (
+	_ erdiscovery.Watcher       = (*ehDiscovery)(nil)
+	_ erdiscovery.IPRulesReader = (*ehDiscovery)(nil)
+	_ erdiscovery.IPRulesWriter = (*ehDiscovery)(nil)
+)
+
 func New(tenantCtx ehreader.TenantCtx, logger *slog.Logger) (erdiscovery.ReaderWriter, error) {
+	watchInterval, err := erdiscovery.PollIntervalFromEnv("EVENTHORIZON_DISCOVERY_POLL_INTERVAL", defaultWatchInterval)
+	if err != nil {
+		return nil, err
+	}
+
 	d := &ehDiscovery{
-		tenantCtx: tenantCtx,
-		cursor:    ehclient.Beginning(tenantCtx.Stream(stream)),
-		logger:    logger.With("subsystem", "ehdiscovery"),
-		apps:      map[string]erconfig.Application{},
+		tenantCtx:     tenantCtx,
+		watchInterval: watchInterval,
+		cursor:        ehclient.Beginning(tenantCtx.Stream(stream)),
+		logger:        logger.With("subsystem", "ehdiscovery"),
+		apps:          map[string]erconfig.Application{},
+		ipRules:       map[string]erconfig.IPRule{},
 	}
 
 	d.reader = ehreader.New(d, tenantCtx.Client, slogshim.ToStd(logger.With("subsystem", "ehdiscovery/ehreader"), slog.LevelInfo))
@@ -50,7 +70,7 @@ func New(tenantCtx ehreader.TenantCtx, logger *slog.Logger) (erdiscovery.ReaderW
 
 func (d *ehDiscovery) ReadApplications(ctx context.Context) ([]erconfig.Application, error) {
 	// this is essentially polling
-	if err := d.reader.LoadUntilRealtime(ctx); err != nil {
+	if _, err := d.loadUntilRealtime(ctx); err != nil {
 		return nil, err
 	}
 
@@ -68,6 +88,77 @@ func (d *ehDiscovery) ReadApplications(ctx context.Context) ([]erconfig.Applicat
 	return apps, nil
 }
 
+func (d *ehDiscovery) ReadIPRules(ctx context.Context) ([]erconfig.IPRule, error) {
+	if _, err := d.loadUntilRealtime(ctx); err != nil {
+		return nil, err
+	}
+
+	d.appsMu.Lock()
+	defer d.appsMu.Unlock()
+
+	rules := []erconfig.IPRule{}
+
+	for _, rule := range d.ipRules {
+		rules = append(rules, rule)
+	}
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Prefix < rules[j].Prefix })
+
+	return rules, nil
+}
+
+// notifies when new events were appended to the stream
+func (d *ehDiscovery) WatchChanges(ctx context.Context, changed chan<- struct{}) error {
+	ticker := time.NewTicker(d.watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		advanced, err := d.loadUntilRealtime(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			// transient errors are expected. ReadApplications() will report if the problem persists.
+			d.logger.Warn("WatchChanges", "error", err)
+			continue
+		}
+
+		if advanced {
+			erdiscovery.NotifyChanged(changed)
+		}
+	}
+}
+
+// returns true if the cursor advanced (= there were new events)
+func (d *ehDiscovery) loadUntilRealtime(ctx context.Context) (bool, error) {
+	d.readerMu.Lock()
+	defer d.readerMu.Unlock()
+
+	before := d.currentCursor()
+
+	if err := d.reader.LoadUntilRealtime(ctx); err != nil {
+		return false, err
+	}
+
+	after := d.currentCursor()
+
+	return !after.Equal(before), nil
+}
+
+func (d *ehDiscovery) currentCursor() ehclient.Cursor {
+	d.appsMu.Lock()
+	defer d.appsMu.Unlock()
+
+	return d.cursor
+}
+
 func (d *ehDiscovery) UpdateApplication(ctx context.Context, app erconfig.Application) error {
 	updated := erdomain.NewAppUpdated(app, ehevent.MetaSystemUser(time.Now()))
 
@@ -86,6 +177,28 @@ func (d *ehDiscovery) DeleteApplication(ctx context.Context, app erconfig.Applic
 	return err
 }
 
+func (d *ehDiscovery) AddIPRule(ctx context.Context, rule erconfig.IPRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+
+	added := erdomain.NewIPRuleAdded(rule, ehevent.MetaSystemUser(time.Now()))
+
+	_, err := d.tenantCtx.Client.Append(ctx, d.tenantCtx.Stream(stream), []string{
+		ehevent.Serialize(added),
+	})
+	return err
+}
+
+func (d *ehDiscovery) RemoveIPRule(ctx context.Context, prefix string) error {
+	removed := erdomain.NewIPRuleRemoved(prefix, ehevent.MetaSystemUser(time.Now()))
+
+	_, err := d.tenantCtx.Client.Append(ctx, d.tenantCtx.Stream(stream), []string{
+		ehevent.Serialize(removed),
+	})
+	return err
+}
+
 func (d *ehDiscovery) GetEventTypes() ehevent.Allocators {
 	return erdomain.Types
 }
@@ -112,6 +225,10 @@ func (d *ehDiscovery) processEvent(ev ehevent.Event) error {
 		d.apps[e.Application.ID] = e.Application
 	case *erdomain.AppDeleted:
 		delete(d.apps, e.ID)
+	case *erdomain.IPRuleAdded:
+		d.ipRules[e.Rule.Prefix] = e.Rule
+	case *erdomain.IPRuleRemoved:
+		delete(d.ipRules, e.Prefix)
 	default:
 		return ehreader.UnsupportedEventTypeErr(ev)
 	}
@@ -2,13 +2,17 @@ package ehdiscovery
 
 import (
 	"context"
+	"encoding/json"
 	"io"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/erdiscovery"
 	"github.com/function61/edgerouter/pkg/erdomain"
 	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/eventhorizon/pkg/ehclient"
 	"github.com/function61/eventhorizon/pkg/ehevent"
 	"github.com/function61/eventhorizon/pkg/ehreader"
 	"github.com/function61/eventhorizon/pkg/ehreader/ehreadertest"
@@ -69,3 +73,129 @@ func testApp(id string) erconfig.Application {
 		erconfig.SimpleHostnameFrontend("example.com"),
 		erconfig.ReverseProxyBackend([]string{"http://127.0.0.1/"}, nil, false))
 }
+
+func TestIPRules(t *testing.T) {
+	ctx := context.Background()
+
+	eventLog := ehreadertest.NewEventLog()
+	eventLog.AppendE(
+		"/t-42/loadbalancer",
+		erdomain.NewAppUpdated(testApp("testApp1"), ehevent.MetaSystemUser(time.Now())),
+		erdomain.NewIPRuleAdded(erconfig.IPRuleAllowAllApps("192.168.1.0/24", "office"), ehevent.MetaSystemUser(time.Now())))
+
+	discovery, err := New(*ehreader.NewTenantCtx(ehreader.TenantId("42"), eventLog), slogshim.NewWithOutput(io.Discard))
+	assert.Ok(t, err)
+
+	rulesJSON := func() string {
+		rules, err := discovery.(erdiscovery.IPRulesReader).ReadIPRules(ctx)
+		assert.Ok(t, err)
+
+		asJSON, err := json.Marshal(rules)
+		assert.Ok(t, err)
+
+		return string(asJSON)
+	}
+
+	assert.EqualString(t, rulesJSON(), `[{"prefix":"192.168.1.0/24","comment":"office"}]`)
+
+	writer := discovery.(erdiscovery.IPRulesWriter)
+
+	assert.Ok(t, writer.AddIPRule(ctx, erconfig.IPRuleAllowOnlyApps("100.64.0.7/32", "joonas phone", "testApp1")))
+	assert.EqualString(t, rulesJSON(), `[{"prefix":"100.64.0.7/32","apps":["testApp1"],"comment":"joonas phone"},{"prefix":"192.168.1.0/24","comment":"office"}]`)
+
+	// same prefix replaces
+	assert.Ok(t, writer.AddIPRule(ctx, erconfig.IPRuleAllowOnlyApps("192.168.1.0/24", "office", "testApp1")))
+	assert.Ok(t, writer.RemoveIPRule(ctx, "100.64.0.7/32"))
+	assert.EqualString(t, rulesJSON(), `[{"prefix":"192.168.1.0/24","apps":["testApp1"],"comment":"office"}]`)
+
+	assert.EqualString(t, writer.AddIPRule(ctx, erconfig.IPRuleAllowAllApps("192.168.1.1/24", "")).Error(), "Prefix: not in canonical form; use 192.168.1.0/24")
+
+	// IP rule events don't affect apps
+	apps, err := discovery.ReadApplications(ctx)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(apps), 1)
+}
+
+func TestWatchChanges(t *testing.T) {
+	eventLog := &lockedEventLog{EventLog: ehreadertest.NewEventLog()}
+	eventLog.AppendE(
+		"/t-42/loadbalancer",
+		erdomain.NewAppUpdated(testApp("testApp1"), ehevent.MetaSystemUser(time.Now())))
+
+	discovery, err := New(*ehreader.NewTenantCtx(ehreader.TenantId("42"), eventLog), slogshim.NewWithOutput(io.Discard))
+	assert.Ok(t, err)
+
+	discovery.(*ehDiscovery).watchInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	apps, err := discovery.ReadApplications(ctx)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(apps), 1)
+
+	changed := make(chan struct{}, 1)
+
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- discovery.(erdiscovery.Watcher).WatchChanges(ctx, changed)
+	}()
+
+	// no new events => no notifications
+	select {
+	case <-changed:
+		t.Fatal("unexpected change notification")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	eventLog.AppendE(
+		"/t-42/loadbalancer",
+		erdomain.NewAppUpdated(testApp("testApp2"), ehevent.MetaSystemUser(time.Now())))
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected change notification")
+	}
+
+	apps, err = discovery.ReadApplications(ctx)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(apps), 2)
+
+	cancel()
+	assert.Ok(t, <-watchDone)
+}
+
+// ehreadertest.EventLog isn't safe for concurrent use, but here the watcher reads it while we append
+type lockedEventLog struct {
+	*ehreadertest.EventLog
+	mu sync.Mutex
+}
+
+func (e *lockedEventLog) Read(ctx context.Context, lastKnown ehclient.Cursor) (*ehclient.ReadResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.EventLog.Read(ctx, lastKnown)
+}
+
+func (e *lockedEventLog) Append(ctx context.Context, stream string, events []string) (*ehclient.AppendResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.EventLog.Append(ctx, stream, events)
+}
+
+func (e *lockedEventLog) AppendAfter(ctx context.Context, after ehclient.Cursor, events []string) (*ehclient.AppendResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.EventLog.AppendAfter(ctx, after, events)
+}
+
+func (e *lockedEventLog) AppendE(stream string, events ...ehevent.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.EventLog.AppendE(stream, events...)
+}
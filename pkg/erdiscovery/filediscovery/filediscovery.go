@@ -3,7 +3,11 @@ package filediscovery
 
 import (
 	"context"
+	"log/slog"
+	"path/filepath"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/function61/edgerouter/pkg/erconfig"
 	"github.com/function61/edgerouter/pkg/erdiscovery"
 	"github.com/function61/gokit/jsonfile"
@@ -20,13 +24,22 @@ type file struct {
 }
 
 type fileDiscovery struct {
-	file string
+	file            string
+	rewatchInterval time.Duration // how often to retry a lost watch
+	logger          *slog.Logger
 }
 
-var _ erdiscovery.Reader = (*fileDiscovery)(nil)
+var _ interface {
+	erdiscovery.Reader
+	erdiscovery.Watcher
+} = (*fileDiscovery)(nil)
 
-func New(file string) erdiscovery.Reader {
-	return &fileDiscovery{file}
+func New(file string, logger *slog.Logger) erdiscovery.Reader {
+	return &fileDiscovery{
+		file:            file,
+		rewatchInterval: time.Minute,
+		logger:          logger.With("subsystem", "filediscovery"),
+	}
 }
 
 func (f *fileDiscovery) ReadApplications(_ context.Context) ([]erconfig.Application, error) {
@@ -36,3 +49,66 @@ func (f *fileDiscovery) ReadApplications(_ context.Context) ([]erconfig.Applicat
 	}
 	return appsFromFile.Apps, nil
 }
+
+// notifies when the file changes. watches the directory instead of the file, because editors (and
+// config management tools) commonly replace the file by renaming a new file over it, which would
+// make a watch on the file itself go stale.
+//
+// problems with the watch aren't fatal: they're logged and the watch is re-added. meanwhile the
+// periodic sync still picks up changes, just not as quickly.
+func (f *fileDiscovery) WatchChanges(ctx context.Context, changed chan<- struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	dir := filepath.Dir(f.file)
+
+	if err := watcher.Add(dir); err != nil {
+		return err
+	}
+	watching := true
+
+	rewatch := time.NewTicker(f.rewatchInterval)
+	defer rewatch.Stop()
+
+	ourFile := filepath.Clean(f.file)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			// like the event queue overflowing, after which we don't know what we missed
+			f.logger.Error("watching applications file", "error", err)
+			watching = f.rewatch(watcher, dir, changed)
+		case <-rewatch.C:
+			if !watching {
+				watching = f.rewatch(watcher, dir, changed)
+			}
+		case event := <-watcher.Events:
+			switch {
+			case filepath.Clean(event.Name) == filepath.Clean(dir) && event.Has(fsnotify.Remove|fsnotify.Rename):
+				f.logger.Warn("applications file's dir went away", "dir", dir)
+				watching = false // the watch went with it
+			case filepath.Clean(event.Name) == ourFile && !event.Has(fsnotify.Chmod):
+				erdiscovery.NotifyChanged(changed)
+			}
+		}
+	}
+}
+
+// (re-)adds the watch. notifies since we might have missed changes. false if adding failed.
+func (f *fileDiscovery) rewatch(watcher *fsnotify.Watcher, dir string, changed chan<- struct{}) bool {
+	_ = watcher.Remove(dir) // might be already gone
+
+	if err := watcher.Add(dir); err != nil {
+		f.logger.Error("watching applications file", "dir", dir, "error", err)
+		return false
+	}
+
+	erdiscovery.NotifyChanged(changed)
+
+	return true
+}
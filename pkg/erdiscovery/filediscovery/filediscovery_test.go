@@ -0,0 +1,86 @@
+package filediscovery
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erdiscovery"
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+)
+
+func TestWatchChanges(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, DefaultFilename)
+
+	assert.Ok(t, os.WriteFile(file, []byte(`{"apps": []}`), 0600))
+
+	discovery := New(file, slogshim.NewWithOutput(io.Discard))
+	discovery.(*fileDiscovery).rewatchInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- discovery.(erdiscovery.Watcher).WatchChanges(ctx, changed)
+	}()
+
+	expectChanged := func() {
+		t.Helper()
+
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected change notification")
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond) // give the watch time to be set up
+
+	// unrelated file in the same directory
+	assert.Ok(t, os.WriteFile(filepath.Join(dir, "unrelated.txt"), []byte("hello"), 0600))
+
+	select {
+	case <-changed:
+		t.Fatal("unexpected change notification")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// atomic replace, like editors do
+	tempFile := filepath.Join(dir, ".applications.json.tmp")
+	assert.Ok(t, os.WriteFile(tempFile, []byte(`{"apps": [{"id": "foo"}]}`), 0600))
+	assert.Ok(t, os.Rename(tempFile, file))
+	expectChanged()
+
+	apps, err := discovery.ReadApplications(ctx)
+	assert.Ok(t, err)
+	assert.EqualString(t, apps[0].ID, "foo")
+
+	// directory going away (and coming back, like when a volume is re-mounted) doesn't stop watching
+	assert.Ok(t, os.RemoveAll(dir))
+	time.Sleep(50 * time.Millisecond)
+	assert.Ok(t, os.Mkdir(dir, 0700))
+	assert.Ok(t, os.WriteFile(file, []byte(`{"apps": [{"id": "bar"}]}`), 0600))
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		expectChanged()
+
+		if apps, err := discovery.ReadApplications(ctx); err == nil && len(apps) == 1 && apps[0].ID == "bar" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected to see the re-created file")
+		}
+	}
+
+	cancel()
+	assert.Ok(t, <-watchDone)
+}
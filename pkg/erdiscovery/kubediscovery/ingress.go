@@ -0,0 +1,343 @@
+package kubediscovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/erdiscovery"
+)
+
+// only the fields we need of the Kubernetes API objects
+
+type objectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// https://kubernetes.io/docs/reference/kubernetes-api/service-resources/ingress-v1/
+type ingressList struct {
+	Items []ingress `json:"items"`
+}
+
+type ingress struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		IngressClassName string        `json:"ingressClassName"`
+		Rules            []ingressRule `json:"rules"`
+	} `json:"spec"`
+}
+
+type ingressRule struct {
+	Host string `json:"host"` // "" = all hosts
+	HTTP *struct {
+		Paths []ingressPath `json:"paths"`
+	} `json:"http"`
+}
+
+type ingressPath struct {
+	Path     string `json:"path"`
+	PathType string `json:"pathType"` // "Prefix" | "Exact" | "ImplementationSpecific"
+	Backend  struct {
+		Service *struct {
+			Name string             `json:"name"`
+			Port serviceBackendPort `json:"port"`
+		} `json:"service"`
+	} `json:"backend"`
+}
+
+type serviceBackendPort struct {
+	Name   string `json:"name"`
+	Number int    `json:"number"`
+}
+
+// https://kubernetes.io/docs/reference/kubernetes-api/service-resources/service-v1/
+type serviceList struct {
+	Items []service `json:"items"`
+}
+
+type service struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		Ports []servicePort `json:"ports"`
+	} `json:"spec"`
+}
+
+type servicePort struct {
+	Name        string `json:"name"`
+	Port        int    `json:"port"`
+	AppProtocol string `json:"appProtocol"`
+}
+
+// https://kubernetes.io/docs/reference/kubernetes-api/service-resources/endpoint-slice-v1/
+type endpointSliceList struct {
+	Items []endpointSlice `json:"items"`
+}
+
+type endpointSlice struct {
+	Metadata    objectMeta `json:"metadata"`
+	AddressType string     `json:"addressType"` // "IPv4" | "IPv6" | "FQDN"
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"` // nil = unknown, which consumers should interpret as ready
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"` // matches servicePort.Name
+		Port int    `json:"port"` // the port the pods listen on
+	} `json:"ports"`
+}
+
+const serviceNameLabel = "kubernetes.io/service-name"
+
+func (k *kubeDiscovery) ReadApplications(ctx context.Context) ([]erconfig.Application, error) {
+	ingresses := ingressList{}
+	if err := k.list(ctx, "networking.k8s.io/v1", "ingresses", &ingresses); err != nil {
+		return nil, err
+	}
+
+	services := serviceList{}
+	if err := k.list(ctx, "v1", "services", &services); err != nil {
+		return nil, err
+	}
+
+	endpointSlices := endpointSliceList{}
+	if err := k.list(ctx, "discovery.k8s.io/v1", "endpointslices", &endpointSlices); err != nil {
+		return nil, err
+	}
+
+	apps := []erconfig.Application{}
+
+	for _, ingress := range ingresses.Items {
+		if !k.isOurs(ingress) {
+			continue
+		}
+
+		ingressApps, err := ingressToApps(ingress, services.Items, endpointSlices.Items)
+		if err != nil { // one broken ingress shouldn't take down the others
+			k.logger.Error("ingressToApps",
+				"namespace", ingress.Metadata.Namespace,
+				"ingress", ingress.Metadata.Name,
+				"error", err)
+			continue
+		}
+
+		apps = append(apps, ingressApps...)
+	}
+
+	return apps, nil
+}
+
+func (k *kubeDiscovery) isOurs(ingress ingress) bool {
+	class := ingress.Spec.IngressClassName
+	if class == "" {
+		class = ingress.Metadata.Annotations[ingressClassAnnotation]
+	}
+
+	return class == "" || class == k.ingressClass
+}
+
+// one app per backend service (port) of an ingress, with the frontends being the (host, path)
+// combinations that route to it
+func ingressToApps(ingress ingress, services []service, endpointSlices []endpointSlice) ([]erconfig.Application, error) {
+	type serviceRef struct {
+		name string
+		port serviceBackendPort
+	}
+
+	frontendsByService := map[serviceRef][]erconfig.Frontend{}
+	serviceRefs := []serviceRef{} // to keep ordering stable
+
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service == nil { // resource backends are not supported
+				return nil, fmt.Errorf("path %s: only service backends supported", path.Path)
+			}
+
+			frontend, err := ingressRuleToFrontend(rule.Host, path)
+			if err != nil {
+				return nil, err
+			}
+
+			ref := serviceRef{path.Backend.Service.Name, path.Backend.Service.Port}
+
+			if _, seen := frontendsByService[ref]; !seen {
+				serviceRefs = append(serviceRefs, ref)
+			}
+
+			frontendsByService[ref] = append(frontendsByService[ref], frontend)
+		}
+	}
+
+	apps := []erconfig.Application{}
+
+	for _, ref := range serviceRefs {
+		origins, err := resolveOrigins(ingress.Metadata.Namespace, ref.name, ref.port, services, endpointSlices)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(origins) == 0 { // no ready pods (same as with Docker: no instances => no app)
+			continue
+		}
+
+		backend := erconfig.ReverseProxyBackend(origins, nil, true)
+
+		// annotations of the Ingress are what the Docker labels are for containers
+		backendAuthorized, err := erdiscovery.AuthFromLabels(
+			ingress.Metadata.Annotations,
+			ingress.Metadata.Namespace+"_"+ref.name, // mimics Swarm's "<stack>_<service>"
+			backend)
+		if err != nil {
+			return nil, err
+		}
+
+		concurrencyLimit, err := erdiscovery.ConcurrencyLimitFromLabels(ingress.Metadata.Annotations)
+		if err != nil {
+			return nil, err
+		}
+
+		apps = append(apps, erconfig.Application{
+			ID:               appID(ingress, ref.name, ref.port),
+			Frontends:        frontendsByService[ref],
+			Backend:          backendAuthorized,
+			ConcurrencyLimit: concurrencyLimit,
+		})
+	}
+
+	return apps, nil
+}
+
+func ingressRuleToFrontend(host string, path ingressPath) (erconfig.Frontend, error) {
+	pathPrefix := path.Path
+	if pathPrefix == "" {
+		pathPrefix = "/"
+	}
+
+	switch path.PathType {
+	case "Prefix", "ImplementationSpecific", "":
+	default: // "Exact"
+		return erconfig.Frontend{}, fmt.Errorf("path %s: unsupported pathType: %s", path.Path, path.PathType)
+	}
+
+	switch {
+	case host == "":
+		return erconfig.PathPrefixFrontend(pathPrefix), nil
+	case strings.HasPrefix(host, "*."): // wildcard only matches a single label
+		return erconfig.WildcardHostnameFrontend(host, erconfig.PathPrefix(pathPrefix)), nil
+	default:
+		return erconfig.SimpleHostnameFrontend(host, erconfig.PathPrefix(pathPrefix)), nil
+	}
+}
+
+// resolves origins from the ready endpoints of the service's port
+func resolveOrigins(
+	namespace string,
+	serviceName string,
+	port serviceBackendPort,
+	services []service,
+	endpointSlices []endpointSlice,
+) ([]string, error) {
+	svc := findService(services, namespace, serviceName)
+	if svc == nil {
+		return nil, fmt.Errorf("service not found: %s", serviceName)
+	}
+
+	svcPort := func() *servicePort {
+		for _, candidate := range svc.Spec.Ports {
+			if (port.Name != "" && candidate.Name == port.Name) || (port.Number != 0 && candidate.Port == port.Number) {
+				return &candidate
+			}
+		}
+
+		return nil
+	}()
+	if svcPort == nil {
+		return nil, fmt.Errorf("service %s doesn't have port %s", serviceName, describePort(port))
+	}
+
+	scheme := "http"
+	if svcPort.AppProtocol == "https" || svcPort.Name == "https" {
+		scheme = "https"
+	}
+
+	origins := []string{}
+
+	for _, slice := range endpointSlices {
+		if slice.Metadata.Namespace != namespace || slice.Metadata.Labels[serviceNameLabel] != serviceName {
+			continue
+		}
+
+		if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+			continue
+		}
+
+		// slice's port names refer to service port names (unnamed if the service has only one port)
+		targetPort := 0
+		for _, slicePort := range slice.Ports {
+			if slicePort.Name == svcPort.Name {
+				targetPort = slicePort.Port
+			}
+		}
+		if targetPort == 0 {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+
+			if len(endpoint.Addresses) == 0 {
+				continue
+			}
+
+			// "must be considered fungible", so one is enough
+			origins = append(origins, scheme+"://"+net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(targetPort)))
+		}
+	}
+
+	// endpoint slices come in no particular order. keep the app config stable.
+	sort.Strings(origins)
+
+	return origins, nil
+}
+
+// "<namespace>_<ingress>_<service>_<port>". ACLs can reference this, so it's deterministic.
+func appID(ingress ingress, serviceName string, port serviceBackendPort) string {
+	return strings.Join([]string{
+		ingress.Metadata.Namespace,
+		ingress.Metadata.Name,
+		serviceName,
+		describePort(port),
+	}, "_")
+}
+
+func describePort(port serviceBackendPort) string {
+	if port.Name != "" {
+		return port.Name
+	}
+
+	return strconv.Itoa(port.Number)
+}
+
+func findService(services []service, namespace string, name string) *service {
+	for _, svc := range services {
+		if svc.Metadata.Namespace == namespace && svc.Metadata.Name == name {
+			return &svc
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+// Discovers applications from Kubernetes Ingress objects
+package kubediscovery
+
+// We talk to the API with plain HTTP + JSON (like we do with Docker) instead of client-go, which
+// would be a massive dependency for listing three kinds of objects.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/function61/edgerouter/pkg/erdiscovery"
+	"github.com/function61/gokit/ezhttp"
+)
+
+const (
+	inClusterValue         = "in-cluster"
+	serviceAccountDir      = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultIngressClass    = "edgerouter"
+	ingressClassAnnotation = "kubernetes.io/ingress.class" // deprecated, but still widely used
+)
+
+func HasConfigInEnv() bool {
+	return os.Getenv("KUBERNETES_DISCOVERY") != ""
+}
+
+// configured with ENV:
+//   - KUBERNETES_DISCOVERY: "in-cluster" (use service account) or API URL (like "http://127.0.0.1:8001" from "$ kubectl proxy")
+//   - KUBERNETES_NAMESPACE: (optional) only discover from this namespace
+//   - KUBERNETES_INGRESS_CLASS: (optional) ingresses of this class (or without class) are ours. default "edgerouter"
+func New(logger *slog.Logger) (erdiscovery.Reader, error) {
+	apiURL, client, token, err := func() (string, *http.Client, func() (string, error), error) {
+		apiURL := os.Getenv("KUBERNETES_DISCOVERY")
+
+		if apiURL != inClusterValue {
+			return strings.TrimRight(apiURL, "/"), http.DefaultClient, noToken, nil
+		}
+
+		return inClusterConfig()
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("kubediscovery: %w", err)
+	}
+
+	ingressClass := os.Getenv("KUBERNETES_INGRESS_CLASS")
+	if ingressClass == "" {
+		ingressClass = defaultIngressClass
+	}
+
+	return &kubeDiscovery{
+		apiURL:       apiURL,
+		client:       client,
+		token:        token,
+		namespace:    os.Getenv("KUBERNETES_NAMESPACE"),
+		ingressClass: ingressClass,
+		logger:       logger.With("subsystem", "kubediscovery"),
+	}, nil
+}
+
+type kubeDiscovery struct {
+	apiURL       string
+	client       *http.Client
+	token        func() (string, error)
+	namespace    string // "" = all namespaces
+	ingressClass string
+	logger       *slog.Logger
+}
+
+// https://kubernetes.io/docs/tasks/run-application/access-api-from-pod/
+func inClusterConfig() (string, *http.Client, func() (string, error), error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", nil, nil, errors.New("in-cluster config requested but KUBERNETES_SERVICE_HOST or _PORT not set")
+	}
+
+	caCert, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	caCerts := x509.NewCertPool()
+	if !caCerts.AppendCertsFromPEM(caCert) {
+		return "", nil, nil, errors.New("no certificates found from service account's ca.crt")
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:    caCerts,
+				MinVersion: tls.VersionTLS12,
+			},
+		},
+	}
+
+	// re-read for each use, because Kubernetes rotates the (bound) service account tokens
+	token := func() (string, error) {
+		token, err := os.ReadFile(serviceAccountDir + "/token")
+		return strings.TrimSpace(string(token)), err
+	}
+
+	return "https://" + net.JoinHostPort(host, port), client, token, nil
+}
+
+func noToken() (string, error) {
+	return "", nil
+}
+
+func (k *kubeDiscovery) list(ctx context.Context, group string, resource string, result any) error {
+	token, err := k.token()
+	if err != nil {
+		return err
+	}
+
+	namespaced := ""
+	if k.namespace != "" {
+		namespaced = "/namespaces/" + k.namespace
+	}
+
+	// core group lives at "/api/v1", the rest at "/apis/<group>/<version>"
+	url := k.apiURL + "/apis/" + group + namespaced + "/" + resource
+	if group == "v1" {
+		url = k.apiURL + "/api/v1" + namespaced + "/" + resource
+	}
+
+	opts := []ezhttp.ConfigPiece{
+		ezhttp.Client(k.client),
+		ezhttp.RespondsJson(result, true),
+	}
+
+	if token != "" {
+		opts = append(opts, ezhttp.AuthBearer(token))
+	}
+
+	if _, err := ezhttp.Get(ctx, url, opts...); err != nil {
+		return fmt.Errorf("list %s: %w", resource, err)
+	}
+
+	return nil
+}
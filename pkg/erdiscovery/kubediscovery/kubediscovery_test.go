@@ -0,0 +1,205 @@
+package kubediscovery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+)
+
+func TestReadApplications(t *testing.T) {
+	fakeAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/apis/networking.k8s.io/v1/ingresses":
+			_, _ = io.WriteString(w, testIngresses)
+		case "/api/v1/services":
+			_, _ = io.WriteString(w, testServices)
+		case "/apis/discovery.k8s.io/v1/endpointslices":
+			_, _ = io.WriteString(w, testEndpointSlices)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer fakeAPI.Close()
+
+	discovery := &kubeDiscovery{
+		apiURL:       fakeAPI.URL,
+		client:       fakeAPI.Client(),
+		token:        func() (string, error) { return "s3cret", nil },
+		ingressClass: defaultIngressClass,
+		logger:       slogshim.NewWithOutput(io.Discard),
+	}
+
+	apps, err := discovery.ReadApplications(context.Background())
+	assert.Ok(t, err)
+
+	assert.EqualJson(t, apps, `[
+  {
+    "id": "default_web_web_http",
+    "frontends": [
+      {
+        "kind": "hostname",
+        "hostname": "example.com",
+        "path_prefix": "/"
+      },
+      {
+        "kind": "hostname_wildcard",
+        "hostname": "*.example.com",
+        "path_prefix": "/"
+      }
+    ],
+    "backend": {
+      "kind": "auth_v0",
+      "auth_v0_opts": {
+        "bearer_token": "Hunter2",
+        "authorized_backend": {
+          "kind": "reverse_proxy",
+          "reverse_proxy_opts": {
+            "origins": [
+              "http://10.42.0.10:8080",
+              "http://10.42.0.11:8080"
+            ],
+            "pass_host_header": true
+          }
+        }
+      }
+    }
+  },
+  {
+    "id": "default_web_api_443",
+    "frontends": [
+      {
+        "kind": "hostname",
+        "hostname": "example.com",
+        "path_prefix": "/api/"
+      }
+    ],
+    "backend": {
+      "kind": "auth_v0",
+      "auth_v0_opts": {
+        "bearer_token": "Hunter2",
+        "authorized_backend": {
+          "kind": "reverse_proxy",
+          "reverse_proxy_opts": {
+            "origins": [
+              "https://10.42.0.20:8443"
+            ],
+            "pass_host_header": true
+          }
+        }
+      }
+    }
+  }
+]`)
+}
+
+const testIngresses = `{
+  "kind": "IngressList",
+  "items": [
+    {
+      "metadata": {
+        "name": "web",
+        "namespace": "default",
+        "annotations": {
+          "edgerouter.auth": "bearer_token",
+          "edgerouter.auth_bearer_token": "Hunter2"
+        }
+      },
+      "spec": {
+        "rules": [
+          {
+            "host": "example.com",
+            "http": {
+              "paths": [
+                {"path": "/", "pathType": "Prefix", "backend": {"service": {"name": "web", "port": {"name": "http"}}}},
+                {"path": "/api/", "pathType": "Prefix", "backend": {"service": {"name": "api", "port": {"number": 443}}}}
+              ]
+            }
+          },
+          {
+            "host": "*.example.com",
+            "http": {
+              "paths": [
+                {"path": "/", "pathType": "Prefix", "backend": {"service": {"name": "web", "port": {"name": "http"}}}}
+              ]
+            }
+          }
+        ]
+      }
+    },
+    {
+      "metadata": {
+        "name": "someone-elses",
+        "namespace": "default"
+      },
+      "spec": {
+        "ingressClassName": "nginx",
+        "rules": [
+          {
+            "host": "nginx.example.com",
+            "http": {
+              "paths": [
+                {"path": "/", "pathType": "Prefix", "backend": {"service": {"name": "web", "port": {"name": "http"}}}}
+              ]
+            }
+          }
+        ]
+      }
+    }
+  ]
+}`
+
+const testServices = `{
+  "kind": "ServiceList",
+  "items": [
+    {
+      "metadata": {"name": "web", "namespace": "default"},
+      "spec": {"ports": [{"name": "http", "port": 80}]}
+    },
+    {
+      "metadata": {"name": "api", "namespace": "default"},
+      "spec": {"ports": [{"name": "metrics", "port": 9090}, {"name": "tls", "port": 443, "appProtocol": "https"}]}
+    }
+  ]
+}`
+
+const testEndpointSlices = `{
+  "kind": "EndpointSliceList",
+  "items": [
+    {
+      "metadata": {"name": "web-abc", "namespace": "default", "labels": {"kubernetes.io/service-name": "web"}},
+      "addressType": "IPv4",
+      "endpoints": [
+        {"addresses": ["10.42.0.11"], "conditions": {"ready": true}},
+        {"addresses": ["10.42.0.12"], "conditions": {"ready": false}},
+        {"addresses": ["10.42.0.10"]}
+      ],
+      "ports": [{"name": "http", "port": 8080}]
+    },
+    {
+      "metadata": {"name": "api-def", "namespace": "default", "labels": {"kubernetes.io/service-name": "api"}},
+      "addressType": "IPv4",
+      "endpoints": [
+        {"addresses": ["10.42.0.20"], "conditions": {"ready": true}}
+      ],
+      "ports": [{"name": "metrics", "port": 9090}, {"name": "tls", "port": 8443}]
+    },
+    {
+      "metadata": {"name": "web-other-ns", "namespace": "other", "labels": {"kubernetes.io/service-name": "web"}},
+      "addressType": "IPv4",
+      "endpoints": [
+        {"addresses": ["10.42.1.99"], "conditions": {"ready": true}}
+      ],
+      "ports": [{"name": "http", "port": 8080}]
+    }
+  ]
+}`
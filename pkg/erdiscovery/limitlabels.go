@@ -0,0 +1,44 @@
+package erdiscovery
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+)
+
+// concurrency limit as specified by "edgerouter.concurrency_limit.*" labels (Docker) or annotations
+// (Kubernetes). nil if not specified.
+func ConcurrencyLimitFromLabels(labels map[string]string) (*erconfig.ConcurrencyLimitPolicy, error) {
+	limit := &erconfig.ConcurrencyLimitPolicy{}
+	specified := false
+
+	for key, field := range map[string]*int{
+		"edgerouter.concurrency_limit.max_concurrent":        &limit.MaxConcurrent,
+		"edgerouter.concurrency_limit.max_queued":            &limit.MaxQueued,
+		"edgerouter.concurrency_limit.queue_timeout_seconds": &limit.QueueTimeoutSeconds,
+	} {
+		value, has := labels[key]
+		if !has {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+
+		*field = parsed
+		specified = true
+	}
+
+	if !specified {
+		return nil, nil
+	}
+
+	if err := limit.Validate(); err != nil {
+		return nil, fmt.Errorf("edgerouter.concurrency_limit: %w", err)
+	}
+
+	return limit, nil
+}
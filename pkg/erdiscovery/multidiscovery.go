@@ -4,9 +4,12 @@ import (
 	"context"
 
 	"github.com/function61/edgerouter/pkg/erconfig"
+	"golang.org/x/sync/errgroup"
 )
 
-// merges multiple discovery readers into one reader that returns them aggregated
+// merges multiple discovery readers into one reader that returns them aggregated.
+// the result is also a Watcher that fans in change notifications of the readers that are Watchers,
+// and an IPRulesReader that aggregates the readers that are IPRulesReaders.
 func MultiDiscovery(merge []Reader) Reader {
 	return &multiDiscovery{merge}
 }
@@ -15,6 +18,11 @@ type multiDiscovery struct {
 	readers []Reader
 }
 
+var (
+	_ Watcher       = (*multiDiscovery)(nil)
+	_ IPRulesReader = (*multiDiscovery)(nil)
+)
+
 func (m *multiDiscovery) ReadApplications(ctx context.Context) ([]erconfig.Application, error) {
 	merged := []erconfig.Application{}
 
@@ -29,3 +37,40 @@ func (m *multiDiscovery) ReadApplications(ctx context.Context) ([]erconfig.Appli
 
 	return merged, nil
 }
+
+func (m *multiDiscovery) ReadIPRules(ctx context.Context) ([]erconfig.IPRule, error) {
+	merged := []erconfig.IPRule{}
+
+	for _, reader := range m.readers {
+		if ipRulesReader, is := reader.(IPRulesReader); is {
+			result, err := ipRulesReader.ReadIPRules(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			merged = append(merged, result...)
+		}
+	}
+
+	return merged, nil
+}
+
+func (m *multiDiscovery) WatchChanges(ctx context.Context, changed chan<- struct{}) error {
+	watchers, watchersCtx := errgroup.WithContext(ctx)
+
+	for _, reader := range m.readers {
+		if watcher, is := reader.(Watcher); is {
+			watchers.Go(func() error {
+				return watcher.WatchChanges(watchersCtx, changed)
+			})
+		}
+	}
+
+	// if no reader is a watcher, keep the same "blocks until ctx canceled" semantics
+	watchers.Go(func() error {
+		<-watchersCtx.Done()
+		return nil
+	})
+
+	return watchers.Wait()
+}
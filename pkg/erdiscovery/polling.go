@@ -0,0 +1,151 @@
+package erdiscovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+)
+
+// wraps a Reader that can't notify of changes by itself (or whose reads are expensive) so that:
+//   - reads are cached for the interval (syncs triggered by *other* sources' notifications don't
+//     hit the wrapped source each time)
+//   - the source is polled every interval in the background and a change is notified when the
+//     result differs from the previous one
+//
+// if the wrapped reader is a Watcher, its notifications invalidate the cache and are passed through.
+func PollEvery(reader Reader, interval time.Duration, logger *slog.Logger) Reader {
+	return &pollingReader{
+		reader:   reader,
+		interval: interval,
+		now:      time.Now,
+		logger:   logger,
+	}
+}
+
+// duration from ENV (like "30s", "5m") or the default if not set
+func PollIntervalFromEnv(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+
+	if interval <= 0 {
+		return 0, fmt.Errorf("%s: must be positive; got %s", key, value)
+	}
+
+	return interval, nil
+}
+
+type pollingReader struct {
+	reader   Reader
+	interval time.Duration
+	now      func() time.Time
+	logger   *slog.Logger
+
+	mu     sync.Mutex
+	apps   []erconfig.Application
+	digest []byte
+	readAt time.Time // zero if cache invalid
+}
+
+var _ Watcher = (*pollingReader)(nil)
+
+func (p *pollingReader) ReadApplications(ctx context.Context) ([]erconfig.Application, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.readAt.IsZero() && p.now().Sub(p.readAt) < p.interval {
+		return p.apps, nil
+	}
+
+	if _, err := p.refreshLocked(ctx); err != nil {
+		return nil, err
+	}
+
+	return p.apps, nil
+}
+
+func (p *pollingReader) WatchChanges(ctx context.Context, changed chan<- struct{}) error {
+	innerChanged := make(chan struct{}, 1)
+
+	if watcher, is := p.reader.(Watcher); is {
+		go func() {
+			// we don't have a way to propagate this error and the default semantics are to block
+			// until ctx canceled anyway. polling goes on, so changes still get noticed.
+			if err := watcher.WatchChanges(ctx, innerChanged); err != nil {
+				p.logger.Error("watcher failed, falling back to polling", "error", err)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-innerChanged:
+			p.invalidate()
+
+			NotifyChanged(changed)
+		case <-ticker.C:
+			didChange, err := p.refresh(ctx)
+			if err != nil { // next sync will retry (and report) the error
+				p.invalidate()
+				continue
+			}
+
+			if didChange {
+				NotifyChanged(changed)
+			}
+		}
+	}
+}
+
+func (p *pollingReader) refresh(ctx context.Context) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.refreshLocked(ctx)
+}
+
+// expects lock to be held
+func (p *pollingReader) refreshLocked(ctx context.Context) (bool, error) {
+	apps, err := p.reader.ReadApplications(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	digest, err := json.Marshal(apps)
+	if err != nil {
+		return false, err
+	}
+
+	didChange := !bytes.Equal(digest, p.digest)
+
+	p.apps = apps
+	p.digest = digest
+	p.readAt = p.now()
+
+	return didChange, nil
+}
+
+func (p *pollingReader) invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.readAt = time.Time{}
+}
@@ -0,0 +1,101 @@
+package erdiscovery
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+)
+
+func TestPollEveryCaches(t *testing.T) {
+	ctx := context.Background()
+
+	source := &countingReader{apps: []erconfig.Application{{ID: "a"}}}
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	polling := PollEvery(source, time.Minute, slogshim.NewWithOutput(io.Discard)).(*pollingReader)
+	polling.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		apps, err := polling.ReadApplications(ctx)
+		assert.Ok(t, err)
+		assert.EqualString(t, apps[0].ID, "a")
+	}
+
+	assert.EqualInt(t, source.reads, 1)
+
+	now = now.Add(time.Minute)
+
+	_, err := polling.ReadApplications(ctx)
+	assert.Ok(t, err)
+	assert.EqualInt(t, source.reads, 2)
+}
+
+func TestPollEveryNotifiesOnChange(t *testing.T) {
+	source := &countingReader{apps: []erconfig.Application{{ID: "a"}}}
+
+	polling := PollEvery(source, 10*time.Millisecond, slogshim.NewWithOutput(io.Discard))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := polling.ReadApplications(ctx)
+	assert.Ok(t, err)
+
+	changed := make(chan struct{}, 1)
+
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- polling.(Watcher).WatchChanges(ctx, changed)
+	}()
+
+	// same result => no notification
+	select {
+	case <-changed:
+		t.Fatal("unexpected change notification")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	source.set([]erconfig.Application{{ID: "a"}, {ID: "b"}})
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected change notification")
+	}
+
+	apps, err := polling.ReadApplications(ctx)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(apps), 2)
+
+	cancel()
+	assert.Ok(t, <-watchDone)
+}
+
+type countingReader struct {
+	apps  []erconfig.Application
+	reads int
+	mu    sync.Mutex
+}
+
+func (c *countingReader) ReadApplications(_ context.Context) ([]erconfig.Application, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reads++
+
+	return c.apps, nil
+}
+
+func (c *countingReader) set(apps []erconfig.Application) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.apps = apps
+}
@@ -9,6 +9,9 @@ import (
 var Types = ehevent.Allocators{
 	"AppUpdated": func() ehevent.Event { return &AppUpdated{} },
 	"AppDeleted": func() ehevent.Event { return &AppDeleted{} },
+
+	"IPRuleAdded":   func() ehevent.Event { return &IPRuleAdded{} },
+	"IPRuleRemoved": func() ehevent.Event { return &IPRuleRemoved{} },
 }
 
 // ------
@@ -50,3 +53,44 @@ func NewAppDeleted(
 		ID:   id,
 	}
 }
+
+// ------
+
+// replaces the rule if one already exists for the prefix
+type IPRuleAdded struct {
+	meta ehevent.EventMeta
+	Rule erconfig.IPRule
+}
+
+func (e *IPRuleAdded) MetaType() string         { return "IPRuleAdded" }
+func (e *IPRuleAdded) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewIPRuleAdded(
+	rule erconfig.IPRule,
+	meta ehevent.EventMeta,
+) *IPRuleAdded {
+	return &IPRuleAdded{
+		meta: meta,
+		Rule: rule,
+	}
+}
+
+// ------
+
+type IPRuleRemoved struct {
+	meta   ehevent.EventMeta
+	Prefix string
+}
+
+func (e *IPRuleRemoved) MetaType() string         { return "IPRuleRemoved" }
+func (e *IPRuleRemoved) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewIPRuleRemoved(
+	prefix string,
+	meta ehevent.EventMeta,
+) *IPRuleRemoved {
+	return &IPRuleRemoved{
+		meta:   meta,
+		Prefix: prefix,
+	}
+}
@@ -0,0 +1,382 @@
+package erserver
+
+// Access log: one entry per request, written to any number of sinks (stdout, rotating file,
+// syslog, raw UDP for log shippers like Vector). Apps can opt out, exclude their noisy paths
+// (health checks etc.) or be sampled, see erconfig.AccessLogPolicy.
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/function61/edgerouter/pkg/erconfig"
+)
+
+type accessLogFormat string
+
+const (
+	accessLogFormatJSON     accessLogFormat = "json"
+	accessLogFormatCommon   accessLogFormat = "common"   // NCSA Common Log Format
+	accessLogFormatCombined accessLogFormat = "combined" // Common + referer and user agent
+)
+
+type accessLogEntry struct {
+	time        time.Time // when the request was received
+	appID       string    // empty if no app matched
+	frontend    string
+	backendKind erconfig.BackendKind
+	method      string
+	host        string
+	uri         string // as the client sent it
+	path        string // for exclusion. (the URI's path, before prefix stripping)
+	proto       string
+	status      int
+	bytes       int64
+	duration    time.Duration
+	clientIP    string
+	tlsVersion  string // empty if not TLS
+	user        string // from the auth backend
+	referer     string
+	userAgent   string
+}
+
+type accessLog struct {
+	format accessLogFormat
+	out    io.Writer // each Write() is one entry
+	json   slog.Handler
+	random func() float64 // for sampling
+}
+
+// configured with ENV:
+//   - ACCESS_LOG: comma-separated sinks. unset = no access log. supported sinks:
+//     "stdout", "file:/var/log/edgerouter/access.log", "syslog:10.0.0.5:514" (UDP) and "udp:10.0.0.5:9000"
+//   - ACCESS_LOG_FORMAT: "json" (default), "common" or "combined"
+//   - ACCESS_LOG_FILE_MAX_SIZE_MB: (optional) file is rotated when it reaches this size. default 100
+//   - ACCESS_LOG_FILE_MAX_BACKUPS: (optional) how many rotated files to keep. default 5
+func accessLogFromEnv() (*accessLog, error) {
+	sinkSpecs := os.Getenv("ACCESS_LOG")
+	if sinkSpecs == "" {
+		return nil, nil
+	}
+
+	format := accessLogFormat(os.Getenv("ACCESS_LOG_FORMAT"))
+	switch format {
+	case "":
+		format = accessLogFormatJSON
+	case accessLogFormatJSON, accessLogFormatCommon, accessLogFormatCombined:
+	default:
+		return nil, fmt.Errorf("ACCESS_LOG_FORMAT: unsupported format: %s", format)
+	}
+
+	maxSizeMB, err := intFromEnv("ACCESS_LOG_FILE_MAX_SIZE_MB", 100)
+	if err != nil {
+		return nil, err
+	}
+
+	maxBackups, err := intFromEnv("ACCESS_LOG_FILE_MAX_BACKUPS", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	sinks := []io.Writer{}
+
+	for _, sinkSpec := range strings.Split(sinkSpecs, ",") {
+		sink, err := openAccessLogSink(strings.TrimSpace(sinkSpec), int64(maxSizeMB)*1024*1024, maxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("ACCESS_LOG: %s: %w", sinkSpec, err)
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	return newAccessLog(format, fanOutWriter(sinks)), nil
+}
+
+func newAccessLog(format accessLogFormat, out io.Writer) *accessLog {
+	return &accessLog{
+		format: format,
+		out:    out,
+		json: slog.NewJSONHandler(out, &slog.HandlerOptions{
+			ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+				if len(groups) == 0 && (attr.Key == slog.LevelKey || attr.Key == slog.MessageKey) {
+					return slog.Attr{} // not meaningful for access log entries
+				}
+
+				return attr
+			},
+		}),
+		random: rand.Float64,
+	}
+}
+
+func openAccessLogSink(sinkSpec string, fileMaxSize int64, fileMaxBackups int) (io.Writer, error) {
+	kind, arg, _ := strings.Cut(sinkSpec, ":")
+
+	switch kind {
+	case "stdout":
+		return os.Stdout, nil
+	case "file":
+		return openRotatingFile(arg, fileMaxSize, fileMaxBackups)
+	case "syslog":
+		return syslog.Dial("udp", arg, syslog.LOG_INFO|syslog.LOG_LOCAL0, "edgerouter")
+	case "udp":
+		return net.Dial("udp", arg)
+	default:
+		return nil, fmt.Errorf("unsupported sink: %s", kind)
+	}
+}
+
+// the request's entry, if the app wants it logged
+func (a *accessLog) Log(entry accessLogEntry, policy *erconfig.AccessLogPolicy) {
+	if !a.shouldLog(entry, policy) {
+		return
+	}
+
+	switch a.format {
+	case accessLogFormatJSON:
+		record := slog.NewRecord(entry.time, slog.LevelInfo, "", 0)
+		record.AddAttrs(
+			slog.String("app", entry.appID),
+			slog.String("frontend", entry.frontend),
+			slog.String("backend", string(entry.backendKind)),
+			slog.String("method", entry.method),
+			slog.String("host", entry.host),
+			slog.String("uri", entry.uri),
+			slog.String("proto", entry.proto),
+			slog.Int("status", entry.status),
+			slog.Int64("bytes", entry.bytes),
+			slog.Float64("duration_ms", float64(entry.duration.Microseconds())/1000),
+			slog.String("client_ip", entry.clientIP),
+			slog.String("tls", entry.tlsVersion),
+			slog.String("user", entry.user),
+			slog.String("referer", entry.referer),
+			slog.String("user_agent", entry.userAgent))
+
+		_ = a.json.Handle(context.Background(), record)
+	case accessLogFormatCommon, accessLogFormatCombined:
+		_, _ = a.out.Write([]byte(formatCommonLogLine(entry, a.format == accessLogFormatCombined)))
+	}
+}
+
+func (a *accessLog) shouldLog(entry accessLogEntry, policy *erconfig.AccessLogPolicy) bool {
+	if policy == nil {
+		return true
+	}
+
+	if policy.Disabled {
+		return false
+	}
+
+	for _, excluded := range policy.ExcludePaths {
+		if entry.path == excluded || strings.HasPrefix(entry.path, strings.TrimSuffix(excluded, "/")+"/") {
+			return false
+		}
+	}
+
+	if policy.SampleRate > 0 && entry.status < 400 { // failures are interesting enough to always log
+		return a.random() < policy.SampleRate
+	}
+
+	return true
+}
+
+// 1.2.3.4 - joonas [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"
+func formatCommonLogLine(entry accessLogEntry, combined bool) string {
+	dashIfEmpty := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+
+		return value
+	}
+
+	bytes := "-"
+	if entry.bytes > 0 {
+		bytes = strconv.FormatInt(entry.bytes, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s",
+		dashIfEmpty(entry.clientIP),
+		dashIfEmpty(strings.ReplaceAll(entry.user, " ", "_")), // field is space-separated
+		entry.time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(entry.method+" "+entry.uri+" "+entry.proto),
+		entry.status,
+		bytes)
+
+	if combined {
+		line += fmt.Sprintf(" %s %s", strconv.Quote(dashIfEmpty(entry.referer)), strconv.Quote(dashIfEmpty(entry.userAgent)))
+	}
+
+	return line + "\n"
+}
+
+// request and mount can be inspected only after the request was served, but r.URL.Path
+// must be read before serving (prefix stripping changes it)
+func newAccessLogEntry(
+	r *http.Request,
+	path string,
+	started time.Time,
+	mount *Mount,
+	stats httpsnoop.Metrics,
+	user string,
+) accessLogEntry {
+	entry := accessLogEntry{
+		time:      started,
+		method:    r.Method,
+		host:      r.Host,
+		uri:       r.RequestURI,
+		path:      path,
+		proto:     r.Proto,
+		status:    stats.Code,
+		bytes:     stats.Written,
+		duration:  stats.Duration,
+		user:      user,
+		referer:   r.Referer(),
+		userAgent: r.UserAgent(),
+	}
+
+	if mount != nil {
+		entry.appID = mount.App.ID
+		entry.frontend = mount.frontend
+		entry.backendKind = mount.App.Backend.Kind
+	}
+
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.clientIP = clientIP
+	}
+
+	if r.TLS != nil {
+		entry.tlsVersion = tls.VersionName(r.TLS.Version)
+	}
+
+	return entry
+}
+
+// a failing sink (e.g. full disk) must not affect the others (nor the request)
+type fanOutWriter []io.Writer
+
+func (f fanOutWriter) Write(p []byte) (int, error) {
+	for _, sink := range f {
+		_, _ = sink.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// log file that's rotated (access.log -> access.log.1 -> access.log.2 ..) when it'd grow too big
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if path == "" {
+		return nil, errors.New("path required")
+	}
+
+	if maxSize <= 0 || maxBackups < 1 {
+		return nil, errors.New("max size and max backups must be positive")
+	}
+
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	renameErr := func() error {
+		// oldest one gets overwritten
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			if err := os.Rename(r.backupPath(i), r.backupPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+
+		return os.Rename(r.path, r.backupPath(1))
+	}()
+
+	// even if renaming failed, so we can keep logging (to the too big file)
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	return renameErr
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = info.Size()
+
+	return nil
+}
+
+func (r *rotatingFile) backupPath(number int) string {
+	return fmt.Sprintf("%s.%d", r.path, number)
+}
+
+func intFromEnv(key string, defaultValue int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+
+	return parsed, nil
+}
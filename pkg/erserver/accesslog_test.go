@@ -0,0 +1,110 @@
+package erserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/gokit/assert"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/docs/Main%20Page?action=edit", nil)
+	req.Host = "wiki.example.com"
+	req.RemoteAddr = "203.0.113.9:41234"
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13}
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("User-Agent", `curl/8.0 "quoted"`)
+
+	mount := &Mount{
+		App: erconfig.SimpleApplication(
+			"wiki",
+			erconfig.SimpleHostnameFrontend("wiki.example.com"),
+			erconfig.ReverseProxyBackend([]string{"http://127.0.0.1:8080"}, nil, false)),
+		frontend: "hostname:wiki.example.com/",
+	}
+
+	entry := newAccessLogEntry(
+		req,
+		req.URL.Path,
+		time.Date(2024, 3, 1, 13, 55, 36, 0, time.UTC),
+		mount,
+		httpsnoop.Metrics{Code: 200, Written: 2326, Duration: 1500 * time.Microsecond},
+		"joonas")
+
+	logLine := func(format accessLogFormat) string {
+		out := &bytes.Buffer{}
+		newAccessLog(format, out).Log(entry, nil)
+		return out.String()
+	}
+
+	assert.EqualString(t, logLine(accessLogFormatJSON), `{"time":"2024-03-01T13:55:36Z","app":"wiki","frontend":"hostname:wiki.example.com/","backend":"reverse_proxy","method":"GET","host":"wiki.example.com","uri":"/docs/Main%20Page?action=edit","proto":"HTTP/1.1","status":200,"bytes":2326,"duration_ms":1.5,"client_ip":"203.0.113.9","tls":"TLS 1.3","user":"joonas","referer":"https://example.com/","user_agent":"curl/8.0 \"quoted\""}
+`)
+	assert.EqualString(t, logLine(accessLogFormatCommon), `203.0.113.9 - joonas [01/Mar/2024:13:55:36 +0000] "GET /docs/Main%20Page?action=edit HTTP/1.1" 200 2326
+`)
+	assert.EqualString(t, logLine(accessLogFormatCombined), `203.0.113.9 - joonas [01/Mar/2024:13:55:36 +0000] "GET /docs/Main%20Page?action=edit HTTP/1.1" 200 2326 "https://example.com/" "curl/8.0 \"quoted\""
+`)
+
+	// no app matched
+	entry = newAccessLogEntry(req, "/", time.Date(2024, 3, 1, 13, 55, 36, 0, time.UTC), nil, httpsnoop.Metrics{Code: 404}, "")
+	assert.EqualString(t, logLine(accessLogFormatCommon), `203.0.113.9 - - [01/Mar/2024:13:55:36 +0000] "GET /docs/Main%20Page?action=edit HTTP/1.1" 404 -
+`)
+}
+
+func TestAccessLogPolicy(t *testing.T) {
+	accessLog := newAccessLog(accessLogFormatJSON, &bytes.Buffer{})
+	accessLog.random = func() float64 { return 0.5 }
+
+	logged := func(path string, status int, policy *erconfig.AccessLogPolicy) bool {
+		assert.Ok(t, policy.Validate())
+
+		return accessLog.shouldLog(accessLogEntry{path: path, status: status}, policy)
+	}
+
+	assert.Assert(t, logged("/", 200, &erconfig.AccessLogPolicy{}))
+	assert.Assert(t, !logged("/", 500, &erconfig.AccessLogPolicy{Disabled: true}))
+
+	healthChecksExcluded := &erconfig.AccessLogPolicy{ExcludePaths: []string{"/healthz", "/metrics/"}}
+	assert.Assert(t, !logged("/healthz", 200, healthChecksExcluded))
+	assert.Assert(t, !logged("/healthz/ready", 200, healthChecksExcluded))
+	assert.Assert(t, logged("/healthzz", 200, healthChecksExcluded))
+	assert.Assert(t, !logged("/metrics/node", 200, healthChecksExcluded))
+
+	assert.Assert(t, !logged("/", 200, &erconfig.AccessLogPolicy{SampleRate: 0.4}))
+	assert.Assert(t, logged("/", 200, &erconfig.AccessLogPolicy{SampleRate: 0.6}))
+	assert.Assert(t, logged("/", 503, &erconfig.AccessLogPolicy{SampleRate: 0.4})) // failures always
+
+	assert.EqualString(t, (&erconfig.AccessLogPolicy{SampleRate: 2}).Validate().Error(), "SampleRate: must be between 0 and 1; got 2")
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	file, err := openRotatingFile(path, 10, 2)
+	assert.Ok(t, err)
+
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		_, err := file.Write([]byte(line))
+		assert.Ok(t, err)
+	}
+
+	content := func(path string) string {
+		data, err := os.ReadFile(path)
+		assert.Ok(t, err)
+		return string(data)
+	}
+
+	assert.EqualString(t, content(path), "line4\n")
+	assert.EqualString(t, content(path+".1"), "line3\n")
+	assert.EqualString(t, content(path+".2"), "line2\n") // line1 was rotated away
+
+	_, err = os.Stat(path + ".3")
+	assert.Assert(t, os.IsNotExist(err))
+}
@@ -0,0 +1,91 @@
+package erserver
+
+// Built-in ACME client (Let's Encrypt etc.) as an alternative to CertBus. Certificates are issued
+// on-demand on the first TLS handshake for a hostname, but only for hostnames of discovered
+// (exact) hostname frontends. Wildcards would need the DNS-01 challenge, which we don't support.
+//
+// Both HTTP-01 (answered via a path prefix mount, see acmeChallengeApp()) and TLS-ALPN-01
+// challenges are supported, so it's enough for either :80 or :443 to be reachable by the CA.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	acmeChallengeAppID = "acme-challenge"
+)
+
+func acmeConfigured() bool {
+	return os.Getenv("ACME_EMAIL") != ""
+}
+
+// configured with ENV:
+//   - ACME_EMAIL: contact address for the CA's expiry notices etc.
+//   - ACME_DIRECTORY_URL: (optional) defaults to Let's Encrypt's production
+func newAcmeManagerFromEnv(configDir ConfigDir, currentConfig erconfig.CurrentConfigAccessor) *autocert.Manager {
+	directoryURL := os.Getenv("ACME_DIRECTORY_URL")
+	if directoryURL == "" {
+		directoryURL = autocert.DefaultACMEDirectory
+	}
+
+	return newAcmeManager(
+		configDir.File("acme"),
+		os.Getenv("ACME_EMAIL"),
+		&acme.Client{DirectoryURL: directoryURL},
+		currentConfig)
+}
+
+func newAcmeManager(
+	cacheDir string,
+	email string,
+	client *acme.Client,
+	currentConfig erconfig.CurrentConfigAccessor,
+) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(cacheDir), // certificates + ACME account key
+		Email:  email,
+		Client: client,
+		HostPolicy: func(_ context.Context, host string) error {
+			return acmeHostAllowed(host, currentConfig.Apps())
+		},
+	}
+}
+
+// without this anyone could make us request (and hit the CA's rate limits with) certificates for
+// any hostname that resolves to us
+func acmeHostAllowed(host string, apps []erconfig.Application) error {
+	for _, app := range apps {
+		for _, frontend := range app.Frontends {
+			if frontend.Kind == erconfig.FrontendKindHostname && frontend.Hostname == host {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("no hostname frontend for %s", host)
+}
+
+// the HTTP-01 challenge is served for every hostname (the CA connects to http://<hostname>/.well-known/acme-challenge/<token>)
+func acmeChallengeApp() erconfig.Application {
+	return erconfig.SimpleApplication(
+		acmeChallengeAppID,
+		erconfig.PathPrefixFrontend("/.well-known/acme-challenge/", erconfig.AllowInsecureHTTP),
+		erconfig.AcmeChallengeBackend())
+}
+
+// acmeChallengeHandler is nil if our ACME client is not in use
+func newAcmeChallengeBackend(acmeChallengeHandler http.Handler) (http.Handler, error) {
+	if acmeChallengeHandler == nil {
+		return nil, fmt.Errorf("%s backend requires ACME to be configured (ACME_EMAIL)", erconfig.BackendKindAcmeChallenge)
+	}
+
+	return acmeChallengeHandler, nil
+}
@@ -0,0 +1,306 @@
+package erserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/gokit/assert"
+	"golang.org/x/crypto/acme"
+)
+
+func TestAcme(t *testing.T) {
+	currentConfig := newAtomicConfig()
+
+	// HTTP-01 validation goes through the same mount resolving as real requests do
+	validateHTTP01 := func(hostname string, token string) (string, error) {
+		r := httptest.NewRequest(http.MethodGet, "http://"+hostname+"/.well-known/acme-challenge/"+token, nil)
+
+		mount := resolveMount(hostname, r, currentConfig.Load().(*frontendMatchers))
+		if mount == nil {
+			return "", fmt.Errorf("no mount for %s", r.URL.String())
+		}
+
+		res := httptest.NewRecorder()
+		mount.backend.ServeHTTP(res, r)
+
+		return res.Body.String(), nil
+	}
+
+	ca := newFakeAcmeServer(t, validateHTTP01)
+	defer ca.Close()
+
+	manager := newAcmeManager(
+		t.TempDir(),
+		"admin@example.com",
+		&acme.Client{DirectoryURL: ca.URL + "/directory", HTTPClient: ca.Client()},
+		currentConfig)
+
+	apps := []erconfig.Application{
+		erconfig.SimpleApplication(
+			"web",
+			erconfig.SimpleHostnameFrontend("example.com"),
+			erconfig.RedirectBackend("http://example.net/")),
+		erconfig.SimpleApplication(
+			"wildcard",
+			erconfig.WildcardHostnameFrontend("*.example.com"),
+			erconfig.RedirectBackend("http://example.net/")),
+		acmeChallengeApp(),
+	}
+
+	matchers := appConfigToHandlersAndMatchers(
+		context.Background(),
+		apps,
+		nil,
+		currentConfig,
+		manager.HTTPHandler(http.NotFoundHandler()),
+		time.Now(),
+		nil)
+	assert.EqualString(t, rejectedErrors(matchers), "")
+	currentConfig.Store(matchers)
+
+	hello := func(serverName string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName:       serverName,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		}
+	}
+
+	cert, err := manager.GetCertificate(hello("example.com"))
+	assert.Ok(t, err)
+	assert.EqualString(t, strings.Join(cert.Leaf.DNSNames, ","), "example.com")
+	assert.Assert(t, ca.validations == 1)
+
+	// second handshake is served from cache
+	_, err = manager.GetCertificate(hello("example.com"))
+	assert.Ok(t, err)
+	assert.Assert(t, ca.validations == 1)
+
+	_, err = manager.GetCertificate(hello("foo.example.com"))
+	assert.EqualString(t, err.Error(), "no hostname frontend for foo.example.com")
+
+	_, err = manager.GetCertificate(hello("notours.net"))
+	assert.EqualString(t, err.Error(), "no hostname frontend for notours.net")
+}
+
+// minimal stand-in for a CA (like Pebble, but in-process). does not verify JWS signatures.
+type fakeAcmeServer struct {
+	*httptest.Server
+	t              *testing.T
+	validateHTTP01 func(hostname string, token string) (string, error)
+	caKey          *ecdsa.PrivateKey
+	caCert         *x509.Certificate
+
+	mu          sync.Mutex
+	hostname    string // of the current order
+	authzValid  bool
+	certPEM     []byte
+	nonce       int
+	validations int
+}
+
+func newFakeAcmeServer(t *testing.T, validateHTTP01 func(string, string) (string, error)) *fakeAcmeServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Ok(t, err)
+
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.Ok(t, err)
+
+	f := &fakeAcmeServer{
+		t:              t,
+		validateHTTP01: validateHTTP01,
+		caKey:          caKey,
+		caCert:         caCert,
+	}
+
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.serveHTTP))
+
+	return f
+}
+
+func (f *fakeAcmeServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", f.nonce))
+
+	url := func(path string) string { return f.URL + path }
+
+	respond := func(status int, body any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		assert.Ok(f.t, json.NewEncoder(w).Encode(body))
+	}
+
+	order := func() map[string]any {
+		status := "pending"
+		switch {
+		case f.certPEM != nil:
+			status = "valid"
+		case f.authzValid:
+			status = "ready"
+		}
+
+		w.Header().Set("Location", url("/order/1"))
+
+		return map[string]any{
+			"status":         status,
+			"identifiers":    []any{map[string]string{"type": "dns", "value": f.hostname}},
+			"authorizations": []string{url("/authz/1")},
+			"finalize":       url("/finalize/1"),
+			"certificate":    url("/cert/1"),
+		}
+	}
+
+	authz := func() map[string]any {
+		status := "pending"
+		if f.authzValid {
+			status = "valid"
+		}
+
+		return map[string]any{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": f.hostname},
+			"challenges": []any{map[string]string{ // only HTTP-01 offered, so we know it works
+				"type":   "http-01",
+				"url":    url("/chal/1"),
+				"token":  "token1",
+				"status": status,
+			}},
+		}
+	}
+
+	payload := f.jwsPayload(r)
+
+	switch r.URL.Path {
+	case "/directory":
+		respond(http.StatusOK, map[string]string{
+			"newNonce":   url("/nonce"),
+			"newAccount": url("/account"),
+			"newOrder":   url("/order"),
+			"revokeCert": url("/revoke"),
+			"keyChange":  url("/keychange"),
+		})
+	case "/nonce":
+		w.WriteHeader(http.StatusOK)
+	case "/account":
+		w.Header().Set("Location", url("/account/1"))
+		respond(http.StatusCreated, map[string]any{"status": "valid"})
+	case "/order":
+		req := struct {
+			Identifiers []struct {
+				Value string `json:"value"`
+			} `json:"identifiers"`
+		}{}
+		assert.Ok(f.t, json.Unmarshal(payload, &req))
+
+		f.hostname = req.Identifiers[0].Value
+		f.authzValid = false
+		f.certPEM = nil
+
+		respond(http.StatusCreated, order())
+	case "/order/1":
+		respond(http.StatusOK, order())
+	case "/authz/1":
+		respond(http.StatusOK, authz())
+	case "/chal/1":
+		f.validations++
+
+		keyAuthorization, err := f.validateHTTP01(f.hostname, "token1")
+		assert.Ok(f.t, err)
+		assert.Assert(f.t, strings.HasPrefix(keyAuthorization, "token1."))
+
+		f.authzValid = true
+
+		respond(http.StatusOK, authz()["challenges"].([]any)[0])
+	case "/finalize/1":
+		req := struct {
+			CSR string `json:"csr"`
+		}{}
+		assert.Ok(f.t, json.Unmarshal(payload, &req))
+
+		f.certPEM = f.sign(req.CSR)
+
+		respond(http.StatusOK, order())
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(f.certPEM)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAcmeServer) jwsPayload(r *http.Request) []byte {
+	if r.Method != http.MethodPost {
+		return nil
+	}
+
+	jws := struct {
+		Payload string `json:"payload"`
+	}{}
+	body, err := io.ReadAll(r.Body)
+	assert.Ok(f.t, err)
+	assert.Ok(f.t, json.Unmarshal(body, &jws))
+
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	assert.Ok(f.t, err)
+
+	return payload
+}
+
+func (f *fakeAcmeServer) sign(csrBase64 string) []byte {
+	csrDER, err := base64.RawURLEncoding.DecodeString(csrBase64)
+	assert.Ok(f.t, err)
+
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	assert.Ok(f.t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, f.caCert, csr.PublicKey, f.caKey)
+	assert.Ok(f.t, err)
+
+	return append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+}
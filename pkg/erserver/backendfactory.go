@@ -8,6 +8,10 @@ import (
 	"log/slog"
 	"net/http"
 
+	"github.com/function61/edgerouter/pkg/erbackend/authbasicbackend"
+	"github.com/function61/edgerouter/pkg/erbackend/authforwardbackend"
+	"github.com/function61/edgerouter/pkg/erbackend/authmtlsbackend"
+	"github.com/function61/edgerouter/pkg/erbackend/authoidcbackend"
 	"github.com/function61/edgerouter/pkg/erbackend/authssobackend"
 	"github.com/function61/edgerouter/pkg/erbackend/authv0backend"
 	"github.com/function61/edgerouter/pkg/erbackend/edgerouteradminbackend"
@@ -27,6 +31,7 @@ func makeBackend(
 	appID string,
 	backendConf erconfig.Backend,
 	currentConfig erconfig.CurrentConfigAccessor,
+	acmeChallengeHandler http.Handler,
 	parentLogger *slog.Logger,
 ) (http.Handler, error) {
 	configDigest, err := json.Marshal(backendConf)
@@ -37,11 +42,17 @@ func makeBackend(
 	// only make new instance if config JSON has changed for this app ID
 	cached := bendCache.Find(appID, configDigest)
 	if cached == nil {
-		backend, err := makeBackendInternal(ctx, appID, backendConf, currentConfig, parentLogger)
+		backend, err := makeBackendInternal(ctx, appID, backendConf, currentConfig, acmeChallengeHandler, parentLogger)
 		if err != nil {
 			return nil, err
 		}
 
+		// a reverse proxy re-declares its origins' health checks (and metrics) when it's made, but
+		// other kinds of backends would leave the previous ones running
+		if !hasReverseProxy(backendConf) {
+			reverseproxybackend.ForgetApp(appID)
+		}
+
 		cached = &cacheEntry{
 			backend:      backend,
 			configDigest: configDigest,
@@ -58,6 +69,28 @@ func makeBackendInternal(
 	appID string,
 	backendConf erconfig.Backend,
 	currentConfig erconfig.CurrentConfigAccessor,
+	acmeChallengeHandler http.Handler,
+	parentLogger *slog.Logger,
+) (http.Handler, error) {
+	backend, err := makeBackendOfKind(ctx, appID, backendConf, currentConfig, acmeChallengeHandler, parentLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isAuthBackend(backendConf.Kind) {
+		backend = withUserRateLimit(backend)
+	}
+
+	return withBackendSpan(backend, string(backendConf.Kind)), nil
+}
+
+// (authorized backends of auth backends are made with makeBackendInternal(), so they get their own spans)
+func makeBackendOfKind(
+	ctx context.Context,
+	appID string,
+	backendConf erconfig.Backend,
+	currentConfig erconfig.CurrentConfigAccessor,
+	acmeChallengeHandler http.Handler,
 	parentLogger *slog.Logger,
 ) (http.Handler, error) {
 	appSpecificLogger := func() *slog.Logger { // helper
@@ -66,7 +99,7 @@ func makeBackendInternal(
 
 	switch backendConf.Kind {
 	case erconfig.BackendKindS3StaticWebsite:
-		return statics3websitebackend.New(appID, *backendConf.S3StaticWebsiteOpts)
+		return statics3websitebackend.New(appID, *backendConf.S3StaticWebsiteOpts, appSpecificLogger())
 	case erconfig.BackendKindReverseProxy:
 		return reverseproxybackend.New(ctx, appID, *backendConf.ReverseProxyOpts, appSpecificLogger())
 	case erconfig.BackendKindAwsLambda:
@@ -83,31 +116,109 @@ func makeBackendInternal(
 			appID,
 			*backendConf.AuthV0Opts.AuthorizedBackend,
 			currentConfig,
+			acmeChallengeHandler,
 			parentLogger)
 		if err != nil {
 			return nil, fmt.Errorf("authorizedBackend: %w", err)
 		}
 
 		return authv0backend.New(*backendConf.AuthV0Opts, authorizedBackend), nil
+	case erconfig.BackendKindAuthBasic:
+		authorizedBackend, err := makeBackendInternal(
+			ctx,
+			appID,
+			*backendConf.AuthBasicOpts.AuthorizedBackend,
+			currentConfig,
+			acmeChallengeHandler,
+			parentLogger)
+		if err != nil {
+			return nil, fmt.Errorf("authorizedBackend: %w", err)
+		}
+
+		return authbasicbackend.New(*backendConf.AuthBasicOpts, authorizedBackend), nil
 	case erconfig.BackendKindAuthSso:
 		authorizedBackend, err := makeBackendInternal(
 			ctx,
 			appID,
 			*backendConf.AuthSsoOpts.AuthorizedBackend,
 			currentConfig,
+			acmeChallengeHandler,
 			parentLogger)
 		if err != nil {
 			return nil, fmt.Errorf("authorizedBackend: %w", err)
 		}
 
 		return authssobackend.New(*backendConf.AuthSsoOpts, authorizedBackend)
+	case erconfig.BackendKindAuthMtls:
+		authorizedBackend, err := makeBackendInternal(
+			ctx,
+			appID,
+			*backendConf.AuthMtlsOpts.AuthorizedBackend,
+			currentConfig,
+			acmeChallengeHandler,
+			parentLogger)
+		if err != nil {
+			return nil, fmt.Errorf("authorizedBackend: %w", err)
+		}
+
+		return authmtlsbackend.New(*backendConf.AuthMtlsOpts, authorizedBackend)
+	case erconfig.BackendKindAuthForward:
+		authorizedBackend, err := makeBackendInternal(
+			ctx,
+			appID,
+			*backendConf.AuthForwardOpts.AuthorizedBackend,
+			currentConfig,
+			acmeChallengeHandler,
+			parentLogger)
+		if err != nil {
+			return nil, fmt.Errorf("authorizedBackend: %w", err)
+		}
+
+		return authforwardbackend.New(*backendConf.AuthForwardOpts, authorizedBackend, appSpecificLogger()), nil
+	case erconfig.BackendKindAuthOidc:
+		authorizedBackend, err := makeBackendInternal(
+			ctx,
+			appID,
+			*backendConf.AuthOidcOpts.AuthorizedBackend,
+			currentConfig,
+			acmeChallengeHandler,
+			parentLogger)
+		if err != nil {
+			return nil, fmt.Errorf("authorizedBackend: %w", err)
+		}
+
+		return authoidcbackend.New(*backendConf.AuthOidcOpts, authorizedBackend, appSpecificLogger()), nil
 	case erconfig.BackendKindPromMetrics:
 		return promhttp.Handler(), nil
+	case erconfig.BackendKindAcmeChallenge:
+		return newAcmeChallengeBackend(acmeChallengeHandler)
 	default:
 		return nil, fmt.Errorf("unsupported backend kind: %s", backendConf.Kind)
 	}
 }
 
+// whether the backend is a reverse proxy, or an auth backend that passes requests to one
+func hasReverseProxy(backendConf erconfig.Backend) bool {
+	switch backendConf.Kind {
+	case erconfig.BackendKindReverseProxy:
+		return true
+	case erconfig.BackendKindAuthV0:
+		return hasReverseProxy(*backendConf.AuthV0Opts.AuthorizedBackend)
+	case erconfig.BackendKindAuthBasic:
+		return hasReverseProxy(*backendConf.AuthBasicOpts.AuthorizedBackend)
+	case erconfig.BackendKindAuthSso:
+		return hasReverseProxy(*backendConf.AuthSsoOpts.AuthorizedBackend)
+	case erconfig.BackendKindAuthMtls:
+		return hasReverseProxy(*backendConf.AuthMtlsOpts.AuthorizedBackend)
+	case erconfig.BackendKindAuthForward:
+		return hasReverseProxy(*backendConf.AuthForwardOpts.AuthorizedBackend)
+	case erconfig.BackendKindAuthOidc:
+		return hasReverseProxy(*backendConf.AuthOidcOpts.AuthorizedBackend)
+	default:
+		return false
+	}
+}
+
 // we need this because if we'd make new instances all the time, reverseproxybackend f.ex. makes
 // new http.Transport instance each time, so this would end up with loads of half-open TCP
 // connections since the connection cache is per http.Transport
@@ -130,6 +241,18 @@ func newBackendCache() *backendCache {
 	}
 }
 
+// forgets backends of apps that no longer exist, so their background resources (like origin
+// health checks and metrics) get released
+func (b *backendCache) Prune(apps []erconfig.Application) {
+	for appID := range b.perAppID {
+		if erconfig.FindApplication(appID, apps) == nil {
+			delete(b.perAppID, appID)
+
+			reverseproxybackend.ForgetApp(appID)
+		}
+	}
+}
+
 func (b *backendCache) Find(appID string, configDigest []byte) *cacheEntry {
 	cached, found := b.perAppID[appID]
 	if !found {
@@ -0,0 +1,51 @@
+package erserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/function61/edgerouter/pkg/erbackend/reverseproxybackend"
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+)
+
+func TestHealthChecksStopWhenBackendRebuiltWithoutThem(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	logger := slogshim.NewWithOutput(io.Discard)
+
+	healthCheckedApps := func() []string {
+		appIDs := []string{}
+		for _, status := range reverseproxybackend.OriginHealthStatuses() {
+			appIDs = append(appIDs, status.AppID)
+		}
+
+		return appIDs
+	}
+
+	build := func(backend erconfig.Backend) {
+		t.Helper()
+
+		_, err := makeBackend(context.Background(), "rebuilt", backend, nil, nil, logger)
+		assert.Ok(t, err)
+	}
+
+	proxy := erconfig.ReverseProxyBackend([]string{origin.URL}, nil, false)
+	proxy.ReverseProxyOpts.HealthCheck = &erconfig.HealthCheck{Path: "/health"}
+
+	build(erconfig.AuthV0Backend("token", proxy))
+	assert.EqualJson(t, healthCheckedApps(), `[
+  "rebuilt"
+]`)
+
+	// same app, but no longer proxied
+	build(erconfig.RedirectBackend("https://example.com/"))
+	assert.EqualJson(t, healthCheckedApps(), `[]`)
+
+	bendCache.Prune(nil)
+}
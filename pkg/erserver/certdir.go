@@ -0,0 +1,171 @@
+package erserver
+
+// Certificates from a directory, for when they're managed by an external tool (certbot etc.).
+// Each *.pem file is a bundle of the certificate chain and its private key (like dev-cert.pem).
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type certificateDir struct {
+	dir             string
+	bySAN           atomic.Pointer[map[string]*tls.Certificate] // lowercased SAN (can be wildcard) => cert
+	rewatchInterval time.Duration                               // how often to retry a lost watch
+	logger          *slog.Logger
+}
+
+func newCertificateDir(dir string, logger *slog.Logger) (*certificateDir, error) {
+	certDir := &certificateDir{
+		dir:             dir,
+		rewatchInterval: time.Minute,
+		logger:          logger,
+	}
+
+	if err := certDir.reload(); err != nil {
+		return nil, err
+	}
+
+	return certDir, nil
+}
+
+func (c *certificateDir) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverName := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if serverName == "" {
+		return nil, fmt.Errorf("client didn't send SNI")
+	}
+
+	bySAN := *c.bySAN.Load()
+
+	if cert, found := bySAN[serverName]; found {
+		return cert, nil
+	}
+
+	// "foo.example.com" => "*.example.com"
+	if _, parent, hasParent := strings.Cut(serverName, "."); hasParent {
+		if cert, found := bySAN["*."+parent]; found {
+			return cert, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no certificate for %s", serverName)
+}
+
+// reloads the certificates when files in the directory change. problems with the watch (or the
+// directory) aren't fatal: we keep serving the certificates we have, and re-add the watch.
+func (c *certificateDir) WatchChanges(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(c.dir); err != nil {
+		return err
+	}
+	watching := true
+
+	rewatch := time.NewTicker(c.rewatchInterval)
+	defer rewatch.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			// like the event queue overflowing, after which we don't know what we missed
+			c.logger.Error("watching certificates", "error", err)
+			watching = c.rewatch(watcher)
+		case <-rewatch.C:
+			if !watching {
+				watching = c.rewatch(watcher)
+			}
+		case event := <-watcher.Events:
+			switch {
+			case filepath.Clean(event.Name) == filepath.Clean(c.dir) && event.Has(fsnotify.Remove|fsnotify.Rename):
+				c.logger.Warn("certificate dir went away, keeping the certificates we have", "dir", c.dir)
+				watching = false // the watch went with it
+			case isCertificateFile(event.Name) && !event.Has(fsnotify.Chmod):
+				// a file being written by an external tool can be incomplete, which makes it fail to
+				// load. that's fine since we'll get another event when it's complete.
+				c.reloadOrKeep()
+			}
+		}
+	}
+}
+
+// (re-)adds the watch and reloads, since we might have missed changes. false if adding failed.
+func (c *certificateDir) rewatch(watcher *fsnotify.Watcher) bool {
+	_ = watcher.Remove(c.dir) // might be already gone
+
+	if err := watcher.Add(c.dir); err != nil {
+		c.logger.Error("watching certificates", "dir", c.dir, "error", err)
+		return false
+	}
+
+	c.reloadOrKeep()
+
+	return true
+}
+
+func (c *certificateDir) reloadOrKeep() {
+	if err := c.reload(); err != nil {
+		c.logger.Error("reloading certificates, keeping the previous ones", "error", err)
+	}
+}
+
+// builds a new index from scratch, so removed certificates go away as well
+func (c *certificateDir) reload() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	bySAN := map[string]*tls.Certificate{}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !isCertificateFile(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(c.dir, entry.Name())
+
+		// one broken file shouldn't take down the other certificates
+		cert, err := tls.LoadX509KeyPair(path, path)
+		if err != nil {
+			c.logger.Error("loading certificate", "file", path, "error", err)
+			continue
+		}
+
+		for _, san := range cert.Leaf.DNSNames {
+			san = strings.ToLower(san)
+
+			// multiple certs for same name happen while renewing (the old one is still around).
+			// prefer the one that's valid for longer.
+			if existing, found := bySAN[san]; found && existing.Leaf.NotAfter.After(cert.Leaf.NotAfter) {
+				continue
+			}
+
+			bySAN[san] = &cert
+		}
+	}
+
+	c.bySAN.Store(&bySAN)
+
+	c.logger.Info("certificates loaded", "dir", c.dir, "names", len(bySAN))
+
+	return nil
+}
+
+func isCertificateFile(name string) bool {
+	return filepath.Ext(name) == ".pem"
+}
@@ -0,0 +1,119 @@
+package erserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+)
+
+func TestCertificateDir(t *testing.T) {
+	dir := t.TempDir()
+
+	writeCert := func(filename string, notAfter time.Time, sans ...string) {
+		t.Helper()
+		assert.Ok(t, os.WriteFile(filepath.Join(dir, filename), selfSignedCertBundle(t, notAfter, sans...), 0600))
+	}
+
+	soon := time.Now().Add(24 * time.Hour)
+	later := time.Now().Add(48 * time.Hour)
+
+	writeCert("example.com.pem", soon, "example.com", "www.example.com")
+	writeCert("wildcard.pem", soon, "*.example.com")
+	writeCert("example.com-renewed.pem", later, "example.com")
+	assert.Ok(t, os.WriteFile(filepath.Join(dir, "broken.pem"), []byte("not a certificate"), 0600))
+	assert.Ok(t, os.WriteFile(filepath.Join(dir, "README.txt"), []byte("not a certificate either"), 0600))
+
+	certDir, err := newCertificateDir(dir, slogshim.NewWithOutput(io.Discard))
+	assert.Ok(t, err)
+	certDir.rewatchInterval = 10 * time.Millisecond
+
+	certFor := func(serverName string) string {
+		cert, err := certDir.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			return err.Error()
+		}
+
+		return strings.Join(cert.Leaf.DNSNames, ",") + "@" + cert.Leaf.NotAfter.Format(time.RFC3339)
+	}
+
+	assert.EqualString(t, certFor("example.com"), "example.com@"+later.UTC().Format(time.RFC3339))
+	assert.EqualString(t, certFor("WWW.example.com"), "example.com,www.example.com@"+soon.UTC().Format(time.RFC3339))
+	assert.EqualString(t, certFor("foo.example.com"), "*.example.com@"+soon.UTC().Format(time.RFC3339))
+	assert.EqualString(t, certFor("foo.bar.example.com"), "no certificate for foo.bar.example.com")
+	assert.EqualString(t, certFor(""), "client didn't send SNI")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		assert.Ok(t, certDir.WatchChanges(ctx))
+	}()
+
+	time.Sleep(50 * time.Millisecond) // give the watch time to be set up
+
+	writeCert("other.pem", soon, "other.net")
+	assert.Ok(t, os.Remove(filepath.Join(dir, "wildcard.pem")))
+
+	for deadline := time.Now().Add(5 * time.Second); certFor("foo.example.com") != "no certificate for foo.example.com"; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected wildcard certificate to go away")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.EqualString(t, certFor("other.net"), "other.net@"+soon.UTC().Format(time.RFC3339))
+
+	// directory going away (and coming back, like when a volume is re-mounted) doesn't stop watching
+	assert.Ok(t, os.RemoveAll(dir))
+	time.Sleep(50 * time.Millisecond)
+	assert.Ok(t, os.Mkdir(dir, 0700))
+	writeCert("new.pem", soon, "new.net")
+
+	for deadline := time.Now().Add(5 * time.Second); certFor("new.net") != "new.net@"+soon.UTC().Format(time.RFC3339); {
+		if time.Now().After(deadline) {
+			t.Fatal("expected certificate from re-created dir")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// certificate chain + private key in one file
+func selfSignedCertBundle(t *testing.T, notAfter time.Time, sans ...string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     sans,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter.Truncate(time.Second),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Ok(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Ok(t, err)
+
+	return append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+}
@@ -0,0 +1,255 @@
+package erserver
+
+// Resolving the client's real IP when we're behind proxies (Cloudflare, cloud load balancers etc.).
+// Without this every client would look like the load balancer, making IP rules useless.
+//
+// The proxies tell us the client either with the PROXY protocol (prepended to the TCP connection,
+// used by L4 balancers) or in the `X-Forwarded-For` / `Forwarded` header (L7 proxies). Both are
+// trivially spoofable by anyone who can connect to us, so they're only believed from proxies we've
+// been told to trust.
+//
+// Only the header our proxies are configured to add is read. Most proxies only append to
+// X-Forwarded-For and pass the client's Forwarded header through as-is, so falling back from one to
+// the other would let the client pick its own IP.
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+type clientIPConfig struct {
+	trustedProxies []netip.Prefix
+	trustedHeader  string // the header our proxies append the client to. "X-Forwarded-For" or "Forwarded"
+	proxyProtocol  bool   // accept PROXY protocol headers (from trusted proxies) on the listeners
+}
+
+// configured with ENV:
+//   - TRUSTED_PROXIES: comma-separated IPs or CIDRs. example: 10.0.0.0/8,2001:db8::/32
+//   - TRUSTED_PROXY_HEADER: (optional) "x-forwarded-for" (default) or "forwarded"
+//   - PROXY_PROTOCOL: "1" (or "true") to accept PROXY protocol v1/v2 from the trusted proxies
+func clientIPConfigFromEnv() (*clientIPConfig, error) {
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+
+	trustedHeader, err := parseTrustedProxyHeader(os.Getenv("TRUSTED_PROXY_HEADER"))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXY_HEADER: %w", err)
+	}
+
+	proxyProtocol := false
+	switch value := os.Getenv("PROXY_PROTOCOL"); value {
+	case "", "0", "false":
+	case "1", "true":
+		proxyProtocol = true
+	default:
+		return nil, fmt.Errorf("PROXY_PROTOCOL: unsupported value: %s", value)
+	}
+
+	if proxyProtocol && len(trustedProxies) == 0 {
+		// otherwise anyone could claim to be anyone
+		return nil, fmt.Errorf("PROXY_PROTOCOL requires TRUSTED_PROXIES")
+	}
+
+	return &clientIPConfig{
+		trustedProxies: trustedProxies,
+		trustedHeader:  trustedHeader,
+		proxyProtocol:  proxyProtocol,
+	}, nil
+}
+
+func parseTrustedProxyHeader(serialized string) (string, error) {
+	switch strings.ToLower(serialized) {
+	case "", "x-forwarded-for":
+		return "X-Forwarded-For", nil
+	case "forwarded":
+		return "Forwarded", nil
+	default:
+		return "", fmt.Errorf("unsupported value: %s", serialized)
+	}
+}
+
+func parseTrustedProxies(serialized string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+
+	for _, item := range strings.Split(serialized, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") { // single IP
+			ip, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, err
+			}
+
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func (c *clientIPConfig) trusted(ip netip.Addr) bool {
+	ip = ip.Unmap()
+
+	for _, prefix := range c.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listener for our HTTP servers, which understands PROXY protocol if it's enabled
+func (c *clientIPConfig) listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.proxyProtocol {
+		return listener, nil
+	}
+
+	return &proxyproto.Listener{
+		Listener: listener,
+		ConnPolicy: func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			upstream, err := netip.ParseAddrPort(opts.Upstream.String())
+			if err != nil || !c.trusted(upstream.Addr()) {
+				return proxyproto.SKIP, nil // regular connection (header, if any, will be a bad request)
+			}
+
+			// optional, so the balancer's health checks etc. work without the header
+			return proxyproto.USE, nil
+		},
+	}, nil
+}
+
+// rewrites r.RemoteAddr to be the client's address as told by our trusted proxies. everything
+// downstream (IP rules, backends like Lambda) can then keep using r.RemoteAddr.
+//
+// X-Forwarded-For is rewritten to contain only the (untrusted) hops before the client, so that the
+// reverse proxy appending r.RemoteAddr to it makes the client the last hop for upstreams.
+// a consumed Forwarded header is removed for the same reason. the header we don't trust is ignored.
+func (c *clientIPConfig) resolveClientAddr(r *http.Request) {
+	if len(c.trustedProxies) == 0 {
+		return
+	}
+
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !c.trusted(peer.Addr()) {
+		return
+	}
+
+	fromForwarded := c.trustedHeader == "Forwarded"
+
+	hops := xForwardedForHops(r.Header)
+	if fromForwarded {
+		hops = forwardedHops(r.Header)
+	}
+	if len(hops) == 0 {
+		return
+	}
+
+	client := peer
+	clientIdx := len(hops)
+
+	// right-to-left, because only the hops added by our trusted proxies can be believed. the first
+	// untrusted one is the client (anything left of it was supplied by the client itself).
+	for clientIdx > 0 {
+		hop, valid := parseHop(hops[clientIdx-1])
+		if !valid { // "unknown" or garbage. the proxy that added it is the best we know
+			break
+		}
+
+		clientIdx--
+		client = hop
+
+		if !c.trusted(hop.Addr()) {
+			break
+		}
+	}
+
+	r.RemoteAddr = netip.AddrPortFrom(client.Addr().Unmap(), client.Port()).String()
+
+	if fromForwarded {
+		r.Header.Del("Forwarded")
+	}
+
+	if clientIdx > 0 {
+		r.Header.Set("X-Forwarded-For", strings.Join(hops[:clientIdx], ", "))
+	} else {
+		r.Header.Del("X-Forwarded-For")
+	}
+}
+
+// returns the hops (oldest first) from the standardized Forwarded header. multiple headers are
+// concatenated in order.
+func forwardedHops(headers http.Header) []string {
+	forwardeds := headers.Values("Forwarded")
+	if len(forwardeds) == 0 {
+		return nil
+	}
+
+	hops := []string{}
+
+	// Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"
+	for _, element := range strings.Split(strings.Join(forwardeds, ","), ",") {
+		forValue := "unknown" // element without for= still counts as a hop (we can't skip it)
+
+		for _, pair := range strings.Split(element, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if strings.EqualFold(key, "for") {
+				forValue = strings.Trim(value, `"`)
+			}
+		}
+
+		hops = append(hops, forValue)
+	}
+
+	return hops
+}
+
+// returns the hops (oldest first) from X-Forwarded-For. multiple headers are concatenated in order.
+func xForwardedForHops(headers http.Header) []string {
+	hops := []string{}
+	for _, hop := range strings.Split(strings.Join(headers.Values("X-Forwarded-For"), ","), ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+
+	return hops
+}
+
+// supports "192.0.2.60", "192.0.2.60:4711", "2001:db8::17" and "[2001:db8::17]:4711"
+func parseHop(hop string) (netip.AddrPort, bool) {
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort, true
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+
+	return netip.AddrPortFrom(addr, 0), true
+}
@@ -0,0 +1,158 @@
+package erserver
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/assert"
+)
+
+func TestResolveClientAddr(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1,2001:db8::/32")
+	assert.Ok(t, err)
+
+	for _, tc := range []struct {
+		trustedHeader string
+		remoteAddr    string
+		headers       map[string]string
+		expectedAddr  string
+		expectedXFF   string
+	}{
+		{ // untrusted peer can't tell us anything
+			"X-Forwarded-For",
+			"203.0.113.9:1234",
+			map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			"203.0.113.9:1234",
+			"1.2.3.4",
+		},
+		{
+			"X-Forwarded-For",
+			"10.0.0.5:1234",
+			map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			"1.2.3.4:0",
+			"",
+		},
+		{ // client tried spoofing, but our proxy appended the real IP
+			"X-Forwarded-For",
+			"10.0.0.5:1234",
+			map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 192.0.2.1"},
+			"1.2.3.4:0",
+			"6.6.6.6",
+		},
+		{ // no headers => the trusted peer is the client
+			"X-Forwarded-For",
+			"10.0.0.5:1234",
+			map[string]string{},
+			"10.0.0.5:1234",
+			"",
+		},
+		{ // everyone is trusted => leftmost
+			"X-Forwarded-For",
+			"10.0.0.5:1234",
+			map[string]string{"X-Forwarded-For": "10.1.1.1, 10.2.2.2"},
+			"10.1.1.1:0",
+			"",
+		},
+		{ // garbage from the proxy => the proxy is the best we know
+			"X-Forwarded-For",
+			"10.0.0.5:1234",
+			map[string]string{"X-Forwarded-For": "1.2.3.4, unknown"},
+			"10.0.0.5:1234",
+			"1.2.3.4, unknown",
+		},
+		{
+			"Forwarded",
+			"[2001:db8::1]:1234",
+			map[string]string{"Forwarded": `for=6.6.6.6, for="[2001:db9::17]:4711";proto=https, for=192.0.2.1`},
+			"[2001:db9::17]:4711",
+			"6.6.6.6",
+		},
+		{ // our proxies only append to X-Forwarded-For, so a Forwarded header is from the client
+			"X-Forwarded-For",
+			"10.0.0.5:1234",
+			map[string]string{"Forwarded": "for=192.0.2.77", "X-Forwarded-For": "1.2.3.4"},
+			"1.2.3.4:0",
+			"",
+		},
+		{ // ... and there's no falling back to it when X-Forwarded-For is missing
+			"X-Forwarded-For",
+			"10.0.0.5:1234",
+			map[string]string{"Forwarded": "for=192.0.2.77"},
+			"10.0.0.5:1234",
+			"",
+		},
+		{ // same the other way around
+			"Forwarded",
+			"10.0.0.5:1234",
+			map[string]string{"Forwarded": "for=1.2.3.4", "X-Forwarded-For": "192.0.2.77"},
+			"1.2.3.4:0",
+			"",
+		},
+		{
+			"Forwarded",
+			"10.0.0.5:1234",
+			map[string]string{"X-Forwarded-For": "192.0.2.77"},
+			"10.0.0.5:1234",
+			"192.0.2.77",
+		},
+	} {
+		t.Run(tc.trustedHeader+" "+tc.remoteAddr+" "+tc.headers["X-Forwarded-For"]+tc.headers["Forwarded"], func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+
+			config := &clientIPConfig{trustedProxies: trustedProxies, trustedHeader: tc.trustedHeader}
+			config.resolveClientAddr(req)
+
+			assert.EqualString(t, req.RemoteAddr, tc.expectedAddr)
+			assert.EqualString(t, req.Header.Get("X-Forwarded-For"), tc.expectedXFF)
+			if tc.trustedHeader == "Forwarded" {
+				assert.EqualString(t, req.Header.Get("Forwarded"), "") // consumed
+			} else { // not ours to touch
+				assert.EqualString(t, req.Header.Get("Forwarded"), tc.headers["Forwarded"])
+			}
+		})
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	config := &clientIPConfig{proxyProtocol: true}
+
+	for _, trusted := range []string{"", "127.0.0.0/8"} {
+		trustedProxies, err := parseTrustedProxies(trusted)
+		assert.Ok(t, err)
+		config.trustedProxies = trustedProxies
+
+		listener, err := config.listen("127.0.0.1:0")
+		assert.Ok(t, err)
+
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			config.resolveClientAddr(r)
+			_, _ = w.Write([]byte(r.RemoteAddr))
+		})}
+		go func() { _ = srv.Serve(listener) }()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.Ok(t, err)
+
+		_, err = conn.Write([]byte("PROXY TCP4 198.51.100.7 192.0.2.10 56324 443\r\nGET / HTTP/1.0\r\n\r\n"))
+		assert.Ok(t, err)
+
+		res, err := io.ReadAll(conn)
+		assert.Ok(t, err)
+		assert.Ok(t, conn.Close())
+		assert.Ok(t, srv.Close())
+
+		if trusted != "" {
+			assert.Assert(t, strings.HasSuffix(string(res), "\r\n\r\n198.51.100.7:56324"))
+		} else { // untrusted can't use PROXY protocol
+			assert.Assert(t, strings.HasPrefix(string(res), "HTTP/1.1 400 Bad Request"))
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package erserver
+
+// Load shedding: caps the requests an app's backend (Lambda, origins..) is given at once, so that
+// a traffic spike queues up here (or gets a fast 503) instead of overwhelming the backend.
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type concurrencyLimiters struct {
+	metrics *metricsStore
+
+	mu     sync.Mutex
+	perApp map[string]*concurrencyLimiter
+}
+
+func newConcurrencyLimiters(metrics *metricsStore) *concurrencyLimiters {
+	return &concurrencyLimiters{
+		metrics: metrics,
+		perApp:  map[string]*concurrencyLimiter{},
+	}
+}
+
+// nil if the app's concurrency is not limited
+func (c *concurrencyLimiters) forApp(app erconfig.Application) *concurrencyLimiter {
+	if app.ConcurrencyLimit == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	limiter, found := c.perApp[app.ID]
+	// policy changed => new limiter. requests in flight release their slots to the old one, so for
+	// a moment the app can have more than the limit.
+	if !found || limiter.policy != *app.ConcurrencyLimit {
+		limiter = newConcurrencyLimiter(*app.ConcurrencyLimit, c.metrics.requestsQueued.WithLabelValues(app.ID))
+		limiter.shed = func(reason string) {
+			c.metrics.requestsShed.WithLabelValues(app.ID, reason).Inc()
+		}
+
+		c.metrics.concurrencyLimit.WithLabelValues(app.ID).Set(float64(app.ConcurrencyLimit.MaxConcurrent))
+
+		c.perApp[app.ID] = limiter
+	}
+
+	return limiter
+}
+
+type concurrencyLimiter struct {
+	policy erconfig.ConcurrencyLimitPolicy
+	slots  chan struct{} // a request holds a slot while it's being served
+	queued atomic.Int64
+
+	queuedGauge prometheus.Gauge
+	shed        func(reason string)
+}
+
+func newConcurrencyLimiter(policy erconfig.ConcurrencyLimitPolicy, queuedGauge prometheus.Gauge) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		policy:      policy,
+		slots:       make(chan struct{}, policy.MaxConcurrent),
+		queuedGauge: queuedGauge,
+		shed:        func(string) {},
+	}
+}
+
+// waits for a slot if there's room in the queue. returns false if the request was shed (or the
+// client went away while queued), otherwise the slot must be released after serving.
+func (c *concurrencyLimiter) acquire(ctx context.Context) (func(), bool) {
+	select {
+	case c.slots <- struct{}{}: // happy path
+		return c.release, true
+	default:
+	}
+
+	if c.queued.Add(1) > int64(c.policy.MaxQueued) {
+		c.queued.Add(-1)
+		c.shed("queue_full")
+		return nil, false
+	}
+	defer c.queued.Add(-1)
+
+	c.queuedGauge.Inc()
+	defer c.queuedGauge.Dec()
+
+	var timeout <-chan time.Time // nil (= never) if no timeout
+	if c.policy.QueueTimeoutSeconds > 0 {
+		timer := time.NewTimer(time.Duration(c.policy.QueueTimeoutSeconds) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+		return c.release, true
+	case <-timeout:
+		c.shed("queue_timeout")
+		return nil, false
+	case <-ctx.Done():
+		c.shed("client_gone")
+		return nil, false
+	}
+}
+
+func (c *concurrencyLimiter) release() {
+	<-c.slots
+}
@@ -0,0 +1,58 @@
+package erserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/gokit/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	queued := prometheus.NewGauge(prometheus.GaugeOpts{Name: "queued"})
+
+	limiter := newConcurrencyLimiter(erconfig.ConcurrencyLimitPolicy{MaxConcurrent: 1, MaxQueued: 1}, queued)
+
+	shedReasons := []string{}
+	limiter.shed = func(reason string) { shedReasons = append(shedReasons, reason) }
+
+	release1, ok := limiter.acquire(context.Background())
+	assert.Assert(t, ok)
+
+	// 2nd waits in the queue
+	acquired2 := make(chan func())
+	go func() {
+		release2, ok := limiter.acquire(context.Background())
+		assert.Assert(t, ok)
+		acquired2 <- release2
+	}()
+
+	for testutil.ToFloat64(queued) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// queue is full => 3rd is shed right away
+	_, ok = limiter.acquire(context.Background())
+	assert.Assert(t, !ok)
+
+	release1()
+	release2 := <-acquired2
+	assert.EqualInt(t, int(testutil.ToFloat64(queued)), 0)
+
+	// client going away while queued
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ok = limiter.acquire(ctx)
+	assert.Assert(t, !ok)
+
+	release2()
+
+	_, ok = limiter.acquire(context.Background())
+	assert.Assert(t, ok)
+
+	assert.EqualString(t, strings.Join(shedReasons, ","), "queue_full,client_gone")
+}
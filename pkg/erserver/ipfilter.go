@@ -2,33 +2,63 @@ package erserver
 
 // IP-based filtering (access control). I used to think it is legacy enterprise BS and doesn't have any
 // place in a modern stack, but once Tailscale made them "identities", I guess there is some value left.
+//
+// Rules are tried in order of priority (highest first), then denies before allows, then in the order
+// they were given: the file's rules in file order, then discovered rules (most specific prefix first,
+// since they have no order of their own). The first rule that matches the IP and covers the app and
+// path decides. Except that an allow rule without paths decides for all apps: the ones it doesn't
+// list are denied (like the first matching rule always did before we had deny rules). Path-scoped
+// rules have no say outside their paths.
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/netip"
 	"os"
+	"path"
+	"sort"
+	"strings"
 
+	"github.com/function61/edgerouter/pkg/erdiscovery"
 	"github.com/function61/gokit/hcl2json"
 	"github.com/function61/gokit/jsonfile"
 	"github.com/function61/gokit/sliceutil"
 )
 
 type ipRule struct {
-	ipPrefix      netip.Prefix
-	allowedAppIds []string // if empty, means all apps are allowed
+	ipPrefix netip.Prefix
+	appIds   []string // if empty, means all apps
+	deny     bool
+	paths    []string // if empty, means all paths. ex: "/admin" covers "/admin" and "/admin/users"
+	priority int      // higher is tried first
 }
 
-func (i ipRule) AllowsApp(appToAccess string) bool {
-	if len(i.allowedAppIds) == 0 { // allow all
+func (i ipRule) coversApp(appToAccess string) bool {
+	if len(i.appIds) == 0 { // all apps
 		return true
 	}
 
-	return sliceutil.ContainsString(i.allowedAppIds, appToAccess)
+	return sliceutil.ContainsString(i.appIds, appToAccess)
 }
 
-func ipAllowed(ipAndPortStr string, appToAccess string, rules []ipRule) (bool, string) {
+// *reqPath* must be canonical (see canonicalPath())
+func (i ipRule) coversPath(reqPath string) bool {
+	if len(i.paths) == 0 { // all paths
+		return true
+	}
+
+	for _, prefix := range i.paths {
+		if reqPath == prefix || strings.HasPrefix(reqPath, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func ipAllowed(ipAndPortStr string, appToAccess string, path string, rules []ipRule) (bool, string) {
 	if len(rules) == 0 { // no rules => no IP filtering in use
 		return true, ""
 	}
@@ -38,17 +68,44 @@ func ipAllowed(ipAndPortStr string, appToAccess string, rules []ipRule) (bool, s
 		return false, "invalid IP: " + err.Error()
 	}
 
-	// the port is not used for ACL (it's remote port anyway which is meaningless)
-	return ipAllowedInternal(ipAndPort.Addr(), appToAccess, rules)
+	// the port is not used for ACL (it's remote port anyway which is meaningless).
+	// IPv4 clients of dual-stack listeners look like "::ffff:1.2.3.4"
+	return ipAllowedInternal(ipAndPort.Addr().Unmap(), appToAccess, canonicalPath(path), rules)
+}
+
+// the path as the backend will most likely interpret it. path scopes must be matched against this,
+// or "/public/../admin", "//admin" or "/admin/./users" would slip past a rule for "/admin".
+func canonicalPath(reqPath string) string {
+	cleaned := path.Clean("/" + reqPath)
+	if strings.HasSuffix(reqPath, "/") && cleaned != "/" {
+		return cleaned + "/"
+	}
+
+	return cleaned
 }
 
 // do not use directly
-func ipAllowedInternal(ip netip.Addr, appToAccess string, rules []ipRule) (bool, string) {
-	if matchingRule := ruleForIP(ip, rules); matchingRule != nil {
-		if matchingRule.AllowsApp(appToAccess) {
+func ipAllowedInternal(ip netip.Addr, appToAccess string, path string, rules []ipRule) (bool, string) {
+	explicitDeny := fmt.Sprintf("your IP (%s) is not allowed (explicit deny)", ip.String())
+
+	for _, rule := range rules {
+		if !rule.ipPrefix.Contains(ip) {
+			continue
+		}
+
+		covers := rule.coversApp(appToAccess) && rule.coversPath(path)
+
+		switch {
+		case rule.deny && covers:
+			return false, explicitDeny
+		case rule.deny: // deny rules have no say about what they don't cover
+			continue
+		case covers:
 			return true, ""
-		} else {
-			return false, fmt.Sprintf("your IP (%s) is not allowed (explicit deny)", ip.String())
+		case len(rule.paths) > 0: // path-scoped rules have no say outside their paths
+			continue
+		default: // allow rule for other apps
+			return false, explicitDeny
 		}
 	}
 
@@ -56,6 +113,7 @@ func ipAllowedInternal(ip netip.Addr, appToAccess string, rules []ipRule) (bool,
 	return false, fmt.Sprintf("your IP (%s) is not allowed (implicit deny)", ip.String())
 }
 
+// first rule (in evaluation order) that matches the IP, regardless of whether it covers the app
 func ruleForIP(ip netip.Addr, rules []ipRule) *ipRule {
 	for _, rule := range rules {
 		if rule.ipPrefix.Contains(ip) {
@@ -66,20 +124,71 @@ func ruleForIP(ip netip.Addr, rules []ipRule) *ipRule {
 	return nil
 }
 
+// sorts in evaluation order: highest priority first, then denies first. otherwise keeps the given order.
+func sortIPRules(rules []ipRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].priority != rules[j].priority {
+			return rules[i].priority > rules[j].priority
+		}
+
+		return rules[i].deny && !rules[j].deny
+	})
+}
+
 // factories
 
 // funky signature to make sure we get at least one app (0 apps by accident would be catastrophic)
 func allowOnlyApps(prefix netip.Prefix, app1 string, appN ...string) ipRule {
-	return ipRule{prefix, append([]string{app1}, appN...)}
+	return ipRule{ipPrefix: prefix, appIds: append([]string{app1}, appN...)}
 }
 
 func allowAllApps(prefix netip.Prefix) ipRule {
-	return ipRule{prefix, nil}
+	return ipRule{ipPrefix: prefix}
 }
 
-// temporary rules file format. you can see example in tests
+// rules from the file and discovery (if it stores IP rules), in evaluation order
+func readIPRules(ctx context.Context, discovery erdiscovery.Reader, fileRules []ipRule) ([]ipRule, error) {
+	rules := append([]ipRule{}, fileRules...)
+
+	if ipRulesReader, is := discovery.(erdiscovery.IPRulesReader); is {
+		discovered, err := ipRulesReader.ReadIPRules(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("ReadIPRules: %w", err)
+		}
+
+		discoveredRules := []ipRule{}
+		for _, rule := range discovered {
+			if err := rule.Validate(); err != nil {
+				return nil, fmt.Errorf("IP rule %s: %w", rule.Prefix, err)
+			}
+
+			discoveredRules = append(discoveredRules, ipRule{ipPrefix: netip.MustParsePrefix(rule.Prefix), appIds: rule.Apps})
+		}
+
+		sort.SliceStable(discoveredRules, func(i, j int) bool {
+			return discoveredRules[i].ipPrefix.Bits() > discoveredRules[j].ipPrefix.Bits()
+		})
+
+		rules = append(rules, discoveredRules...)
+	}
+
+	sortIPRules(rules)
+
+	return rules, nil
+}
+
+// the file-based rules format. it's only read at startup, but has features (deny rules, IP sets,
+// paths and priorities) that rules in discovery don't. you can see example in tests
 
 type ipRulesConfig struct {
+	IPSets []struct {
+		Name     string   `json:"name"`
+		Prefixes []string `json:"prefixes"` // IPv4 and IPv6 can be mixed
+	} `json:"ip_set"`
+	Allow []ipRuleConfig `json:"allow"`
+	Deny  []ipRuleConfig `json:"deny"`
+
+	// the original, simple format
 	AllowAllApps []struct {
 		Prefix string `json:"prefix"`
 	} `json:"allow_all"`
@@ -89,6 +198,14 @@ type ipRulesConfig struct {
 	} `json:"allow_specified"`
 }
 
+type ipRuleConfig struct {
+	Prefixes []string `json:"prefixes"`
+	IPSets   []string `json:"ip_sets"` // names of `ip_set`s
+	Apps     []string `json:"apps"`
+	Paths    []string `json:"paths"`
+	Priority int      `json:"priority"`
+}
+
 func loadIPRules(ipRulesFile string) ([]ipRule, error) {
 	f, err := os.Open(ipRulesFile)
 	if err != nil {
@@ -109,20 +226,117 @@ func parseHclRules(content io.Reader) ([]ipRule, error) {
 		return nil, err
 	}
 
+	ipSets := map[string][]netip.Prefix{}
+
+	for idx, ipSet := range conf.IPSets {
+		if ipSet.Name == "" {
+			return nil, fmt.Errorf("ip_set[%d]: name: required", idx)
+		}
+
+		if _, duplicate := ipSets[ipSet.Name]; duplicate {
+			return nil, fmt.Errorf("ip_set %s: defined more than once", ipSet.Name)
+		}
+
+		prefixes, err := parsePrefixes(ipSet.Prefixes)
+		if err != nil {
+			return nil, fmt.Errorf("ip_set %s: %w", ipSet.Name, err)
+		}
+
+		if len(prefixes) == 0 {
+			return nil, fmt.Errorf("ip_set %s: prefixes: required", ipSet.Name)
+		}
+
+		ipSets[ipSet.Name] = prefixes
+	}
+
 	rules := []ipRule{}
 
-	for _, allowAllItem := range conf.AllowAllApps {
-		rules = append(rules, allowAllApps(mustParsePrefix(allowAllItem.Prefix)))
+	for idx, allowAllItem := range conf.AllowAllApps {
+		prefix, err := parsePrefix(allowAllItem.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("allow_all[%d]: %w", idx, err)
+		}
+
+		rules = append(rules, allowAllApps(prefix))
+	}
+
+	for idx, allowSpecified := range conf.AllowOnlyApps {
+		prefix, err := parsePrefix(allowSpecified.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("allow_specified[%d]: %w", idx, err)
+		}
+
+		if len(allowSpecified.Apps) == 0 { // would mean all apps
+			return nil, fmt.Errorf("allow_specified[%d]: apps: required", idx)
+		}
+
+		rules = append(rules, allowOnlyApps(prefix, allowSpecified.Apps[0], allowSpecified.Apps[1:]...))
 	}
 
-	for _, allowSpecified := range conf.AllowOnlyApps {
-		rules = append(rules, allowOnlyApps(mustParsePrefix(allowSpecified.Prefix), allowSpecified.Apps[0], allowSpecified.Apps[1:]...))
+	for _, kind := range []struct {
+		name    string
+		deny    bool
+		configs []ipRuleConfig
+	}{
+		{"allow", false, conf.Allow},
+		{"deny", true, conf.Deny},
+	} {
+		for idx, ruleConfig := range kind.configs {
+			ruleRules, err := ruleConfig.rules(kind.deny, ipSets)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%d]: %w", kind.name, idx, err)
+			}
+
+			rules = append(rules, ruleRules...)
+		}
 	}
 
 	if len(rules) == 0 {
 		return nil, errors.New("empty IP rules file") // would be dangerous to accept
 	}
 
+	sortIPRules(rules)
+
+	return rules, nil
+}
+
+// one rule per prefix (in the order of prefixes, then IP sets)
+func (r ipRuleConfig) rules(deny bool, ipSets map[string][]netip.Prefix) ([]ipRule, error) {
+	prefixes, err := parsePrefixes(r.Prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ipSetName := range r.IPSets {
+		ipSet, found := ipSets[ipSetName]
+		if !found {
+			return nil, fmt.Errorf("ip_sets: not defined: %s", ipSetName)
+		}
+
+		prefixes = append(prefixes, ipSet...)
+	}
+
+	if len(prefixes) == 0 {
+		return nil, errors.New("prefixes or ip_sets required")
+	}
+
+	for _, path := range r.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("paths: must start with '/': %s", path)
+		}
+	}
+
+	rules := []ipRule{}
+	for _, prefix := range prefixes {
+		rules = append(rules, ipRule{
+			ipPrefix: prefix,
+			appIds:   r.Apps,
+			deny:     deny,
+			paths:    r.Paths,
+			priority: r.Priority,
+		})
+	}
+
 	return rules, nil
 }
 
@@ -136,11 +350,27 @@ func unmarhsalHcl(content io.Reader, data interface{}) error {
 	return jsonfile.Unmarshal(asJSON, data, true)
 }
 
-func mustParsePrefix(rawPrefix string) netip.Prefix {
+func parsePrefixes(rawPrefixes []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+
+	for _, rawPrefix := range rawPrefixes {
+		prefix, err := parsePrefix(rawPrefix)
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+func parsePrefix(rawPrefix string) (netip.Prefix, error) {
 	prefix, err := netip.ParsePrefix(rawPrefix)
 	if err != nil {
-		panic(err)
+		return netip.Prefix{}, fmt.Errorf("prefix: %w", err)
 	}
 
-	return prefix
+	// "192.168.1.1/24" is most likely a typo, but let's not be pedantic about it
+	return prefix.Masked(), nil
 }
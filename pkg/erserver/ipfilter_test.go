@@ -1,16 +1,19 @@
 package erserver
 
 import (
+	"context"
 	"fmt"
 	"net/netip"
 	"strings"
 	"testing"
 
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/erdiscovery"
 	"github.com/function61/gokit/assert"
 )
 
 func TestNoRulesAllAllowed(t *testing.T) {
-	allowed, _ := ipAllowed("1.2.3.4:1234", "anyapp", nil)
+	allowed, _ := ipAllowed("1.2.3.4:1234", "anyapp", "/", nil)
 	assert.Assert(t, allowed)
 }
 
@@ -18,14 +21,14 @@ func TestInvalidIP(t *testing.T) {
 	invalidIP := "500.400.300.200.100:80"
 
 	// without rules IP parsing is skipped
-	allowed, errStr := ipAllowed(invalidIP, "anyapp", nil)
+	allowed, errStr := ipAllowed(invalidIP, "anyapp", "/", nil)
 	assert.Assert(t, allowed)
 	assert.Assert(t, errStr == "")
 
 	allIpsPrefix, err := netip.ParsePrefix("0.0.0.0/0")
 	assert.Ok(t, err)
 
-	allowed, errStr = ipAllowed(invalidIP, "anyapp", []ipRule{allowAllApps(allIpsPrefix)})
+	allowed, errStr = ipAllowed(invalidIP, "anyapp", "/", []ipRule{allowAllApps(allIpsPrefix)})
 	assert.Assert(t, !allowed)
 	assert.EqualString(t, errStr, `invalid IP: ParseAddr("500.400.300.200.100"): IPv4 field has value >255`)
 }
@@ -55,7 +58,7 @@ allow_specified {
 	assert.EqualString(t, ruleForIP(ip("100.75.44.30"), rules).ipPrefix.String(), "100.75.44.30/32")
 	assert.Assert(t, ruleForIP(ip("100.75.44.31"), rules) == nil)
 
-	assert.EqualJson(t, ruleForIP(ip("100.56.80.66"), rules).allowedAppIds, `[
+	assert.EqualJson(t, ruleForIP(ip("100.56.80.66"), rules).appIds, `[
   "test"
 ]`)
 
@@ -101,7 +104,7 @@ allow_specified {
 		testcaseSubject := fmt.Sprintf("%s -> %s", tc.ip, tc.app) // for failures
 
 		t.Run(testcaseSubject, func(t *testing.T) {
-			allowed, errorStr := ipAllowed(tc.ip+":1234", tc.app, rules)
+			allowed, errorStr := ipAllowed(tc.ip+":1234", tc.app, "/", rules)
 
 			output := func() string {
 				if allowed {
@@ -116,3 +119,185 @@ allow_specified {
 	}
 
 }
+
+// rules are tried in file order, not most specific first
+func TestIpFilterFirstMatchWins(t *testing.T) {
+	rules, err := parseHclRules(strings.NewReader(`
+allow_all { prefix = "10.0.0.0/8" }
+
+allow_specified {
+	prefix = "10.1.0.0/16"
+	apps = ["x"]
+}
+`))
+	assert.Ok(t, err)
+
+	allowed, _ := ipAllowed("10.1.2.3:1234", "y", "/", rules)
+	assert.Assert(t, allowed)
+
+	rules, err = parseHclRules(strings.NewReader(`
+allow {
+	prefixes = ["10.1.0.0/16"]
+	apps = ["x"]
+}
+
+allow { prefixes = ["10.0.0.0/8"] }
+`))
+	assert.Ok(t, err)
+
+	allowed, errStr := ipAllowed("10.1.2.3:1234", "y", "/", rules)
+	assert.Assert(t, !allowed)
+	assert.EqualString(t, errStr, "your IP (10.1.2.3) is not allowed (explicit deny)")
+
+	allowed, _ = ipAllowed("10.2.0.1:1234", "y", "/", rules)
+	assert.Assert(t, allowed)
+}
+
+func TestIpFilterDenyRulesAndPaths(t *testing.T) {
+	rules, err := parseHclRules(strings.NewReader(`
+ip_set {
+	name = "office"
+	prefixes = ["192.168.1.0/24", "2001:db8:1::/48"]
+}
+
+# wiki's /public is for everyone, but its /admin only for the office
+allow {
+	prefixes = ["0.0.0.0/0", "::/0"]
+	apps = ["wiki"]
+	paths = ["/public"]
+}
+allow {
+	ip_sets = ["office"]
+}
+
+# ... except for the office's guest WiFi
+deny {
+	prefixes = ["192.168.1.128/25"]
+	apps = ["wiki"]
+	paths = ["/admin"]
+	priority = 10
+}
+`))
+	assert.Ok(t, err)
+
+	output := func(ip string, app string, path string) string {
+		if allowed, errStr := ipAllowed(ip, app, path, rules); !allowed {
+			return errStr
+		}
+
+		return "allow"
+	}
+
+	assert.EqualString(t, output("203.0.113.9:1234", "wiki", "/public/logo.png"), "allow")
+	assert.EqualString(t, output("[2001:db9::1]:1234", "wiki", "/public"), "allow")
+	assert.EqualString(t, output("203.0.113.9:1234", "wiki", "/publicity"), "your IP (203.0.113.9) is not allowed (implicit deny)")
+	assert.EqualString(t, output("203.0.113.9:1234", "wiki", "/admin"), "your IP (203.0.113.9) is not allowed (implicit deny)")
+	assert.EqualString(t, output("203.0.113.9:1234", "grafana", "/public"), "your IP (203.0.113.9) is not allowed (implicit deny)")
+	assert.EqualString(t, output("192.168.1.10:1234", "wiki", "/admin"), "allow")
+	assert.EqualString(t, output("[::ffff:192.168.1.10]:1234", "grafana", "/"), "allow")
+	assert.EqualString(t, output("[2001:db8:1::5]:1234", "wiki", "/admin/users"), "allow")
+	assert.EqualString(t, output("192.168.1.200:1234", "wiki", "/admin/users"), "your IP (192.168.1.200) is not allowed (explicit deny)")
+	assert.EqualString(t, output("192.168.1.200:1234", "wiki", "/public"), "allow")
+	assert.EqualString(t, output("192.168.1.200:1234", "grafana", "/admin"), "allow")
+
+	// non-canonical paths can't be used to sneak past path scopes
+	assert.EqualString(t, output("203.0.113.9:1234", "wiki", "/public/../admin"), "your IP (203.0.113.9) is not allowed (implicit deny)")
+	assert.EqualString(t, output("192.168.1.200:1234", "wiki", "//admin/users"), "your IP (192.168.1.200) is not allowed (explicit deny)")
+	assert.EqualString(t, output("192.168.1.200:1234", "wiki", "/admin/./users"), "your IP (192.168.1.200) is not allowed (explicit deny)")
+	assert.EqualString(t, output("192.168.1.200:1234", "wiki", "/public/./../admin/"), "your IP (192.168.1.200) is not allowed (explicit deny)")
+	assert.EqualString(t, output("203.0.113.9:1234", "wiki", "/admin/../public/"), "allow")
+}
+
+func TestCanonicalPath(t *testing.T) {
+	for _, tc := range []struct {
+		input  string
+		output string
+	}{
+		{"/", "/"},
+		{"", "/"},
+		{"/admin", "/admin"},
+		{"/admin/", "/admin/"},
+		{"/public/../admin", "/admin"},
+		{"//admin/users", "/admin/users"},
+		{"/admin/./x", "/admin/x"},
+		{"/../../admin/", "/admin/"},
+		{"/a/..", "/"},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			assert.EqualString(t, canonicalPath(tc.input), tc.output)
+		})
+	}
+}
+
+func TestParseHclRulesErrors(t *testing.T) {
+	parseErr := func(content string) string {
+		_, err := parseHclRules(strings.NewReader(content))
+		if err == nil {
+			return ""
+		}
+
+		return err.Error()
+	}
+
+	assert.EqualString(t, parseErr(`allow_all { prefix = "10.0.0.0/33" }`), `allow_all[0]: prefix: netip.ParsePrefix("10.0.0.0/33"): prefix length out of range`)
+	assert.EqualString(t, parseErr(`allow_specified { prefix = "10.0.0.0/8" }`), "allow_specified[0]: apps: required")
+	assert.EqualString(t, parseErr(`deny { ip_sets = ["office"] }`), "deny[0]: ip_sets: not defined: office")
+	assert.EqualString(t, parseErr(`allow { apps = ["wiki"] }`), "allow[0]: prefixes or ip_sets required")
+	assert.EqualString(t, parseErr(`allow { prefixes = ["10.0.0.0/8"] paths = ["admin"] }`), "allow[0]: paths: must start with '/': admin")
+	assert.EqualString(t, parseErr(`ip_set { name = "office" prefixes = ["10.0.0.1"] }`), `ip_set office: prefix: netip.ParsePrefix("10.0.0.1"): no '/'`)
+	assert.EqualString(t, parseErr(`ip_set { name = "office" }`), "ip_set office: prefixes: required")
+	assert.EqualString(t, parseErr(``), "empty IP rules file")
+}
+
+func TestReadIPRules(t *testing.T) {
+	fileRules, err := parseHclRules(strings.NewReader(`
+allow_all { prefix = "10.0.0.0/8" }
+allow_specified {
+	prefix = "10.1.0.0/16"
+	apps = ["wiki"]
+}
+`))
+	assert.Ok(t, err)
+
+	discovery := &ipRulesDiscovery{
+		Reader: erdiscovery.StaticDiscovery(nil),
+		rules: []erconfig.IPRule{
+			erconfig.IPRuleAllowOnlyApps("172.16.0.0/16", "contractors", "wiki"),
+			erconfig.IPRuleAllowAllApps("172.16.2.3/32", "contractor lead"),
+			erconfig.IPRuleAllowOnlyApps("10.9.0.0/16", "shadowed by the file's rule", "wiki"),
+		},
+	}
+
+	rules, err := readIPRules(context.Background(), discovery, fileRules)
+	assert.Ok(t, err)
+
+	output := func(ip string, app string) string {
+		if allowed, errStr := ipAllowed(ip+":1234", app, "/", rules); !allowed {
+			return errStr
+		}
+
+		return "allow"
+	}
+
+	// file's rules first, in file order
+	assert.EqualString(t, output("10.9.9.9", "grafana"), "allow")
+	assert.EqualString(t, output("10.1.9.9", "grafana"), "allow")
+	// then discovered rules, most specific first
+	assert.EqualString(t, output("172.16.9.9", "wiki"), "allow")
+	assert.EqualString(t, output("172.16.9.9", "grafana"), "your IP (172.16.9.9) is not allowed (explicit deny)")
+	assert.EqualString(t, output("172.16.2.3", "grafana"), "allow")
+	assert.EqualString(t, output("192.168.1.1", "wiki"), "your IP (192.168.1.1) is not allowed (implicit deny)")
+
+	discovery.rules = append(discovery.rules, erconfig.IPRule{Prefix: "10.2.0.0/33"})
+	_, err = readIPRules(context.Background(), discovery, fileRules)
+	assert.EqualString(t, err.Error(), `IP rule 10.2.0.0/33: Prefix: netip.ParsePrefix("10.2.0.0/33"): prefix length out of range`)
+}
+
+type ipRulesDiscovery struct {
+	erdiscovery.Reader
+	rules []erconfig.IPRule
+}
+
+func (i *ipRulesDiscovery) ReadIPRules(context.Context) ([]erconfig.IPRule, error) {
+	return i.rules, nil
+}
@@ -1,6 +1,8 @@
 package erserver
 
 import (
+	"io"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -9,9 +11,19 @@ const (
 )
 
 type metricsStore struct {
-	requestsOk      *prometheus.CounterVec
-	requestsFail    *prometheus.CounterVec
-	requestDuration *prometheus.HistogramVec
+	requestsOk       *prometheus.CounterVec
+	requestsFail     *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	requestSize      *prometheus.HistogramVec
+	responseSize     *prometheus.HistogramVec
+	requestsInFlight *prometheus.GaugeVec
+	requestsQueued   *prometheus.GaugeVec
+	requestsShed     *prometheus.CounterVec
+	concurrencyLimit *prometheus.GaugeVec
+	configSyncOk     prometheus.Counter
+	configSyncFail   prometheus.Counter
+	configSyncLastOk prometheus.Gauge
+	configRejected   *prometheus.GaugeVec
 }
 
 func incAppCodeMethodCounter(
@@ -24,10 +36,40 @@ func incAppCodeMethodCounter(
 	counter.WithLabelValues(allAppKey, code, method).Inc()
 }
 
+// observes for both the app and all apps
+func observeApp(histogram *prometheus.HistogramVec, app string, value float64) {
+	histogram.WithLabelValues(app).Observe(value)
+	histogram.WithLabelValues(allAppKey).Observe(value)
+}
+
+// records the result of a config sync (both the initial one and the scheduled ones)
+func (m *metricsStore) observeSync(conf *frontendMatchers, err error) {
+	if err != nil {
+		m.configSyncFail.Inc()
+		return
+	}
+
+	m.configSyncOk.Inc()
+	m.configSyncLastOk.SetToCurrentTime()
+	m.observeRejected(conf.rejected)
+}
+
+// replaces the previous sync's counts, so fixed apps don't linger
+func (m *metricsStore) observeRejected(rejected []rejectedConfig) {
+	m.configRejected.Reset()
+
+	for _, r := range rejected {
+		m.configRejected.WithLabelValues(r.appID).Inc()
+	}
+}
+
 func initMetrics() *metricsStore {
 	// from 0.25ms to 8 seconds
 	timeBuckets := prometheus.ExponentialBuckets(0.00025, 2, 16)
 
+	// from 64 bytes to 16 MB
+	sizeBuckets := prometheus.ExponentialBuckets(64, 4, 10)
+
 	m := &metricsStore{
 		requestsOk: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "er_requests_ok",
@@ -40,11 +82,75 @@ func initMetrics() *metricsStore {
 			Buckets: timeBuckets,
 			Help:    "Histogram of the time (in seconds) each request took.",
 		}, []string{"app"}),
+		requestSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "er_request_size_bytes",
+			Buckets: sizeBuckets,
+			Help:    "Histogram of request body sizes.",
+		}, []string{"app"}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "er_response_size_bytes",
+			Buckets: sizeBuckets,
+			Help:    "Histogram of response body sizes.",
+		}, []string{"app"}),
+		requestsInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "er_requests_in_flight",
+			Help: "Requests currently being served by the app's backend.",
+		}, []string{"app"}),
+		requestsQueued: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "er_requests_queued",
+			Help: "Requests waiting for the app's concurrency limit to let them through.",
+		}, []string{"app"}),
+		requestsShed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "er_requests_shed",
+			Help: "Requests rejected with 503 due to the app's concurrency limit, by reason.",
+		}, []string{"app", "reason"}),
+		concurrencyLimit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "er_concurrency_limit",
+			Help: "Configured max concurrent requests of the app (compare with er_requests_in_flight).",
+		}, []string{"app"}),
+		configSyncOk: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "er_config_sync_ok",
+			Help: "Successful syncs of apps from discovery.",
+		}),
+		configSyncFail: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "er_config_sync_fail",
+			Help: "Failed syncs of apps from discovery (previous config stays in use).",
+		}),
+		configSyncLastOk: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "er_config_sync_last_ok_timestamp_seconds",
+			Help: "Unix time of the last successful sync of apps from discovery.",
+		}),
+		configRejected: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "er_config_rejected",
+			Help: "Apps or frontends left out of the current config due to an error in their config.",
+		}, []string{"app"}),
 	}
 
 	prometheus.MustRegister(m.requestsOk)
 	prometheus.MustRegister(m.requestsFail)
 	prometheus.MustRegister(m.requestDuration)
+	prometheus.MustRegister(m.requestSize)
+	prometheus.MustRegister(m.responseSize)
+	prometheus.MustRegister(m.requestsInFlight)
+	prometheus.MustRegister(m.requestsQueued)
+	prometheus.MustRegister(m.requestsShed)
+	prometheus.MustRegister(m.concurrencyLimit)
+	prometheus.MustRegister(m.configSyncOk)
+	prometheus.MustRegister(m.configSyncFail)
+	prometheus.MustRegister(m.configSyncLastOk)
+	prometheus.MustRegister(m.configRejected)
 
 	return m
 }
+
+// counts the request body bytes the backend actually read (Content-Length is missing for chunked bodies)
+type countingBody struct {
+	io.ReadCloser
+	bytesRead int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.bytesRead += int64(n)
+	return n, err
+}
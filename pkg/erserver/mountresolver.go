@@ -2,9 +2,11 @@ package erserver
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"reflect"
 	"regexp"
 	"sort"
 	"strings"
@@ -14,14 +16,17 @@ import (
 )
 
 type hostnameRegexp struct {
-	Regexp *regexp.Regexp
-	Mounts MountList
+	Regexp    *regexp.Regexp
+	Mounts    MountList
+	tlsPolicy *tlsPolicy
 }
 
 type Mount struct {
 	prefix            string
 	stripPrefix       bool
+	conditions        *requestConditions // nil if no additional matchers
 	App               erconfig.Application
+	frontend          string // description of the frontend that mounted this (for logs)
 	backend           http.Handler
 	allowInsecureHTTP bool
 }
@@ -29,112 +34,290 @@ type Mount struct {
 // these are ordered from longest to shortest
 type MountList []Mount
 
-// order mount list based on the path length, so longer paths are considered before root
+// order mount list based on the path length, so longer paths are considered before root.
+// for the same path, mounts with additional matchers (e.g. "Upgrade: websocket") are considered
+// before the ones without, so they're not shadowed by the catch-all.
 func (m MountList) sortMountsFromLongestToShortest(i, j int) bool {
-	return len(m[i].prefix) > len(m[j].prefix)
+	if len(m[i].prefix) != len(m[j].prefix) {
+		return len(m[i].prefix) > len(m[j].prefix)
+	}
+
+	return m[i].conditions != nil && m[j].conditions == nil
 }
 
 type frontendMatchers struct {
-	Hostname       map[string]MountList // hostname equality
-	hostnameRegexp []hostnameRegexp
-	PathPrefix     MountList // global "all hostnames" path prefix rules like http://ANY_HOSTNAME/.well-known/acme-challenge/TOKEN
-	Apps           []erconfig.Application
-	timestamp      time.Time
+	Hostname                  map[string]MountList // hostname equality
+	hostnameTLSPolicy         map[string]*tlsPolicy
+	hostnameWildcard          map[string]MountList // "*.example.com" is keyed by "example.com"
+	hostnameWildcardTLSPolicy map[string]*tlsPolicy
+	hostnameRegexp            []hostnameRegexp
+	PathPrefix                MountList // global "all hostnames" path prefix rules like http://ANY_HOSTNAME/.well-known/acme-challenge/TOKEN
+	Apps                      []erconfig.Application
+	ipRules                   []ipRule // empty = no IP filtering
+	rejected                  []rejectedConfig
+	mountedBy                 map[string]mountedFrontend // [frontendConflictKey] => who has the mount
+	timestamp                 time.Time
 }
 
 func newFrontendMatchers(apps []erconfig.Application, timestamp time.Time) *frontendMatchers {
 	return &frontendMatchers{
-		Hostname:       map[string]MountList{},
-		hostnameRegexp: []hostnameRegexp{},
-		PathPrefix:     MountList{},
-		Apps:           apps,
-		timestamp:      timestamp,
+		Hostname:                  map[string]MountList{},
+		hostnameTLSPolicy:         map[string]*tlsPolicy{},
+		hostnameWildcard:          map[string]MountList{},
+		hostnameWildcardTLSPolicy: map[string]*tlsPolicy{},
+		hostnameRegexp:            []hostnameRegexp{},
+		PathPrefix:                MountList{},
+		Apps:                      apps,
+		mountedBy:                 map[string]mountedFrontend{},
+		timestamp:                 timestamp,
 	}
 }
 
-// transforms config (erconfig.Application) to concrerete instances (http.Handler) of backend for each app
+// transforms config (erconfig.Application) to concrerete instances (http.Handler) of backend for each app.
+// one app's bad config must not take down the others, so apps (or their frontends) that can't be
+// mounted are left out and reported in frontendMatchers.rejected.
 func appConfigToHandlersAndMatchers(
 	ctx context.Context,
 	apps []erconfig.Application,
+	previous *frontendMatchers, // nil if there's no previous config
 	currentConfig erconfig.CurrentConfigAccessor,
+	acmeChallengeHandler http.Handler,
 	timestamp time.Time,
 	parentLogger *slog.Logger,
-) (*frontendMatchers, error) {
+) *frontendMatchers {
 	fem := newFrontendMatchers(apps, timestamp)
 
-	for _, app := range apps {
-		backend, err := makeBackend(ctx, app.ID, app.Backend, currentConfig, parentLogger)
+	// mounts that would match exactly the same requests => only one of them could ever be used.
+	// the one mounted first stays. the app that had the mount in the previous config goes first, so
+	// a newly discovered app can't hijack an existing app's traffic. after that it's by app ID, so
+	// the winner doesn't depend on discovery order (which isn't stable with most discovery sources).
+	sorted := append([]erconfig.Application{}, apps...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	backends := make([]http.Handler, len(sorted)) // nil if the app was rejected
+	for i, app := range sorted {
+		backend, err := makeBackend(ctx, app.ID, app.Backend, currentConfig, acmeChallengeHandler, parentLogger)
 		if err != nil {
-			return nil, fmt.Errorf("makeBackend: %s: %w", app.ID, err)
+			fem.reject(app.ID, fmt.Errorf("makeBackend: %s: %w", app.ID, err))
+			continue
 		}
 
-		for _, frontend := range app.Frontends {
-			mount := Mount{
-				App:               app,
-				backend:           backend,
-				prefix:            frontend.PathPrefix,
-				stripPrefix:       frontend.StripPathPrefix,
-				allowInsecureHTTP: frontend.AllowInsecureHTTP,
+		backends[i] = backend
+	}
+
+	hadMount := func(app erconfig.Application, frontend erconfig.Frontend) bool {
+		return previous != nil && previous.mountedBy[frontendConflictKey(frontend)].appID == app.ID
+	}
+
+	hostnameRegexpIdx := map[string]int{} // same regexp (with different paths) shares one entry
+
+	for _, previousOwners := range []bool{true, false} {
+		for i, app := range sorted {
+			if backends[i] == nil {
+				continue
 			}
 
-			switch frontend.Kind {
-			case erconfig.FrontendKindHostname:
-				if _, exists := fem.Hostname[frontend.Hostname]; !exists {
-					fem.Hostname[frontend.Hostname] = MountList{}
+			for _, frontend := range app.Frontends {
+				if hadMount(app, frontend) != previousOwners {
+					continue
 				}
 
-				mountList := fem.Hostname[frontend.Hostname]
+				if err := fem.mount(app, frontend, backends[i], hostnameRegexpIdx); err != nil {
+					fem.reject(app.ID, err)
+				}
+			}
+		}
+	}
 
-				// TODO: detect duplicate (hostname, pathprefix) combos
+	// we can't know which of two overlapping regexps is more specific, but we can at least make
+	// the order independent of the order in which apps were discovered. longer is a decent guess.
+	sort.SliceStable(fem.hostnameRegexp, func(i, j int) bool {
+		ri, rj := fem.hostnameRegexp[i].Regexp.String(), fem.hostnameRegexp[j].Regexp.String()
+		if len(ri) != len(rj) {
+			return len(ri) > len(rj)
+		}
 
-				mountList = append(mountList, mount)
+		return ri < rj
+	})
 
-				sort.Slice(mountList, mountList.sortMountsFromLongestToShortest)
+	bendCache.Prune(apps)
 
-				fem.Hostname[frontend.Hostname] = mountList
-			case erconfig.FrontendKindHostnameRegexp:
-				re, err := hostnameRegexpSyntaxToRegexp(frontend.HostnameRegexp)
-				if err != nil {
-					return nil, err
-				}
+	return fem
+}
+
+// validates the frontend and adds a mount for it. on error nothing is changed.
+func (fem *frontendMatchers) mount(
+	app erconfig.Application,
+	frontend erconfig.Frontend,
+	backend http.Handler,
+	hostnameRegexpIdx map[string]int,
+) error {
+	if err := frontend.Validate(); err != nil {
+		return fmt.Errorf("%s: frontend %s: %w", app.ID, frontend.Describe(), err)
+	}
+
+	key := frontendConflictKey(frontend)
+	if previous, conflicting := fem.mountedBy[key]; conflicting {
+		if previous.appID == app.ID && reflect.DeepEqual(previous.frontend, frontend) {
+			return nil // harmless duplicate (e.g. from expanding "Host(`a`, `a`)")
+		}
+
+		return fmt.Errorf(
+			"frontend %s of %s conflicts with frontend %s of %s",
+			frontend.Describe(),
+			app.ID,
+			previous.frontend.Describe(),
+			previous.appID)
+	}
+
+	conditions, err := newRequestConditions(frontend)
+	if err != nil {
+		return fmt.Errorf("%s: %w", app.ID, err)
+	}
+
+	mount := Mount{
+		App:               app,
+		frontend:          frontend.Describe(),
+		backend:           backend,
+		prefix:            frontend.PathPrefix,
+		stripPrefix:       frontend.StripPathPrefix,
+		conditions:        conditions,
+		allowInsecureHTTP: frontend.AllowInsecureHTTP,
+	}
+
+	// TLS policy can't differ between frontends of same hostname. it's not shadowing
+	// in the same sense as mount conflicts, but it's a conflict nonetheless.
+	withTLSPolicy := func(hostnamePolicy *tlsPolicy) (*tlsPolicy, error) {
+		if err := setTLSPolicy(&hostnamePolicy, frontend, app.Backend); err != nil {
+			return nil, fmt.Errorf("%s: %w", app.ID, err)
+		}
+
+		return hostnamePolicy, nil
+	}
+
+	switch frontend.Kind {
+	case erconfig.FrontendKindHostname:
+		policy, err := withTLSPolicy(fem.hostnameTLSPolicy[frontend.Hostname])
+		if err != nil {
+			return err
+		}
+
+		fem.Hostname[frontend.Hostname] = fem.Hostname[frontend.Hostname].with(mount)
+		fem.hostnameTLSPolicy[frontend.Hostname] = policy
+	case erconfig.FrontendKindHostnameWildcard:
+		parent := strings.TrimPrefix(frontend.Hostname, "*.")
 
-				// TODO: support for same regexp multiple times, with different paths
+		policy, err := withTLSPolicy(fem.hostnameWildcardTLSPolicy[parent])
+		if err != nil {
+			return err
+		}
 
-				fem.hostnameRegexp = append(fem.hostnameRegexp, hostnameRegexp{
-					Regexp: re,
-					Mounts: MountList{mount},
-				})
-			case erconfig.FrontendKindPathPrefix:
-				fem.PathPrefix = append(fem.PathPrefix, mount)
+		fem.hostnameWildcard[parent] = fem.hostnameWildcard[parent].with(mount)
+		fem.hostnameWildcardTLSPolicy[parent] = policy
+	case erconfig.FrontendKindHostnameRegexp:
+		if idx, exists := hostnameRegexpIdx[frontend.HostnameRegexp]; exists {
+			policy, err := withTLSPolicy(fem.hostnameRegexp[idx].tlsPolicy)
+			if err != nil {
+				return err
+			}
+
+			fem.hostnameRegexp[idx].Mounts = fem.hostnameRegexp[idx].Mounts.with(mount)
+			fem.hostnameRegexp[idx].tlsPolicy = policy
+		} else {
+			re, err := hostnameRegexpSyntaxToRegexp(frontend.HostnameRegexp)
+			if err != nil {
+				return fmt.Errorf("%s: %w", app.ID, err)
+			}
 
-				sort.Slice(fem.PathPrefix, fem.PathPrefix.sortMountsFromLongestToShortest)
-			default:
-				return nil, fmt.Errorf("unsupported frontend kind: %s", frontend.Kind)
+			policy, err := withTLSPolicy(nil)
+			if err != nil {
+				return err
 			}
+
+			hostnameRegexpIdx[frontend.HostnameRegexp] = len(fem.hostnameRegexp)
+
+			fem.hostnameRegexp = append(fem.hostnameRegexp, hostnameRegexp{
+				Regexp:    re,
+				Mounts:    MountList{mount},
+				tlsPolicy: policy,
+			})
 		}
+	case erconfig.FrontendKindPathPrefix:
+		fem.PathPrefix = fem.PathPrefix.with(mount)
+	default:
+		return fmt.Errorf("%s: unsupported frontend kind: %s", app.ID, frontend.Kind)
 	}
 
-	return fem, nil
+	fem.mountedBy[key] = mountedFrontend{app.ID, frontend}
+
+	return nil
 }
 
-func resolveMount(hostname string, path string, matchers *frontendMatchers) *Mount {
-	pathMatches := func(mount Mount) bool {
-		if mount.prefix == "/" { // always matches
-			return true
+func (fem *frontendMatchers) reject(appID string, err error) {
+	fem.rejected = append(fem.rejected, rejectedConfig{appID, err})
+}
+
+// an app or one of its frontends that was left out of the config
+type rejectedConfig struct {
+	appID string
+	err   error
+}
+
+type mountedFrontend struct {
+	appID    string
+	frontend erconfig.Frontend
+}
+
+// frontends with the same key match exactly the same requests
+func frontendConflictKey(frontend erconfig.Frontend) string {
+	host := func() string {
+		switch frontend.Kind {
+		case erconfig.FrontendKindHostnameRegexp:
+			return frontend.HostnameRegexp
+		case erconfig.FrontendKindPathPrefix:
+			return ""
+		default:
+			return frontend.Hostname
 		}
+	}()
+
+	// "/foo/" and "/foo" match the same paths
+	prefix := strings.TrimRight(frontend.PathPrefix, "/")
+
+	methods := append([]string{}, frontend.Methods...)
+	sort.Strings(methods)
+
+	// JSON is just a convenient way to get an unambiguous representation
+	conditions, _ := json.Marshal([]any{methods, frontend.Headers, frontend.Queries, frontend.PathRegexp})
 
-		// normalize "/foo/" => "/foo"
-		prefix := strings.TrimRight(mount.prefix, "/")
+	return strings.Join([]string{string(frontend.Kind), host, prefix, string(conditions)}, "\x00")
+}
+
+// returns a new list with mount added in its correct position
+func (m MountList) with(mount Mount) MountList {
+	mountList := append(append(MountList{}, m...), mount)
+
+	sort.SliceStable(mountList, mountList.sortMountsFromLongestToShortest)
+
+	return mountList
+}
 
-		// prefix="/foo" should match "/foo", "/foo/.*" but not "/foobar"
-		matches := path == prefix || strings.HasPrefix(path, prefix+"/")
+// hostname is given separately, because it's already normalized from r.Host
+func resolveMount(hostname string, r *http.Request, matchers *frontendMatchers) *Mount {
+	path := r.URL.Path
 
-		return matches
+	mountMatches := func(mount Mount) bool {
+		if !pathPrefixMatches(mount, path) {
+			return false
+		}
+
+		// additional matchers (method, headers ...) are evaluated last, since they're the least common
+		return mount.conditions.matches(r)
 	}
 
 	// hostname-independent path-based mounts
 	for _, mount := range matchers.PathPrefix {
-		if pathMatches(mount) {
+		if mountMatches(mount) {
 			return &mount
 		}
 	}
@@ -142,20 +325,29 @@ func resolveMount(hostname string, path string, matchers *frontendMatchers) *Mou
 	// try with exact hostname. this will probably be the most common case
 	if hostnameMounts, hostnameFound := matchers.Hostname[hostname]; hostnameFound {
 		for _, mount := range hostnameMounts {
-			if pathMatches(mount) {
+			if mountMatches(mount) {
 				return &mount
 			}
 		}
 	}
 
-	// try regexp-based hostnames
+	// wildcard only covers the leftmost label, so "a.b.example.com" is not looked up from "*.example.com"
+	if _, parent, hasParent := strings.Cut(hostname, "."); hasParent {
+		for _, mount := range matchers.hostnameWildcard[parent] {
+			if mountMatches(mount) {
+				return &mount
+			}
+		}
+	}
+
+	// try regexp-based hostnames (they're ordered from the longest regexp to shortest)
 	for _, hostnameRegexp := range matchers.hostnameRegexp {
 		if !hostnameRegexp.Regexp.MatchString(hostname) {
 			continue
 		}
 
 		for _, mount := range hostnameRegexp.Mounts {
-			if pathMatches(mount) {
+			if mountMatches(mount) {
 				return &mount
 			}
 		}
@@ -163,3 +355,15 @@ func resolveMount(hostname string, path string, matchers *frontendMatchers) *Mou
 
 	return nil // will be a 404
 }
+
+func pathPrefixMatches(mount Mount, path string) bool {
+	if mount.prefix == "/" { // always matches
+		return true
+	}
+
+	// normalize "/foo/" => "/foo"
+	prefix := strings.TrimRight(mount.prefix, "/")
+
+	// prefix="/foo" should match "/foo", "/foo/.*" but not "/foobar"
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
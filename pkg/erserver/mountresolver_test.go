@@ -2,6 +2,9 @@ package erserver
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -37,20 +40,227 @@ func TestMountResolver(t *testing.T) {
 			erconfig.RedirectBackend("http://example.net/5")),
 	}
 
-	matchers, err := appConfigToHandlersAndMatchers(context.Background(), apps, nil, time.Date(2021, 6, 30, 15, 17, 0, 0, time.UTC), nil)
-	assert.Ok(t, err)
+	matchers := appConfigToHandlersAndMatchers(context.Background(), apps, nil, nil, nil, time.Date(2021, 6, 30, 15, 17, 0, 0, time.UTC), nil)
+	assert.EqualString(t, rejectedErrors(matchers), "")
 
-	assert.Assert(t, resolveMount("notfound.net", "/", matchers) == nil)
+	assert.Assert(t, resolveMount("notfound.net", get("/"), matchers) == nil)
 
-	assert.EqualString(t, resolveMount("example.com", "/", matchers).App.ID, "examplecom-app")
-	assert.EqualString(t, resolveMount("example.com", "/lollotilol", matchers).App.ID, "examplecom-app")
+	assert.EqualString(t, resolveMount("example.com", get("/"), matchers).App.ID, "examplecom-app")
+	assert.EqualString(t, resolveMount("example.com", get("/lollotilol"), matchers).App.ID, "examplecom-app")
 
-	assert.Assert(t, resolveMount("docs.example.com", "/", matchers).App.ID == "examplecom-docs-root")
-	assert.EqualString(t, resolveMount("docs.example.com", "/foo", matchers).App.ID, "examplecom-docs-foo")
-	assert.EqualString(t, resolveMount("docs.example.com", "/foo/", matchers).App.ID, "examplecom-docs-foo")
-	assert.EqualString(t, resolveMount("docs.example.com", "/foo/stuff", matchers).App.ID, "examplecom-docs-foo")
-	assert.EqualString(t, resolveMount("docs.example.com", "/foobar", matchers).App.ID, "examplecom-docs-root")
-	assert.EqualString(t, resolveMount("docs.example.com", "/bar", matchers).App.ID, "examplecom-docs-bar")
-	assert.EqualString(t, resolveMount("docs.example.com", "/.well-known/acme-challenge/TOKEN", matchers).App.ID, "acme-challenge")
-	assert.EqualString(t, resolveMount("docs.example.com", "/.well-known/test", matchers).App.ID, "well-known")
+	assert.Assert(t, resolveMount("docs.example.com", get("/"), matchers).App.ID == "examplecom-docs-root")
+	assert.EqualString(t, resolveMount("docs.example.com", get("/foo"), matchers).App.ID, "examplecom-docs-foo")
+	assert.EqualString(t, resolveMount("docs.example.com", get("/foo/"), matchers).App.ID, "examplecom-docs-foo")
+	assert.EqualString(t, resolveMount("docs.example.com", get("/foo/stuff"), matchers).App.ID, "examplecom-docs-foo")
+	assert.EqualString(t, resolveMount("docs.example.com", get("/foobar"), matchers).App.ID, "examplecom-docs-root")
+	assert.EqualString(t, resolveMount("docs.example.com", get("/bar"), matchers).App.ID, "examplecom-docs-bar")
+	assert.EqualString(t, resolveMount("docs.example.com", get("/.well-known/acme-challenge/TOKEN"), matchers).App.ID, "acme-challenge")
+	assert.EqualString(t, resolveMount("docs.example.com", get("/.well-known/test"), matchers).App.ID, "well-known")
+}
+
+func TestMountResolverAdditionalMatchers(t *testing.T) {
+	apps := []erconfig.Application{
+		erconfig.SimpleApplication(
+			"web",
+			erconfig.SimpleHostnameFrontend("example.com"),
+			erconfig.RedirectBackend("http://example.net/1")),
+		erconfig.SimpleApplication(
+			"websocket",
+			erconfig.SimpleHostnameFrontend("example.com", erconfig.HeaderRegexp("Upgrade", "(?i)^websocket$")),
+			erconfig.RedirectBackend("http://example.net/2")),
+		erconfig.SimpleApplication(
+			"api-v1",
+			erconfig.SimpleHostnameFrontend("example.com", erconfig.PathPrefix("/api/")),
+			erconfig.RedirectBackend("http://example.net/3")),
+		erconfig.SimpleApplication(
+			"api-v2",
+			erconfig.SimpleHostnameFrontend("example.com", erconfig.PathPrefix("/api/"), erconfig.HeaderEquals("X-Api-Version", "2")),
+			erconfig.RedirectBackend("http://example.net/4")),
+		erconfig.SimpleApplication(
+			"user-writes",
+			erconfig.SimpleHostnameFrontend("example.com",
+				erconfig.Methods("POST", "PUT"),
+				erconfig.PathRegexp("^/users/[0-9]+$"),
+				erconfig.QueryEquals("dryrun", "false")),
+			erconfig.RedirectBackend("http://example.net/5")),
+	}
+
+	matchers := appConfigToHandlersAndMatchers(context.Background(), apps, nil, nil, nil, time.Date(2021, 6, 30, 15, 17, 0, 0, time.UTC), nil)
+	assert.EqualString(t, rejectedErrors(matchers), "")
+
+	withHeader := func(r *http.Request, key string, value string) *http.Request {
+		r.Header.Set(key, value)
+		return r
+	}
+
+	resolvedID := func(r *http.Request) string {
+		return resolveMount("example.com", r, matchers).App.ID
+	}
+
+	assert.EqualString(t, resolvedID(get("/")), "web")
+	assert.EqualString(t, resolvedID(withHeader(get("/"), "Upgrade", "WebSocket")), "websocket")
+	assert.EqualString(t, resolvedID(withHeader(get("/"), "Upgrade", "h2c")), "web")
+
+	assert.EqualString(t, resolvedID(get("/api/users")), "api-v1")
+	assert.EqualString(t, resolvedID(withHeader(get("/api/users"), "X-Api-Version", "2")), "api-v2")
+	assert.EqualString(t, resolvedID(withHeader(get("/api/users"), "x-api-version", "2")), "api-v2")
+	assert.EqualString(t, resolvedID(withHeader(get("/api/users"), "X-Api-Version", "3")), "api-v1")
+
+	assert.EqualString(t, resolvedID(httptest.NewRequest(http.MethodPost, "/users/123?dryrun=false", nil)), "user-writes")
+	assert.EqualString(t, resolvedID(httptest.NewRequest(http.MethodPost, "/users/123?dryrun=true", nil)), "web")
+	assert.EqualString(t, resolvedID(httptest.NewRequest(http.MethodPost, "/users/123/avatar?dryrun=false", nil)), "web")
+	assert.EqualString(t, resolvedID(get("/users/123?dryrun=false")), "web")
+}
+
+func TestMountResolverHostnamePrecedence(t *testing.T) {
+	apps := []erconfig.Application{
+		// regexps first so we know order of discovery doesn't matter
+		erconfig.SimpleApplication(
+			"regexp",
+			erconfig.RegexpHostnameFrontend("{[a-z]+}.example.com"),
+			erconfig.RedirectBackend("http://example.net/1")),
+		erconfig.SimpleApplication(
+			"regexp-multi-level",
+			erconfig.RegexpHostnameFrontend("{.+}.example.com"),
+			erconfig.RedirectBackend("http://example.net/2")),
+		erconfig.SimpleApplication(
+			"regexp-api",
+			erconfig.RegexpHostnameFrontend("{[a-z]+}.example.com", erconfig.PathPrefix("/api")),
+			erconfig.RedirectBackend("http://example.net/3")),
+		erconfig.SimpleApplication(
+			"wildcard",
+			erconfig.WildcardHostnameFrontend("*.example.com"),
+			erconfig.RedirectBackend("http://example.net/4")),
+		erconfig.SimpleApplication(
+			"exact",
+			erconfig.SimpleHostnameFrontend("www.example.com"),
+			erconfig.RedirectBackend("http://example.net/5")),
+	}
+
+	matchers := appConfigToHandlersAndMatchers(context.Background(), apps, nil, nil, nil, time.Date(2021, 6, 30, 15, 17, 0, 0, time.UTC), nil)
+	assert.EqualString(t, rejectedErrors(matchers), "")
+
+	resolvedID := func(hostname string, path string) string {
+		mount := resolveMount(hostname, get(path), matchers)
+		if mount == nil {
+			return "(not found)"
+		}
+
+		return mount.App.ID
+	}
+
+	assert.EqualString(t, resolvedID("www.example.com", "/api"), "exact")
+	assert.EqualString(t, resolvedID("foo.example.com", "/api"), "wildcard")
+	assert.EqualString(t, resolvedID("foo.bar.example.com", "/api"), "regexp-multi-level")
+	assert.EqualString(t, resolvedID("example.com", "/"), "(not found)")
+
+	// regexps with the same pattern share mounts
+	matchers = appConfigToHandlersAndMatchers(context.Background(), apps[0:3], nil, nil, nil, time.Date(2021, 6, 30, 15, 17, 0, 0, time.UTC), nil)
+	assert.EqualString(t, rejectedErrors(matchers), "")
+
+	// longer regexp is tried first
+	assert.EqualString(t, resolvedID("foo.example.com", "/"), "regexp")
+	assert.EqualString(t, resolvedID("foo.example.com", "/api/x"), "regexp-api")
+	assert.EqualString(t, resolvedID("foo.bar.example.com", "/api/x"), "regexp-multi-level")
+}
+
+func TestMountResolverConflicts(t *testing.T) {
+	build := func(apps ...erconfig.Application) *frontendMatchers {
+		return appConfigToHandlersAndMatchers(context.Background(), apps, nil, nil, nil, time.Date(2021, 6, 30, 15, 17, 0, 0, time.UTC), nil)
+	}
+
+	app := func(id string, frontends ...erconfig.Frontend) erconfig.Application {
+		return erconfig.Application{
+			ID:        id,
+			Frontends: frontends,
+			Backend:   erconfig.RedirectBackend("http://example.net/"),
+		}
+	}
+
+	assert.EqualString(t, rejectedErrors(build(
+		app("a", erconfig.SimpleHostnameFrontend("example.com")),
+		app("b", erconfig.SimpleHostnameFrontend("example.com", erconfig.PathPrefix("/b"))),
+		app("c", erconfig.SimpleHostnameFrontend("example.com", erconfig.Methods("POST"))),
+		app("d", erconfig.WildcardHostnameFrontend("*.example.com")),
+		app("e", erconfig.PathPrefixFrontend("/")),
+		// same app having the same frontend twice is harmless
+		app("f", erconfig.SimpleHostnameFrontend("f.com"), erconfig.SimpleHostnameFrontend("f.com")),
+	)), "")
+
+	matchers := build(
+		app("a", erconfig.SimpleHostnameFrontend("example.com", erconfig.PathPrefix("/foo"))),
+		app("b", erconfig.SimpleHostnameFrontend("example.com", erconfig.PathPrefix("/foo/")), erconfig.SimpleHostnameFrontend("b.example.com")),
+	)
+	assert.EqualString(t, rejectedErrors(matchers), "frontend hostname:example.com/foo/ of b conflicts with frontend hostname:example.com/foo of a")
+	// the conflicting frontend is left out, but the rest keep working
+	assert.EqualString(t, resolveMount("example.com", get("/foo/"), matchers).App.ID, "a")
+	assert.EqualString(t, resolveMount("b.example.com", get("/"), matchers).App.ID, "b")
+
+	assert.EqualString(t, rejectedErrors(build(
+		app("a", erconfig.SimpleHostnameFrontend("example.com", erconfig.Methods("GET", "HEAD"))),
+		app("b", erconfig.SimpleHostnameFrontend("example.com", erconfig.Methods("HEAD", "GET"))),
+		app("c", erconfig.RegexpHostnameFrontend("{[a-z]+}.example.com")),
+		app("d", erconfig.RegexpHostnameFrontend("{[a-z]+}.example.com")),
+	)), `frontend hostname:example.com/ [method=HEAD|GET] of b conflicts with frontend hostname:example.com/ [method=GET|HEAD] of a
+frontend hostname_regexp:{[a-z]+}.example.com/ of d conflicts with frontend hostname_regexp:{[a-z]+}.example.com/ of c`)
+
+	matchers = build(
+		app("a", erconfig.SimpleHostnameFrontend("*.example.com")),
+		app("b", erconfig.SimpleHostnameFrontend("example.com")),
+	)
+	assert.EqualString(t, rejectedErrors(matchers), "a: frontend hostname:*.example.com/: Hostname: '*.example.com' looks like a wildcard. use kind hostname_wildcard")
+	assert.EqualString(t, resolveMount("example.com", get("/"), matchers).App.ID, "b")
+}
+
+func TestMountResolverConflictWinnerIsStable(t *testing.T) {
+	build := func(previous *frontendMatchers, apps ...erconfig.Application) *frontendMatchers {
+		return appConfigToHandlersAndMatchers(context.Background(), apps, previous, nil, nil, time.Date(2021, 6, 30, 15, 17, 0, 0, time.UTC), nil)
+	}
+
+	app := func(id string) erconfig.Application {
+		return erconfig.SimpleApplication(
+			id,
+			erconfig.SimpleHostnameFrontend("example.com"),
+			erconfig.RedirectBackend("http://example.net/"))
+	}
+
+	// with no history the discovery order doesn't matter
+	for _, apps := range [][]erconfig.Application{{app("a"), app("b")}, {app("b"), app("a")}} {
+		matchers := build(nil, apps...)
+		assert.EqualString(t, resolveMount("example.com", get("/"), matchers).App.ID, "a")
+		assert.EqualString(t, rejectedErrors(matchers), "frontend hostname:example.com/ of b conflicts with frontend hostname:example.com/ of a")
+	}
+
+	matchers := build(nil, app("z"))
+
+	// newly discovered "a" sorts first, but "z" already has the mount. the order keeps flipping
+	// between syncs, but that doesn't change the winner.
+	matchers = build(matchers, app("a"), app("z"))
+	assert.EqualString(t, resolveMount("example.com", get("/"), matchers).App.ID, "z")
+	assert.EqualString(t, rejectedErrors(matchers), "frontend hostname:example.com/ of a conflicts with frontend hostname:example.com/ of z")
+
+	matchers = build(matchers, app("z"), app("a"))
+	assert.EqualString(t, resolveMount("example.com", get("/"), matchers).App.ID, "z")
+
+	matchers = build(matchers, app("a"), app("z"))
+	assert.EqualString(t, resolveMount("example.com", get("/"), matchers).App.ID, "z")
+
+	// once the owner goes away, the other one gets it
+	matchers = build(matchers, app("a"))
+	assert.EqualString(t, resolveMount("example.com", get("/"), matchers).App.ID, "a")
+	assert.EqualString(t, rejectedErrors(matchers), "")
+}
+
+// one line per rejected app or frontend
+func rejectedErrors(matchers *frontendMatchers) string {
+	lines := []string{}
+	for _, rejected := range matchers.rejected {
+		lines = append(lines, rejected.err.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func get(path string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, path, nil)
 }
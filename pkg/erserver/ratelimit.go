@@ -0,0 +1,329 @@
+package erserver
+
+// Rate limiting: a token bucket per client of an app (see erconfig.RateLimitPolicy). Buckets live
+// in RAM, or in Redis for cluster-wide limits (so that adding nodes doesn't multiply the limit).
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erbackend/authidentity"
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+type rateLimiters struct {
+	redis  *redis.Client // nil if cluster-wide limits not configured
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	perApp map[string]*rateLimiter
+}
+
+// configured with ENV:
+//   - RATE_LIMIT_REDIS_URL: (optional) like redis://:password@redis:6379/0. required for
+//     cluster-wide limits, without it they're per-node
+func rateLimitersFromEnv(logger *slog.Logger) (*rateLimiters, error) {
+	limiters := &rateLimiters{
+		logger: logger,
+		perApp: map[string]*rateLimiter{},
+	}
+
+	if redisURL := os.Getenv("RATE_LIMIT_REDIS_URL"); redisURL != "" {
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			return nil, fmt.Errorf("RATE_LIMIT_REDIS_URL: %w", err)
+		}
+		opts.ContextTimeoutEnabled = true // for redisTimeout
+
+		limiters.redis = redis.NewClient(opts)
+	}
+
+	return limiters, nil
+}
+
+// nil if the app is not rate limited
+func (l *rateLimiters) forApp(app erconfig.Application) *rateLimiter {
+	if app.RateLimit == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limiter, found := l.perApp[app.ID]
+	if !found || limiter.policy != *app.RateLimit { // policy changed => start over with full buckets
+		limiter = newRateLimiter(app.ID, *app.RateLimit, time.Now, l.logger)
+
+		if app.RateLimit.ClusterWide {
+			if l.redis != nil {
+				limiter.cluster = newRedisBuckets(l.redis, "edgerouter:ratelimit:"+app.ID+":", *app.RateLimit)
+			} else {
+				l.logger.Warn("cluster-wide rate limit needs RATE_LIMIT_REDIS_URL, limiting per-node", "app", app.ID)
+			}
+		}
+
+		l.perApp[app.ID] = limiter
+	}
+
+	return limiter
+}
+
+type rateLimiter struct {
+	appID   string
+	policy  erconfig.RateLimitPolicy
+	local   *localBuckets
+	cluster *redisBuckets // nil if not cluster-wide
+	logger  *slog.Logger
+}
+
+func newRateLimiter(appID string, policy erconfig.RateLimitPolicy, now func() time.Time, logger *slog.Logger) *rateLimiter {
+	return &rateLimiter{
+		appID:  appID,
+		policy: policy,
+		logger: logger,
+		local: &localBuckets{
+			limit:   rate.Limit(policy.RequestsPerSecond),
+			burst:   policy.BurstOrDefault(),
+			buckets: map[string]*rate.Limiter{},
+			now:     now,
+		},
+	}
+}
+
+// responds with 429 and returns false if the client is over its limit.
+// *user* is who the auth backend authenticated (if any).
+func (l *rateLimiter) allow(w http.ResponseWriter, r *http.Request, user string) bool {
+	retryAfter := l.take(r.Context(), l.clientKey(r, user))
+	if retryAfter == 0 {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+
+	return false
+}
+
+// zero if the request is allowed, otherwise how long until it would be
+func (l *rateLimiter) take(ctx context.Context, key string) time.Duration {
+	// Redis being down (or slow) shouldn't take our apps down. per-node limits are better than nothing.
+	if l.cluster != nil && l.cluster.available() {
+		retryAfter, err := l.cluster.take(ctx, key)
+		switch {
+		case err == nil:
+			return retryAfter
+		case ctx.Err() != nil: // client went away. not Redis' fault
+		case l.cluster.failed(): // logged once per cool-down, not for each request
+			l.logger.Warn("cluster-wide rate limit failed, limiting per-node for a while",
+				"app", l.appID,
+				"error", err,
+				"retry_in", redisCooldown.String())
+		}
+	}
+
+	return l.local.take(key)
+}
+
+func (l *rateLimiter) clientKey(r *http.Request, user string) string {
+	switch l.policy.KeyOrDefault() {
+	case erconfig.RateLimitKeyHeader:
+		if value := r.Header.Get(l.policy.Header); value != "" {
+			// hashed so we don't keep e.g. API keys around (in RAM or Redis)
+			digest := sha256.Sum256([]byte(value))
+			return "header:" + hex.EncodeToString(digest[:16])
+		}
+	case erconfig.RateLimitKeyUser:
+		if user != "" {
+			return "user:" + user
+		}
+	}
+
+	// also the fallback for requests without the header or the user
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr) // already resolved (see clientip.go)
+	return "ip:" + clientIP
+}
+
+type localBuckets struct {
+	limit rate.Limit
+	burst int
+	now   func() time.Time // for testing
+
+	mu        sync.Mutex
+	buckets   map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+func (b *localBuckets) take(key string) time.Duration {
+	now := b.now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.maybeSweep(now)
+
+	bucket, found := b.buckets[key]
+	if !found {
+		bucket = rate.NewLimiter(b.limit, b.burst)
+		b.buckets[key] = bucket
+	}
+
+	reservation := bucket.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now) // rejected requests don't use up tokens
+		return delay
+	}
+
+	return 0
+}
+
+// a full bucket is the same as a new one, so it can be forgotten. keeps memory use proportional to
+// the clients that were active lately instead of all clients ever seen.
+func (b *localBuckets) maybeSweep(now time.Time) {
+	if now.Sub(b.lastSweep) < time.Minute {
+		return
+	}
+	b.lastSweep = now
+
+	for key, bucket := range b.buckets {
+		if bucket.TokensAt(now) >= float64(b.burst) {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+// GCRA (generic cell rate algorithm) is equivalent to a token bucket, but the state is a single
+// timestamp ("theoretical arrival time" of the next request). Redis' clock is used so that the
+// nodes' clocks don't need to agree. returns seconds until the request would be allowed ("0" = allowed).
+var gcraScript = redis.NewScript(`
+local emission_interval = 1 / tonumber(ARGV[1])
+local burst_offset = emission_interval * tonumber(ARGV[2])
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local tat = math.max(tonumber(redis.call("GET", KEYS[1])) or now, now)
+
+local allow_at = tat + emission_interval - burst_offset
+if now < allow_at then
+	return string.format("%.6f", allow_at - now)
+end
+
+local new_tat = tat + emission_interval
+redis.call("SET", KEYS[1], string.format("%.6f", new_tat), "PX", math.ceil((new_tat - now) * 1000))
+return "0"
+`)
+
+const (
+	redisTimeout  = 50 * time.Millisecond // rate limiting shouldn't add noticeable latency to requests
+	redisCooldown = 10 * time.Second      // after a failure, Redis isn't tried for this long
+)
+
+type redisBuckets struct {
+	client    *redis.Client
+	keyPrefix string
+	policy    erconfig.RateLimitPolicy
+	now       func() time.Time // for testing
+
+	mu        sync.Mutex
+	skipUntil time.Time // cool-down after a failure, so each request doesn't wait for a broken Redis
+}
+
+func newRedisBuckets(client *redis.Client, keyPrefix string, policy erconfig.RateLimitPolicy) *redisBuckets {
+	return &redisBuckets{
+		client:    client,
+		keyPrefix: keyPrefix,
+		policy:    policy,
+		now:       time.Now,
+	}
+}
+
+func (b *redisBuckets) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !b.now().Before(b.skipUntil)
+}
+
+// starts the cool-down. returns false if it was already started (by a concurrent request)
+func (b *redisBuckets) failed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if now.Before(b.skipUntil) {
+		return false
+	}
+
+	b.skipUntil = now.Add(redisCooldown)
+
+	return true
+}
+
+func (b *redisBuckets) take(ctx context.Context, key string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	retryAfterSeconds, err := gcraScript.Run(
+		ctx,
+		b.client,
+		[]string{b.keyPrefix + key},
+		b.policy.RequestsPerSecond,
+		b.policy.BurstOrDefault()).Text()
+	if err != nil {
+		return 0, err
+	}
+
+	seconds, err := strconv.ParseFloat(retryAfterSeconds, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+type pendingUserRateLimitKey struct{}
+
+// limits keyed by user can't be checked before the auth backend has authenticated the user
+func withPendingUserRateLimit(r *http.Request, limiter *rateLimiter) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pendingUserRateLimitKey{}, limiter))
+}
+
+// for backends that auth backends pass the request to (or that are the app's only backend), where
+// a pending user-keyed limit gets checked
+func withUserRateLimit(backend http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter, pending := r.Context().Value(pendingUserRateLimitKey{}).(*rateLimiter); pending {
+			if !limiter.allow(w, r, authidentity.User(r)) {
+				return
+			}
+		}
+
+		backend.ServeHTTP(w, r)
+	})
+}
+
+func isAuthBackend(kind erconfig.BackendKind) bool {
+	switch kind {
+	case erconfig.BackendKindAuthV0,
+		erconfig.BackendKindAuthBasic,
+		erconfig.BackendKindAuthSso,
+		erconfig.BackendKindAuthMtls,
+		erconfig.BackendKindAuthOidc,
+		erconfig.BackendKindAuthForward:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,143 @@
+package erserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erbackend/authidentity"
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
+	"github.com/function61/gokit/assert"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRateLimit(t *testing.T) {
+	now := time.Date(2024, 3, 1, 13, 55, 36, 0, time.UTC)
+
+	policy := erconfig.RateLimitPolicy{RequestsPerSecond: 0.5, Burst: 2, Key: erconfig.RateLimitKeyHeader, Header: "X-Api-Key"}
+	assert.Ok(t, policy.Validate())
+
+	limiter := newRateLimiter("api", policy, func() time.Time { return now }, slogshim.NewWithOutput(io.Discard))
+
+	request := func(apiKey string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.9:41234"
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+
+		res := httptest.NewRecorder()
+		if limiter.allow(res, req, "") {
+			return "ok"
+		}
+
+		assert.EqualInt(t, res.Code, http.StatusTooManyRequests)
+		return "429 Retry-After: " + res.Header().Get("Retry-After")
+	}
+
+	assert.EqualString(t, request("key1"), "ok")
+	assert.EqualString(t, request("key1"), "ok")
+	assert.EqualString(t, request("key1"), "429 Retry-After: 2")
+	assert.EqualString(t, request("key2"), "ok") // own bucket
+	assert.EqualString(t, request(""), "ok")     // no header => keyed by client IP
+
+	now = now.Add(1 * time.Second)
+	assert.EqualString(t, request("key1"), "429 Retry-After: 1") // rejected requests didn't use up tokens
+
+	now = now.Add(1 * time.Second)
+	assert.EqualString(t, request("key1"), "ok")
+	assert.EqualString(t, request("key1"), "429 Retry-After: 2")
+
+	// buckets that have refilled are forgotten
+	now = now.Add(time.Hour)
+	_ = request("key3")
+	assert.EqualInt(t, len(limiter.local.buckets), 1)
+}
+
+func TestRateLimitByUser(t *testing.T) {
+	limiter := newRateLimiter(
+		"app",
+		erconfig.RateLimitPolicy{RequestsPerSecond: 1, Key: erconfig.RateLimitKeyUser},
+		time.Now,
+		slogshim.NewWithOutput(io.Discard))
+
+	// stand-in for an auth backend
+	authenticateAs := func(user string, authorized http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user != "" {
+				authidentity.SetUser(r, user)
+			}
+			authorized.ServeHTTP(w, r)
+		})
+	}
+
+	app := withUserRateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+
+	request := func(user string, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req, _ = authidentity.WithIdentity(req)
+
+		res := httptest.NewRecorder()
+		authenticateAs(user, app).ServeHTTP(res, withPendingUserRateLimit(req, limiter))
+		return res.Code
+	}
+
+	assert.EqualInt(t, request("joonas", "203.0.113.9:41234"), http.StatusOK)
+	assert.EqualInt(t, request("joonas", "198.51.100.7:41234"), http.StatusTooManyRequests) // same user, different IP
+	assert.EqualInt(t, request("mary", "203.0.113.9:41234"), http.StatusOK)                 // same IP, different user
+	assert.EqualInt(t, request("", "203.0.113.9:41234"), http.StatusOK)                     // not authenticated => keyed by IP
+	assert.EqualInt(t, request("", "203.0.113.9:41234"), http.StatusTooManyRequests)
+}
+
+func TestRateLimitRedisUnresponsive(t *testing.T) {
+	// accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	now := time.Date(2024, 3, 1, 13, 55, 36, 0, time.UTC)
+
+	logs := &bytes.Buffer{}
+
+	policy := erconfig.RateLimitPolicy{RequestsPerSecond: 1, Burst: 1, ClusterWide: true}
+	limiter := newRateLimiter("api", policy, func() time.Time { return now }, slogshim.NewWithOutput(logs))
+	limiter.cluster = newRedisBuckets(
+		redis.NewClient(&redis.Options{Addr: listener.Addr().String(), ContextTimeoutEnabled: true}),
+		"test:",
+		policy)
+	limiter.cluster.now = func() time.Time { return now }
+
+	started := time.Now()
+	assert.Assert(t, limiter.take(context.Background(), "ip:203.0.113.9") == 0)
+	assert.Assert(t, time.Since(started) < time.Second)
+
+	// cool-down => Redis not tried, and per-node limit applies
+	started = time.Now()
+	assert.Assert(t, limiter.take(context.Background(), "ip:203.0.113.9") == time.Second)
+	assert.Assert(t, time.Since(started) < redisTimeout)
+
+	assert.EqualInt(t, strings.Count(logs.String(), "cluster-wide rate limit failed"), 1)
+
+	now = now.Add(redisCooldown)
+	assert.Assert(t, limiter.cluster.available())
+}
@@ -0,0 +1,134 @@
+package erserver
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+)
+
+// frontend's matchers that are evaluated after hostname and path prefix have matched.
+// compiled from erconfig.Frontend so regexps don't need to be compiled on each request.
+type requestConditions struct {
+	methods    []string
+	headers    []valueCondition
+	queries    []valueCondition
+	pathRegexp *regexp.Regexp
+}
+
+type valueCondition struct {
+	name   string
+	value  string         // "" if not exact match
+	regexp *regexp.Regexp // nil if not regexp match
+}
+
+// returns nil if frontend has no additional matchers
+func newRequestConditions(frontend erconfig.Frontend) (*requestConditions, error) {
+	if !frontend.HasAdditionalMatchers() {
+		return nil, nil
+	}
+
+	headers, err := compileValueConditions(frontend.Headers, http.CanonicalHeaderKey)
+	if err != nil {
+		return nil, err
+	}
+
+	queries, err := compileValueConditions(frontend.Queries, func(name string) string { return name })
+	if err != nil {
+		return nil, err
+	}
+
+	pathRegexp, err := func() (*regexp.Regexp, error) {
+		if frontend.PathRegexp == "" {
+			return nil, nil
+		}
+
+		return regexp.Compile(frontend.PathRegexp)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	return &requestConditions{
+		methods:    frontend.Methods,
+		headers:    headers,
+		queries:    queries,
+		pathRegexp: pathRegexp,
+	}, nil
+}
+
+func (c *requestConditions) matches(r *http.Request) bool {
+	if c == nil { // no conditions
+		return true
+	}
+
+	if len(c.methods) > 0 && !slices.Contains(c.methods, r.Method) {
+		return false
+	}
+
+	for _, header := range c.headers {
+		if !header.matches(r.Header[header.name]) {
+			return false
+		}
+	}
+
+	if len(c.queries) > 0 {
+		query := r.URL.Query()
+
+		for _, param := range c.queries {
+			if !param.matches(query[param.name]) {
+				return false
+			}
+		}
+	}
+
+	if c.pathRegexp != nil && !c.pathRegexp.MatchString(r.URL.Path) {
+		return false
+	}
+
+	return true
+}
+
+// any value matching is enough
+func (v valueCondition) matches(values []string) bool {
+	for _, value := range values {
+		switch {
+		case v.regexp != nil:
+			if v.regexp.MatchString(value) {
+				return true
+			}
+		case v.value != "":
+			if value == v.value {
+				return true
+			}
+		default: // presence is enough
+			return true
+		}
+	}
+
+	return false
+}
+
+func compileValueConditions(matchers []erconfig.ValueMatcher, normalizeName func(string) string) ([]valueCondition, error) {
+	conditions := []valueCondition{}
+
+	for _, matcher := range matchers {
+		condition := valueCondition{
+			name:  normalizeName(matcher.Name),
+			value: matcher.Value,
+		}
+
+		if matcher.Regexp != "" {
+			var err error
+			condition.regexp, err = regexp.Compile(matcher.Regexp)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		conditions = append(conditions, condition)
+	}
+
+	return conditions, nil
+}
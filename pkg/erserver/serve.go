@@ -17,18 +17,24 @@ import (
 
 	"github.com/felixge/httpsnoop"
 	"github.com/function61/certbus/pkg/certbus"
+	"github.com/function61/edgerouter/pkg/erbackend/authidentity"
 	"github.com/function61/edgerouter/pkg/erconfig"
 	"github.com/function61/edgerouter/pkg/erdiscovery"
+	"github.com/function61/edgerouter/pkg/erdiscovery/consuldiscovery"
 	"github.com/function61/edgerouter/pkg/erdiscovery/dockerdiscovery"
 	"github.com/function61/edgerouter/pkg/erdiscovery/ehdiscovery"
 	"github.com/function61/edgerouter/pkg/erdiscovery/filediscovery"
+	"github.com/function61/edgerouter/pkg/erdiscovery/kubediscovery"
 	"github.com/function61/edgerouter/pkg/erdiscovery/s3discovery"
+	"github.com/function61/edgerouter/pkg/ertracing"
 	"github.com/function61/edgerouter/pkg/todoupgradegokit"
 	"github.com/function61/edgerouter/pkg/todoupgradegokit/slogshim"
 	"github.com/function61/edgerouter/pkg/turbocharger"
 	"github.com/function61/eventhorizon/pkg/ehreader"
 	"github.com/function61/gokit/envvar"
+	"github.com/function61/gokit/fileexists"
 	"github.com/function61/gokit/taskrunner"
+	"golang.org/x/crypto/acme"
 )
 
 const (
@@ -59,6 +65,15 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 	}()
 	defer tasksCancel()
 
+	currentConfig := newAtomicConfig()
+
+	var acmeChallengeHandler http.Handler // set if our ACME client is in use
+
+	certDirExists, err := fileexists.Exists(configDir.CertificatesDir())
+	if err != nil {
+		return err
+	}
+
 	getCertificateFn, err := func() (GetCertificateFn, error) {
 		certbusLogger := logger.With("subsystem", "certbus")
 		if os.Getenv("CERTBUS_CLIENT_PRIVKEY") != "" {
@@ -70,6 +85,26 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 			tasks.Start("certbus sync", func(ctx context.Context) error { return certBus.Synchronizer(ctx) })
 
 			return certBus.GetCertificateAdapter(), nil
+		} else if acmeConfigured() {
+			certbusLogger.Info("not configured - using built-in ACME client")
+
+			acmeManager := newAcmeManagerFromEnv(configDir, currentConfig)
+
+			// calling this also enables the HTTP-01 challenge for the manager (TLS-ALPN-01 is always enabled)
+			acmeChallengeHandler = acmeManager.HTTPHandler(http.NotFoundHandler())
+
+			return acmeManager.GetCertificate, nil
+		} else if certDirExists {
+			certbusLogger.Info("not configured - using certificates from directory", "dir", configDir.CertificatesDir())
+
+			certDir, err := newCertificateDir(configDir.CertificatesDir(), logger.With("subsystem", "certdir"))
+			if err != nil {
+				return nil, err
+			}
+
+			tasks.Start("certificate dir watcher", certDir.WatchChanges)
+
+			return certDir.GetCertificate, nil
 		} else {
 			certbusLogger.Info("not configured - assuming local dev-server", "certificate", configDir.DevelopmentCertificate())
 
@@ -98,10 +133,51 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 		return fmt.Errorf("configureDiscovery: %w", err)
 	}
 
-	currentConfig := newAtomicConfig()
+	syncInterval, err := erdiscovery.PollIntervalFromEnv("DISCOVERY_SYNC_INTERVAL", defaultSyncInterval)
+	if err != nil {
+		return err
+	}
+
+	clientIP, err := clientIPConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	accessLog, err := accessLogFromEnv() // nil if not enabled
+	if err != nil {
+		return err
+	}
+
+	rateLimiters, err := rateLimitersFromEnv(logger)
+	if err != nil {
+		return err
+	}
+
+	concurrencyLimiters := newConcurrencyLimiters(metrics)
+
+	shutdownTracing, err := initTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// ctx is probably canceled by now
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			logger.Error("flushing traces failed", "error", err)
+		}
+	}()
+
+	// rules from discovery are read with each sync, so they're not checked here
+	fileIPRules, err := loadIPRules(configDir.File("ip-rules.hcl"))
+	if err != nil {
+		return fmt.Errorf("ip-rules.hcl: %w", err)
+	}
 
 	// initial sync so we won't start dealing out 404s when HTTP server starts
-	initialConfig, err := syncAppsFromDiscovery(ctx, discovery, currentConfig, logger, logger)
+	initialConfig, err := syncAppsFromDiscovery(ctx, discovery, fileIPRules, currentConfig, acmeChallengeHandler, logger, logger)
+	metrics.observeSync(initialConfig, err)
 	if err != nil {
 		// not treating this as a fatal error though
 		logger.Error("initial sync failed", "error", err)
@@ -109,15 +185,6 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 		currentConfig.Store(initialConfig)
 	}
 
-	// TODO: if these rules have syntax error, it'd be good if it came up before other async tasks
-	//       are started.
-	//
-	// file is a temporary solution - these will have to live in EventHorizon
-	ipRules, err := loadIPRules("/etc/edgerouter/ip-rules.hcl")
-	if err != nil {
-		return err
-	}
-
 	// returns mount (i.e. application) that the URL matched.
 	// NOTE: does not imply the request entered the application (e.g. IP filtering or HTTPS-only rule might've blocked the request)
 	// nil mount if no URL matched means "no application found"
@@ -131,7 +198,9 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 			return nil
 		}
 
-		mount := resolveMount(hostname, r.URL.Path, config)
+		_, resolveSpan := ertracing.Start(r.Context(), "resolve mount")
+		mount := resolveMount(hostname, r, config)
+		resolveSpan.End()
 		if mount == nil {
 			http.Error(w, "no website for hostname: "+hostname, http.StatusNotFound)
 			return nil
@@ -144,12 +213,33 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 			return mount
 		}
 
-		// todo: respect x-forwarded-for headers but only if configured as trusted
-		if allowed, errStr := ipAllowed(r.RemoteAddr, mount.App.ID, ipRules); !allowed {
+		if !notSecure {
+			if !connectionSatisfiesTLSPolicy(hostname, r.TLS, config) {
+				http.Error(w, "connection was not made for this hostname", http.StatusMisdirectedRequest)
+				return mount
+			}
+
+			if policy := resolveTLSPolicy(hostname, config); policy != nil && policy.hstsHeader != "" {
+				w.Header().Set("Strict-Transport-Security", policy.hstsHeader)
+			}
+		}
+
+		_, ipFilterSpan := ertracing.Start(r.Context(), "IP filter")
+		allowed, errStr := ipAllowed(r.RemoteAddr, mount.App.ID, r.URL.Path, config.ipRules)
+		ipFilterSpan.End()
+		if !allowed {
 			http.Error(w, errStr, http.StatusForbidden)
 			return mount
 		}
 
+		if limiter := rateLimiters.forApp(mount.App); limiter != nil {
+			if limiter.policy.KeyOrDefault() == erconfig.RateLimitKeyUser {
+				r = withPendingUserRateLimit(r, limiter) // user is known only after the auth backend
+			} else if !limiter.allow(w, r, "") {
+				return mount
+			}
+		}
+
 		if mount.stripPrefix {
 			// path=/files/foobar.txt stripPrefix=/files/
 			// => "foobar.txt"
@@ -162,14 +252,27 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 
 		}
 
+		if limiter := concurrencyLimiters.forApp(mount.App); limiter != nil {
+			release, ok := limiter.acquire(r.Context())
+			if !ok {
+				http.Error(w, "too many requests in flight, try again later", http.StatusServiceUnavailable)
+				return mount
+			}
+			defer release()
+		}
+
+		inFlight := metrics.requestsInFlight.WithLabelValues(mount.App.ID)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
 		// pass the request to the concrete application where the actually interesting things happen.
 		// the path (reversed) looks like this:
 		//
 		// Application
-		// └── serveRequest (app routing/resolving, HTTP-to-HTTPS redirection, IP filtering)
-		//     └── serveRequestWithMetricsCapture
-		//         ├── listener :443
-		//         └── listener :80
+		// └── serveRequest (app routing/resolving, HTTP-to-HTTPS redirection, IP filtering, rate & concurrency limiting)
+		//     └── serveRequestWithMetricsCapture (client IP resolving, access log, tracing)
+		//         ├── listener :443 (PROXY protocol)
+		//         └── listener :80 (PROXY protocol)
 		mount.backend.ServeHTTP(w, r)
 
 		return mount
@@ -177,6 +280,18 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 
 	// shared handler for both HTTPS and HTTP
 	serveRequestWithMetricsCapture := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP.resolveClientAddr(r) // before anything looks at r.RemoteAddr
+
+		r, identity := authidentity.WithIdentity(r)
+		r, span := startRequestSpan(r)
+		started := time.Now()
+		path := r.URL.Path // before prefix stripping
+
+		requestBody := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody { // backends check for NoBody (e.g. whether the body can be re-sent)
+			r.Body = requestBody
+		}
+
 		var mount *Mount
 		// see for greatly written rationale https://github.com/felixge/httpsnoop
 		// tl;dr: response snooping is hard without losing Websocket etc. support
@@ -198,8 +313,20 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 			incAppCodeMethodCounter(metrics.requestsFail, appID, strconv.Itoa(stats.Code), r.Method)
 		}
 
-		metrics.requestDuration.WithLabelValues(appID).Observe(stats.Duration.Seconds())
-		metrics.requestDuration.WithLabelValues(allAppKey).Observe(stats.Duration.Seconds())
+		observeApp(metrics.requestDuration, appID, stats.Duration.Seconds())
+		observeApp(metrics.requestSize, appID, float64(requestBody.bytesRead))
+		observeApp(metrics.responseSize, appID, float64(stats.Written))
+
+		endRequestSpan(span, r, mount, stats.Code)
+
+		if accessLog != nil {
+			var policy *erconfig.AccessLogPolicy
+			if mount != nil {
+				policy = mount.App.AccessLog
+			}
+
+			accessLog.Log(newAccessLogEntry(r, path, started, mount, stats, identity.User), policy)
+		}
 	})
 
 	logger.Info("turbocharger middleware status", "activated", turbocharger.MiddlewareConfigAvailable())
@@ -207,23 +334,41 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 	configUpdated := make(chan *frontendMatchers, 1)
 
 	tasks.Start("listener :443", func(ctx context.Context) error {
+		nextProtos := []string{"h2", "http/1.1"}
+		if acmeChallengeHandler != nil { // TLS-ALPN-01 challenge
+			nextProtos = append(nextProtos, acme.ALPNProto)
+		}
+
+		// lint complains about too low MinVersion (the default, in Go sets it as TLS 1.0).
+		// purposefully leaving MinVersion as default because I feel Go stdlib's default MinVersion
+		// in the long run aligns with loadbalancer use case of conservatively having to support a wide base of users.
+		// https://developers.cloudflare.com/ssl/edge-certificates/additional-options/minimum-tls#decide-what-version-to-use
+		// apps that need stricter settings can have them with a TLS policy in their frontend.
+		//
+		//nolint:gosec // rationale above
+		tlsConfig := &tls.Config{
+			// MinVersion: ... // purposefully unset to follow Go stdlib MinVersion
+			GetCertificate: getCertificateFn,
+			NextProtos:     nextProtos,
+		}
+
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			return tlsConfigForClient(hello, tlsConfig, currentConfig.Load().(*frontendMatchers)), nil
+		}
+
 		srv := &http.Server{
-			Addr: ":443",
-			// lint complains about too low MinVersion (the default, in Go sets it as TLS 1.0).
-			// purposefully leaving MinVersion as default because I feel Go stdlib's default MinVersion
-			// in the long run aligns with loadbalancer use case of conservatively having to support a wide base of users.
-			// https://developers.cloudflare.com/ssl/edge-certificates/additional-options/minimum-tls#decide-what-version-to-use
-			//
-			//nolint:gosec // rationale above
-			TLSConfig: &tls.Config{
-				// MinVersion: ... // purposefully unset to follow Go stdlib MinVersion
-				GetCertificate: getCertificateFn,
-			},
+			Addr:              ":443",
+			TLSConfig:         tlsConfig,
 			Handler:           serveRequestWithMetricsCapture,
 			ReadHeaderTimeout: todoupgradegokit.DefaultReadHeaderTimeout,
 		}
 
-		return cancelableServer(ctx, srv, func() error { return srv.ListenAndServeTLS("", "") })
+		listener, err := clientIP.listen(srv.Addr)
+		if err != nil {
+			return err
+		}
+
+		return cancelableServer(ctx, srv, func() error { return srv.ServeTLS(listener, "", "") })
 	})
 
 	tasks.Start("listener :80", func(ctx context.Context) error {
@@ -233,15 +378,33 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 			ReadHeaderTimeout: todoupgradegokit.DefaultReadHeaderTimeout,
 		}
 
-		return cancelableServer(ctx, srv, srv.ListenAndServe)
+		listener, err := clientIP.listen(srv.Addr)
+		if err != nil {
+			return err
+		}
+
+		return cancelableServer(ctx, srv, func() error { return srv.Serve(listener) })
 	})
 
+	discoveryChanged := make(chan struct{}, 1)
+
+	if watcher, is := discovery.(erdiscovery.Watcher); is {
+		tasks.Start("discoverywatcher", func(ctx context.Context) error {
+			return watcher.WatchChanges(ctx, discoveryChanged)
+		})
+	}
+
 	tasks.Start("configsyncscheduler", func(ctx context.Context) error {
 		return scheduledSync(
 			ctx,
 			discovery,
+			fileIPRules,
+			syncInterval,
+			discoveryChanged,
 			configUpdated,
 			currentConfig,
+			acmeChallengeHandler,
+			metrics,
 			logger,
 			logger.With("subsystem", "configsyncscheduler"))
 	})
@@ -260,7 +423,9 @@ func Serve(ctx context.Context, configDir ConfigDir, logger *slog.Logger) error
 func syncAppsFromDiscovery(
 	ctx context.Context,
 	discovery erdiscovery.Reader,
-	currentConfig erconfig.CurrentConfigAccessor,
+	fileIPRules []ipRule,
+	currentConfig *atomicConfig,
+	acmeChallengeHandler http.Handler, // nil if our ACME client is not in use
 	parentLogger *slog.Logger,
 	logger *slog.Logger,
 ) (*frontendMatchers, error) {
@@ -289,13 +454,32 @@ func syncAppsFromDiscovery(
 		apps = append(apps, prom)
 	}
 
-	logger.Info("applications discovered", "count", len(apps))
+	if acmeChallengeHandler != nil {
+		apps = append(apps, acmeChallengeApp())
+	}
 
-	matchers, err := appConfigToHandlersAndMatchers(ctx, apps, currentConfig, time.Now(), parentLogger)
+	// read before building the matchers, so a failure doesn't leave us with new apps but old rules
+	ipRules, err := readIPRules(ctx, discovery, fileIPRules)
 	if err != nil {
-		return nil, fmt.Errorf("appConfigToHandlersAndMatchers: %w", err)
+		return nil, err
+	}
+
+	logger.Info("applications discovered", "count", len(apps), "ipRules", len(ipRules))
+
+	matchers := appConfigToHandlersAndMatchers(
+		ctx,
+		apps,
+		currentConfig.Load().(*frontendMatchers),
+		currentConfig,
+		acmeChallengeHandler,
+		time.Now(),
+		parentLogger)
+	for _, rejected := range matchers.rejected {
+		logger.Error("app config rejected", "app", rejected.appID, "error", rejected.err)
 	}
 
+	matchers.ipRules = ipRules
+
 	return matchers, nil
 }
 
@@ -308,7 +492,13 @@ func configureDiscovery(ctx context.Context, logger *slog.Logger) (erdiscovery.R
 			return nil, err
 		}
 
-		readers = append(readers, s3Discovery)
+		// LIST requests cost money, so don't read on each sync that other sources trigger
+		s3PollInterval, err := erdiscovery.PollIntervalFromEnv("S3_DISCOVERY_POLL_INTERVAL", defaultSyncInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		readers = append(readers, erdiscovery.PollEvery(s3Discovery, s3PollInterval, logger))
 	}
 
 	if dockerdiscovery.HasConfigInEnv() {
@@ -320,6 +510,24 @@ func configureDiscovery(ctx context.Context, logger *slog.Logger) (erdiscovery.R
 		readers = append(readers, docker)
 	}
 
+	if consuldiscovery.HasConfigInEnv() {
+		consul, err := consuldiscovery.New(logger)
+		if err != nil {
+			return nil, err
+		}
+
+		readers = append(readers, consul)
+	}
+
+	if kubediscovery.HasConfigInEnv() {
+		kube, err := kubediscovery.New(logger)
+		if err != nil {
+			return nil, err
+		}
+
+		readers = append(readers, kube)
+	}
+
 	if ehdiscovery.HasConfigInEnv() {
 		tenantCtx, err := ehreader.TenantCtxFrom(ehreader.ConfigFromEnv)
 		if err != nil {
@@ -334,7 +542,7 @@ func configureDiscovery(ctx context.Context, logger *slog.Logger) (erdiscovery.R
 		readers = append(readers, ehDiscovery)
 	}
 
-	maybeFromFile, err := newFileDiscoveryIfFileExists(filediscovery.DefaultFilename)
+	maybeFromFile, err := newFileDiscoveryIfFileExists(filediscovery.DefaultFilename, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -378,6 +586,11 @@ func (c ConfigDir) DevelopmentCertificate() string {
 	return c.File("dev-cert.pem")
 }
 
+// *.pem files (certificate chain + private key) for when they're managed by an external tool
+func (c ConfigDir) CertificatesDir() string {
+	return c.File("certs")
+}
+
 func (c ConfigDir) String() string {
 	return string(c)
 }
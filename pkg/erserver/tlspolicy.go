@@ -0,0 +1,171 @@
+package erserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"golang.org/x/crypto/acme"
+)
+
+// erconfig.TLSPolicy in the form we need it in the TLS handshake
+type tlsPolicy struct {
+	conf         *erconfig.TLSPolicy // nil if hostname has no explicit policy (but we need a policy for requestClientCert)
+	minVersion   uint16
+	cipherSuites []uint16
+	clientAuth   tls.ClientAuthType
+	clientCAs    *x509.CertPool
+	hstsHeader   string // "" = no HSTS
+
+	// an app of the hostname authenticates with client certificates (verified by the app, not in handshake)
+	requestClientCert bool
+}
+
+func newTLSPolicy(conf erconfig.TLSPolicy) (*tlsPolicy, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	// errors already checked by Validate()
+	minVersion, _ := conf.MinVersionID()
+	cipherSuites, _ := conf.CipherSuiteIDs()
+
+	policy := &tlsPolicy{
+		conf:         &conf,
+		minVersion:   minVersion,
+		cipherSuites: cipherSuites,
+		clientAuth:   tls.NoClientCert,
+	}
+
+	if conf.HSTS != nil {
+		policy.hstsHeader = conf.HSTS.HeaderValue()
+	}
+
+	if conf.ClientCertificate != nil {
+		policy.clientCAs, _ = conf.ClientCertificate.CertPool()
+
+		if conf.ClientCertificate.Optional {
+			policy.clientAuth = tls.VerifyClientCertIfGiven
+		} else {
+			policy.clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return policy, nil
+}
+
+// sets policy of a hostname from a frontend (and the app's backend). frontends without a policy
+// don't affect it.
+func setTLSPolicy(hostnamePolicy **tlsPolicy, frontend erconfig.Frontend, backend erconfig.Backend) error {
+	if frontend.TLS != nil {
+		switch {
+		case *hostnamePolicy == nil || (*hostnamePolicy).conf == nil:
+			policy, err := newTLSPolicy(*frontend.TLS)
+			if err != nil {
+				return fmt.Errorf("frontend %s: %w", frontend.Describe(), err)
+			}
+
+			if *hostnamePolicy != nil {
+				policy.requestClientCert = (*hostnamePolicy).requestClientCert
+			}
+
+			*hostnamePolicy = policy
+		case !reflect.DeepEqual(*(*hostnamePolicy).conf, *frontend.TLS):
+			return fmt.Errorf("frontend %s: TLS policy differs from other frontend of the same hostname", frontend.Describe())
+		}
+	}
+
+	// client has to send the certificate in the handshake, since with TLS 1.3 (and HTTP/2) we
+	// can't ask for it later when we see the request is for this app
+	if backend.Kind == erconfig.BackendKindAuthMtls {
+		if *hostnamePolicy == nil {
+			*hostnamePolicy = &tlsPolicy{clientAuth: tls.NoClientCert}
+		}
+
+		(*hostnamePolicy).requestClientCert = true
+	}
+
+	return nil
+}
+
+// same precedence as with resolveMount(), but TLS is negotiated before we know the path so it
+// depends only on the hostname. nil if the hostname has no policy.
+func resolveTLSPolicy(hostname string, matchers *frontendMatchers) *tlsPolicy {
+	if _, found := matchers.Hostname[hostname]; found {
+		return matchers.hostnameTLSPolicy[hostname]
+	}
+
+	if _, parent, hasParent := strings.Cut(hostname, "."); hasParent {
+		if _, found := matchers.hostnameWildcard[parent]; found {
+			return matchers.hostnameWildcardTLSPolicy[parent]
+		}
+	}
+
+	for _, hostnameRegexp := range matchers.hostnameRegexp {
+		if hostnameRegexp.Regexp.MatchString(hostname) {
+			return hostnameRegexp.tlsPolicy
+		}
+	}
+
+	return nil
+}
+
+// for tls.Config.GetConfigForClient. returns nil (= use base config) if hostname has no policy.
+func tlsConfigForClient(hello *tls.ClientHelloInfo, base *tls.Config, matchers *frontendMatchers) *tls.Config {
+	// the CA doesn't have a client certificate or necessarily support our min version
+	if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return nil
+	}
+
+	policy := resolveTLSPolicy(strings.ToLower(hello.ServerName), matchers)
+	if policy == nil {
+		return nil
+	}
+
+	config := base.Clone()
+	config.GetConfigForClient = nil
+	if policy.minVersion != 0 {
+		config.MinVersion = policy.minVersion
+	}
+	if policy.cipherSuites != nil {
+		config.CipherSuites = policy.cipherSuites
+	}
+	config.ClientAuth = policy.clientAuth
+	config.ClientCAs = policy.clientCAs
+	if policy.requestClientCert && policy.clientAuth == tls.NoClientCert {
+		config.ClientAuth = tls.RequestClientCert
+	}
+
+	return config
+}
+
+// the policy is enforced in the handshake, which is picked by SNI. the request's hostname can be a
+// different one (a client can send any Host, and browsers reuse HTTP/2 connections for hostnames
+// that the certificate covers), so the connection must have been negotiated under the hostname's
+// policy. if not, the client should retry with a new connection (421 Misdirected Request).
+func connectionSatisfiesTLSPolicy(hostname string, conn *tls.ConnectionState, matchers *frontendMatchers) bool {
+	policy := resolveTLSPolicy(strings.ToLower(hostname), matchers)
+
+	if !sameTLSPolicy(policy, resolveTLSPolicy(strings.ToLower(conn.ServerName), matchers)) {
+		return false
+	}
+
+	if policy != nil && policy.clientAuth == tls.RequireAndVerifyClientCert && len(conn.VerifiedChains) == 0 {
+		return false
+	}
+
+	return true
+}
+
+// hostnames can have equal policies without being the same object
+func sameTLSPolicy(a *tlsPolicy, b *tlsPolicy) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a == b || (reflect.DeepEqual(a.conf, b.conf) && a.requestClientCert == b.requestClientCert)
+}
@@ -0,0 +1,198 @@
+package erserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/gokit/assert"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	strict := erconfig.WithTLSPolicy(erconfig.TLSPolicy{
+		MinVersion: "1.3",
+		HSTS: &erconfig.HSTSPolicy{
+			MaxAgeSeconds:     63072000,
+			IncludeSubdomains: true,
+			Preload:           true,
+		},
+	})
+
+	apps := []erconfig.Application{
+		erconfig.SimpleApplication(
+			"internal",
+			erconfig.SimpleHostnameFrontend("internal.example.com", strict),
+			erconfig.RedirectBackend("http://example.net/")),
+		erconfig.SimpleApplication(
+			"internal-api", // gets the hostname's policy
+			erconfig.SimpleHostnameFrontend("internal.example.com", erconfig.PathPrefix("/api")),
+			erconfig.RedirectBackend("http://example.net/")),
+		erconfig.SimpleApplication(
+			"dev",
+			erconfig.WildcardHostnameFrontend("*.dev.example.com", strict),
+			erconfig.RedirectBackend("http://example.net/")),
+		erconfig.SimpleApplication(
+			"marketing",
+			erconfig.SimpleHostnameFrontend("www.example.com"),
+			erconfig.RedirectBackend("http://example.net/")),
+	}
+
+	matchers := appConfigToHandlersAndMatchers(context.Background(), apps, nil, nil, nil, time.Now(), nil)
+	assert.EqualString(t, rejectedErrors(matchers), "")
+
+	hstsHeader := func(hostname string) string {
+		if policy := resolveTLSPolicy(hostname, matchers); policy != nil {
+			return policy.hstsHeader
+		}
+
+		return ""
+	}
+
+	assert.EqualString(t, hstsHeader("internal.example.com"), "max-age=63072000; includeSubDomains; preload")
+	assert.EqualString(t, hstsHeader("foo.dev.example.com"), "max-age=63072000; includeSubDomains; preload")
+	assert.EqualString(t, hstsHeader("www.example.com"), "")
+	assert.EqualString(t, hstsHeader("notfound.net"), "")
+
+	bundle := selfSignedCertBundle(t, time.Now().Add(time.Hour), "internal.example.com", "www.example.com")
+	cert, err := tls.X509KeyPair(bundle, bundle)
+	assert.Ok(t, err)
+
+	base := &tls.Config{Certificates: []tls.Certificate{cert}}
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return tlsConfigForClient(hello, base, matchers), nil
+	}
+
+	// client that only speaks TLS 1.2
+	handshake := func(serverName string) error {
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+
+		go func() {
+			_ = tls.Server(serverConn, base).Handshake()
+			serverConn.Close()
+		}()
+
+		return tls.Client(clientConn, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+		}).Handshake()
+	}
+
+	assert.Ok(t, handshake("www.example.com"))
+	assert.EqualString(t, handshake("internal.example.com").Error(), "remote error: tls: protocol version not supported")
+}
+
+func TestTLSPolicyClientCertRequestedForMtls(t *testing.T) {
+	caBundle := selfSignedCertBundle(t, time.Now().Add(time.Hour), "ca")
+
+	apps := []erconfig.Application{
+		erconfig.SimpleApplication(
+			"web",
+			erconfig.SimpleHostnameFrontend("api.example.com"),
+			erconfig.RedirectBackend("http://example.net/")),
+		erconfig.SimpleApplication(
+			"machine-to-machine",
+			erconfig.SimpleHostnameFrontend("api.example.com", erconfig.PathPrefix("/m2m"), erconfig.WithTLSPolicy(erconfig.TLSPolicy{MinVersion: "1.2"})),
+			erconfig.AuthMtlsBackend(string(caBundle), nil, erconfig.RedirectBackend("http://example.net/"))),
+		erconfig.SimpleApplication(
+			"public",
+			erconfig.SimpleHostnameFrontend("www.example.com"),
+			erconfig.RedirectBackend("http://example.net/")),
+	}
+
+	matchers := appConfigToHandlersAndMatchers(context.Background(), apps, nil, nil, nil, time.Now(), nil)
+	assert.EqualString(t, rejectedErrors(matchers), "")
+
+	base := &tls.Config{}
+
+	api := tlsConfigForClient(&tls.ClientHelloInfo{ServerName: "api.example.com"}, base, matchers)
+	assert.Assert(t, api.ClientAuth == tls.RequestClientCert)
+	assert.Assert(t, api.MinVersion == tls.VersionTLS12)
+
+	assert.Assert(t, tlsConfigForClient(&tls.ClientHelloInfo{ServerName: "www.example.com"}, base, matchers) == nil)
+}
+
+func TestConnectionSatisfiesTLSPolicy(t *testing.T) {
+	caBundle := selfSignedCertBundle(t, time.Now().Add(time.Hour), "ca")
+
+	clientCertRequired := erconfig.WithTLSPolicy(erconfig.TLSPolicy{
+		ClientCertificate: &erconfig.ClientCertificate{CACertificates: string(caBundle)},
+	})
+	tls13 := erconfig.WithTLSPolicy(erconfig.TLSPolicy{MinVersion: "1.3"})
+
+	apps := []erconfig.Application{
+		erconfig.SimpleApplication(
+			"admin",
+			erconfig.SimpleHostnameFrontend("admin.example.com", clientCertRequired),
+			erconfig.RedirectBackend("http://example.net/")),
+		erconfig.SimpleApplication(
+			"internal",
+			erconfig.SimpleHostnameFrontend("internal.example.com", tls13),
+			erconfig.RedirectBackend("http://example.net/")),
+		erconfig.SimpleApplication(
+			"internal2", // same policy, different hostname
+			erconfig.SimpleHostnameFrontend("internal2.example.com", tls13),
+			erconfig.RedirectBackend("http://example.net/")),
+		erconfig.SimpleApplication(
+			"www",
+			erconfig.SimpleHostnameFrontend("www.example.com"),
+			erconfig.RedirectBackend("http://example.net/")),
+	}
+
+	matchers := appConfigToHandlersAndMatchers(context.Background(), apps, nil, nil, nil, time.Now(), nil)
+	assert.EqualString(t, rejectedErrors(matchers), "")
+
+	verified := [][]*x509.Certificate{{&x509.Certificate{}}}
+
+	satisfies := func(hostname string, conn tls.ConnectionState) bool {
+		return connectionSatisfiesTLSPolicy(hostname, &conn, matchers)
+	}
+
+	assert.Assert(t, satisfies("www.example.com", tls.ConnectionState{ServerName: "www.example.com"}))
+	assert.Assert(t, satisfies("www.example.com", tls.ConnectionState{})) // no SNI
+	assert.Assert(t, satisfies("internal.example.com", tls.ConnectionState{ServerName: "internal.example.com"}))
+	assert.Assert(t, satisfies("internal2.example.com", tls.ConnectionState{ServerName: "INTERNAL.example.com"}))
+	assert.Assert(t, satisfies("admin.example.com", tls.ConnectionState{ServerName: "admin.example.com", VerifiedChains: verified}))
+
+	// SNI of a host without the policy, then Host of the protected one (or HTTP/2 connection coalescing)
+	assert.Assert(t, !satisfies("admin.example.com", tls.ConnectionState{ServerName: "www.example.com"}))
+	assert.Assert(t, !satisfies("admin.example.com", tls.ConnectionState{ServerName: "www.example.com", VerifiedChains: verified}))
+	assert.Assert(t, !satisfies("internal.example.com", tls.ConnectionState{ServerName: "www.example.com"}))
+	assert.Assert(t, !satisfies("internal.example.com", tls.ConnectionState{}))
+	assert.Assert(t, !satisfies("www.example.com", tls.ConnectionState{ServerName: "internal.example.com"}))
+
+	assert.Assert(t, !satisfies("admin.example.com", tls.ConnectionState{ServerName: "admin.example.com"}))
+}
+
+func TestTLSPolicyConflict(t *testing.T) {
+	matchers := appConfigToHandlersAndMatchers(context.Background(), []erconfig.Application{
+		erconfig.SimpleApplication(
+			"a",
+			erconfig.SimpleHostnameFrontend("example.com", erconfig.WithTLSPolicy(erconfig.TLSPolicy{MinVersion: "1.2"})),
+			erconfig.RedirectBackend("http://example.net/")),
+		erconfig.SimpleApplication(
+			"b",
+			erconfig.SimpleHostnameFrontend("example.com", erconfig.PathPrefix("/b"), erconfig.WithTLSPolicy(erconfig.TLSPolicy{MinVersion: "1.3"})),
+			erconfig.RedirectBackend("http://example.net/")),
+	}, nil, nil, nil, time.Now(), nil)
+	assert.EqualString(t, rejectedErrors(matchers), "b: frontend hostname:example.com/b: TLS policy differs from other frontend of the same hostname")
+	// the first frontend's policy stays, and the rejected one didn't get mounted
+	assert.EqualString(t, resolveTLSPolicy("example.com", matchers).conf.MinVersion, "1.2")
+	assert.EqualString(t, resolveMount("example.com", get("/b"), matchers).App.ID, "a")
+
+	matchers = appConfigToHandlersAndMatchers(context.Background(), []erconfig.Application{
+		erconfig.SimpleApplication(
+			"a",
+			erconfig.SimpleHostnameFrontend("example.com", erconfig.WithTLSPolicy(erconfig.TLSPolicy{
+				HSTS: &erconfig.HSTSPolicy{MaxAgeSeconds: 300, Preload: true},
+			})),
+			erconfig.RedirectBackend("http://example.net/")),
+	}, nil, nil, nil, time.Now(), nil)
+	assert.EqualString(t, rejectedErrors(matchers), "a: frontend hostname:example.com/: TLS: HSTS: Preload requires IncludeSubdomains and MaxAgeSeconds of at least one year")
+}
@@ -0,0 +1,108 @@
+package erserver
+
+// OpenTelemetry trace exporting. Configured with the standard OTEL_* ENV variables, so there's
+// nothing Edgerouter-specific to learn.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/function61/edgerouter/pkg/ertracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// configured with ENV:
+//   - OTEL_EXPORTER_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT): OTLP/HTTP collector
+//     like http://otel-collector:4318. setting enables tracing
+//   - OTEL_EXPORTER_OTLP_HEADERS: (optional) e.g. auth token for a hosted collector
+//   - OTEL_SERVICE_NAME: (optional) default "edgerouter"
+//   - OTEL_TRACES_SAMPLER + OTEL_TRACES_SAMPLER_ARG: (optional) default is to trace everything,
+//     unless the client's `traceparent` says it's not sampled
+//
+// returned func flushes the spans that haven't been exported yet.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("initTracing: %w", err)
+	}
+
+	res, err := resource.New(
+		ctx,
+		resource.WithAttributes(attribute.String("service.name", "edgerouter")),
+		resource.WithFromEnv(), // OTEL_SERVICE_NAME overrides the above
+		resource.WithTelemetrySDK(),
+		resource.WithHost())
+	if err != nil {
+		return nil, fmt.Errorf("initTracing: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res))
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// root span of the request. its name and status are decided once we know the app and the response.
+func startRequestSpan(r *http.Request) (*http.Request, trace.Span) {
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+
+	ctx, span := ertracing.Start(ertracing.Extract(r.Context(), r.Header), r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.scheme", scheme),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("server.address", r.Host),
+			attribute.String("client.address", r.RemoteAddr),
+			attribute.String("user_agent.original", r.UserAgent())))
+
+	return r.WithContext(ctx), span
+}
+
+func endRequestSpan(span trace.Span, r *http.Request, mount *Mount, statusCode int) {
+	if mount != nil {
+		span.SetName(r.Method + " " + mount.App.ID)
+		span.SetAttributes(
+			attribute.String("edgerouter.app", mount.App.ID),
+			attribute.String("edgerouter.frontend", mount.frontend))
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", statusCode))
+
+	if statusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+
+	span.End()
+}
+
+// span for a backend, so that e.g. time spent in an auth backend can be told apart from time spent
+// in the authorized backend (the child span)
+func withBackendSpan(backend http.Handler, kind string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := ertracing.Start(r.Context(), kind, trace.WithAttributes(attribute.String("edgerouter.backend", kind)))
+		defer span.End()
+
+		backend.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,63 @@
+package erserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/function61/edgerouter/pkg/erconfig"
+	"github.com/function61/edgerouter/pkg/ertracing"
+	"github.com/function61/gokit/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	upstreamTraceparent := ""
+
+	backend := withBackendSpan(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders := http.Header{}
+		ertracing.Inject(r.Context(), upstreamHeaders)
+		upstreamTraceparent = upstreamHeaders.Get("traceparent")
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}), "reverse_proxy")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	mount := &Mount{
+		App: erconfig.SimpleApplication(
+			"wiki",
+			erconfig.SimpleHostnameFrontend("wiki.example.com"),
+			erconfig.ReverseProxyBackend([]string{"http://127.0.0.1:8080"}, nil, false)),
+	}
+
+	req, span := startRequestSpan(req)
+	backend.ServeHTTP(httptest.NewRecorder(), req)
+	endRequestSpan(span, req, mount, http.StatusServiceUnavailable)
+
+	spans := recorder.Ended()
+	assert.Assert(t, len(spans) == 2)
+
+	backendSpan, requestSpan := spans[0], spans[1]
+
+	// continues the client's trace
+	assert.EqualString(t, requestSpan.Name(), "GET wiki")
+	assert.EqualString(t, requestSpan.SpanContext().TraceID().String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.EqualString(t, requestSpan.Parent().SpanID().String(), "00f067aa0ba902b7")
+	assert.Assert(t, requestSpan.Status().Code == codes.Error)
+
+	assert.EqualString(t, backendSpan.Name(), "reverse_proxy")
+	assert.EqualString(t, backendSpan.Parent().SpanID().String(), requestSpan.SpanContext().SpanID().String())
+
+	// upstream continues our trace, as a child of the backend span
+	assert.EqualString(t, upstreamTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+backendSpan.SpanContext().SpanID().String()+"-01")
+}
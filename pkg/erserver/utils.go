@@ -2,6 +2,7 @@ package erserver
 
 import (
 	"context"
+	"log/slog"
 	"net"
 	"net/http"
 	"strings"
@@ -55,14 +56,14 @@ func cancelableServer(ctx context.Context, srv *http.Server, listener func() err
 
 // like its `New()` but don't error if file doesn't exist.
 // (still errors if existence check fails)
-func newFileDiscoveryIfFileExists(path string) (erdiscovery.Reader, error) {
+func newFileDiscoveryIfFileExists(path string, logger *slog.Logger) (erdiscovery.Reader, error) {
 	exists, err := fileexists.Exists(path)
 	if err != nil {
 		return nil, err
 	}
 
 	if exists {
-		return filediscovery.New(path), nil
+		return filediscovery.New(path, logger), nil
 	} else {
 		return nil, nil
 	}
@@ -0,0 +1,42 @@
+// Distributed tracing (OpenTelemetry). Spans go nowhere (and cost next to nothing) unless the
+// server has configured an exporter.
+package ertracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/function61/edgerouter"
+)
+
+func Start(ctx context.Context, spanName string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, spanName, opts...)
+}
+
+// marks the span failed if there was an error
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// continues the trace that the client (or a proxy in front of us) started (W3C `traceparent`)
+func Extract(ctx context.Context, headers http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(headers))
+}
+
+// makes the upstream continue our trace. replaces the client's `traceparent` (if any), since
+// we're the upstream's parent now.
+func Inject(ctx context.Context, headers http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(headers))
+}
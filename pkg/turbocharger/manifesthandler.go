@@ -18,7 +18,10 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/function61/edgerouter/pkg/ertracing"
 	"github.com/function61/edgerouter/pkg/syncutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ManifestHandler struct {
@@ -75,9 +78,25 @@ func newManifestHandlerWithCaches(originFilesAndManifests CASPair, cacheGzipped
 }
 
 func (h *ManifestHandler) ServeHTTPFromManifest(manifestID ObjectID, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := ertracing.Start(r.Context(), "turbocharger", trace.WithAttributes(
+		attribute.String("turbocharger.manifest_id", manifestID.String())))
+	defer span.End()
+
+	err := h.serveHTTPFromManifest(manifestID, w, r.WithContext(ctx), func(cacheResult string) {
+		span.SetAttributes(attribute.String("turbocharger.cache", cacheResult))
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		ertracing.RecordError(span, err)
+	}
+
+	return err
+}
+
+// cacheResult is called with "hit" | "miss" | "not_modified" | "not_found"
+func (h *ManifestHandler) serveHTTPFromManifest(manifestID ObjectID, w http.ResponseWriter, r *http.Request, cacheResult func(string)) error {
 	key := r.URL.Path // TODO: improve
 
-	manifest, err := h.resolveManifest(manifestID)
+	manifest, err := h.resolveManifest(r.Context(), manifestID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return err
@@ -89,6 +108,7 @@ func (h *ManifestHandler) ServeHTTPFromManifest(manifestID ObjectID, w http.Resp
 			if customNotFoundPage, customPageExists := manifest.files["/404.html"]; customPageExists {
 				return customNotFoundPage, http.StatusNotFound, nil
 			} else {
+				cacheResult("not_found")
 				http.NotFound(w, r)
 				return Path{}, 0, fs.ErrNotExist // TODO: what semantics to apply to our error return?
 			}
@@ -103,6 +123,7 @@ func (h *ManifestHandler) ServeHTTPFromManifest(manifestID ObjectID, w http.Resp
 	ifNoneMatch := r.Header.Get("If-None-Match")
 
 	if ifNoneMatch == file.ContentID.ETagUncompressed() || ifNoneMatch == file.ContentID.ETagGZipped() {
+		cacheResult("not_modified")
 		w.WriteHeader(http.StatusNotModified)
 		return nil
 	}
@@ -114,11 +135,16 @@ func (h *ManifestHandler) ServeHTTPFromManifest(manifestID ObjectID, w http.Resp
 	}
 
 	if served {
+		cacheHits.Inc()
+		cacheResult("hit")
 		return nil
 	}
 
 	// => cache miss (from both) -> fallback to serving from origin (+ try hydrating cache)
 
+	cacheMisses.Inc()
+	cacheResult("miss")
+
 	return h.hydrateCacheFromOriginAndServeFromCache(file, status, w, r)
 }
 
@@ -247,11 +273,22 @@ func (h *ManifestHandler) hydrateCacheFromOriginAndServeFromCache(file Path, sta
 
 		// we were the first one to get a lock => we're responsible for hydrating the cache
 
-		contentOriginal, err := h.originFilesAndManifests.Files.GetObject(context.Background(), file.ContentID)
+		_, span := ertracing.Start(r.Context(), "turbocharger hydrate", trace.WithAttributes(
+			attribute.String("turbocharger.content_id", file.ContentID.String())))
+		defer span.End()
+
+		contentOriginalBody, err := h.originFilesAndManifests.Files.GetObject(context.Background(), file.ContentID)
 		if err != nil {
+			ertracing.RecordError(span, err)
 			return err // "not exists" shouldn't ever happen, because manifest said the file would be here
 		}
-		defer contentOriginal.Close()
+		defer contentOriginalBody.Close()
+
+		contentOriginal := &countingReader{Reader: contentOriginalBody}
+		defer func() {
+			hydratedBytes.Add(float64(contentOriginal.bytesRead))
+			span.SetAttributes(attribute.Int64("turbocharger.hydrated_bytes", contentOriginal.bytesRead))
+		}()
 
 		// either insert into the gzipped cache or the uncompressed cache
 		contentMaybeCompressed, cacheToUse, gzipWriterDone := func() (io.Reader, CAS, <-chan error) {
@@ -282,10 +319,13 @@ func (h *ManifestHandler) hydrateCacheFromOriginAndServeFromCache(file Path, sta
 
 		if err := cacheToUse.InsertObject(context.Background(), file.ContentID, contentMaybeCompressed, "dummy"); err != nil {
 			<-gzipWriterDone
+			ertracing.RecordError(span, err)
 			return err
 		}
 
-		return <-gzipWriterDone
+		err = <-gzipWriterDone
+		ertracing.RecordError(span, err)
+		return err
 	}()
 	if err != nil {
 		return err
@@ -304,7 +344,9 @@ func (h *ManifestHandler) hydrateCacheFromOriginAndServeFromCache(file Path, sta
 }
 
 // finds the file list that tells us which named files our file tree contains
-func (h *ManifestHandler) resolveManifest(manifestID ObjectID) (*optimizedManifest, error) {
+// ctx is only for tracing. the download is shared by all requests waiting for it, so it must not be
+// canceled if the requesting client goes away.
+func (h *ManifestHandler) resolveManifest(ctx context.Context, manifestID ObjectID) (*optimizedManifest, error) {
 	// first check if manifest is already in in-RAM cache
 	manifestOptimized, manifestInRAM, manifestSpecificMutexRelease := func() (*optimizedManifest, bool, func()) {
 		h.cachedManifestsMu.Lock()
@@ -332,13 +374,17 @@ func (h *ManifestHandler) resolveManifest(manifestID ObjectID) (*optimizedManife
 		unlock := h.originManifestDownloadLocks.Lock(manifestID.String())
 		unlock() // it has now either succeeded or failed
 
-		return h.resolveManifest(manifestID) // retry by re-entering this func
+		return h.resolveManifest(ctx, manifestID) // retry by re-entering this func
 	}
 	defer manifestSpecificMutexRelease()
 
 	// slow path for manifest still being unknown to our RAM-based cache.
 	// there are no competing producers for the same manifest below this line.
 
+	_, span := ertracing.Start(ctx, "turbocharger manifest load", trace.WithAttributes(
+		attribute.String("turbocharger.manifest_id", manifestID.String())))
+	defer span.End()
+
 	manifest, err := func() (*Manifest, error) {
 		// try first from cache (covers loadbalancer restarts without needing access to origin)
 		manifest, err := h.cacheUncompressed.GetObject(context.Background(), manifestID)
@@ -346,6 +392,8 @@ func (h *ManifestHandler) resolveManifest(manifestID ObjectID) (*optimizedManife
 		case err == nil: // fast-path
 			defer manifest.Close()
 
+			manifestLoads.WithLabelValues("cache").Inc()
+
 			return DecodeManifest(manifest)
 		case !errors.Is(err, fs.ErrNotExist): // actually unexpected error
 			h.logger.Error("read cached manifest failed", "error", err, "manifest_id", manifestID.String())
@@ -358,6 +406,8 @@ func (h *ManifestHandler) resolveManifest(manifestID ObjectID) (*optimizedManife
 		}
 		defer manifest.Close()
 
+		manifestLoads.WithLabelValues("origin").Inc()
+
 		// need to buffer because we need to read this twice
 		manifestBuf, err := io.ReadAll(manifest)
 		if err != nil {
@@ -372,6 +422,7 @@ func (h *ManifestHandler) resolveManifest(manifestID ObjectID) (*optimizedManife
 		return DecodeManifest(bytes.NewReader(manifestBuf))
 	}()
 	if err != nil {
+		ertracing.RecordError(span, err)
 		return nil, err
 	}
 
@@ -413,3 +464,14 @@ func clientSupportsGzip(r *http.Request) bool {
 	// FIXME: this is hacky
 	return strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
 }
+
+type countingReader struct {
+	io.Reader
+	bytesRead int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.bytesRead += int64(n)
+	return n, err
+}
@@ -0,0 +1,31 @@
+package turbocharger
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "er_turbocharger_cache_hits",
+		Help: "Files served from the local cache.",
+	})
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "er_turbocharger_cache_misses",
+		Help: "Files that had to be fetched from the origin (hydrating the cache).",
+	})
+	hydratedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "er_turbocharger_hydrated_bytes",
+		Help: "Bytes fetched from the origin into the local cache.",
+	})
+	manifestLoads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "er_turbocharger_manifest_loads",
+		Help: "Manifests loaded into RAM, by source (\"cache\" | \"origin\").",
+	}, []string{"source"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits)
+	prometheus.MustRegister(cacheMisses)
+	prometheus.MustRegister(hydratedBytes)
+	prometheus.MustRegister(manifestLoads)
+}